@@ -0,0 +1,104 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"encoding/json"
+
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/nautible/review-env-operator/api/v1beta1"
+)
+
+// v1alpha1で表現できないv1beta1のspec、statusを保持するアノテーション
+const (
+	specAnnotation   = "review.nautible.com/v1beta1-spec"
+	statusAnnotation = "review.nautible.com/v1beta1-status"
+)
+
+// ConvertTo converts this MergeRequest to the Hub version (v1beta1).
+func (src *MergeRequest) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1beta1.MergeRequest)
+
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Annotations = copyAnnotations(src.Annotations)
+
+	// v1beta1から変換された際に退避したspec、statusを復元してからv1alpha1の値で上書きする
+	if data, ok := dst.Annotations[specAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &dst.Spec); err != nil {
+			return err
+		}
+		delete(dst.Annotations, specAnnotation)
+	}
+	if data, ok := dst.Annotations[statusAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &dst.Status); err != nil {
+			return err
+		}
+		delete(dst.Annotations, statusAnnotation)
+	}
+	if len(dst.Annotations) == 0 {
+		dst.Annotations = nil
+	}
+
+	dst.Spec.Repository.Group = src.Spec.Name
+	dst.Spec.Repository.Project = src.Spec.Application
+	dst.Spec.Repository.Host = src.Spec.BaseUrl
+	dst.Spec.Source.Path = src.Spec.ManifestPath
+	dst.Spec.Source.TargetRevision = src.Spec.TargetRevision
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1beta1) to this version.
+func (dst *MergeRequest) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1beta1.MergeRequest)
+
+	dst.ObjectMeta = src.ObjectMeta
+	dst.Annotations = copyAnnotations(src.Annotations)
+
+	dst.Spec.Name = src.Spec.Repository.Group
+	dst.Spec.Application = src.Spec.Repository.Project
+	dst.Spec.BaseUrl = src.Spec.Repository.Host
+	dst.Spec.ManifestPath = src.Spec.Source.Path
+	dst.Spec.TargetRevision = src.Spec.Source.TargetRevision
+
+	// v1alpha1に存在しない項目を失わないようspec、status全体をアノテーションに退避する
+	spec, err := json.Marshal(src.Spec)
+	if err != nil {
+		return err
+	}
+	status, err := json.Marshal(src.Status)
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[specAnnotation] = string(spec)
+	dst.Annotations[statusAnnotation] = string(status)
+	return nil
+}
+
+func copyAnnotations(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/nautible/review-env-operator/api/v1beta1"
+)
+
+func TestConvertRoundTripFromV1alpha1(t *testing.T) {
+	src := &MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "demo1-demo1pj1-feature-a",
+			Namespace:   "operator-system",
+			Annotations: map[string]string{"example.com/key": "value"},
+		},
+		Spec: MergeRequestSpec{
+			Name:           "demo1",
+			Application:    "demo1pj1",
+			BaseUrl:        "http://gitlab-webservice-default.gitlab.svc.cluster.local:8181",
+			ManifestPath:   "manifests",
+			TargetRevision: "feature/a",
+		},
+	}
+
+	hub := &v1beta1.MergeRequest{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if hub.Spec.Repository.Group != "demo1" || hub.Spec.Repository.Project != "demo1pj1" {
+		t.Errorf("unexpected repository: %+v", hub.Spec.Repository)
+	}
+	if hub.Spec.Source.Path != "manifests" || hub.Spec.Source.TargetRevision != "feature/a" {
+		t.Errorf("unexpected source: %+v", hub.Spec.Source)
+	}
+
+	dst := &MergeRequest{}
+	if err := dst.ConvertFrom(hub); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if !reflect.DeepEqual(src.Spec, dst.Spec) {
+		t.Errorf("spec changed in round trip:\n got  %+v\n want %+v", dst.Spec, src.Spec)
+	}
+	if dst.Annotations["example.com/key"] != "value" {
+		t.Errorf("annotation lost in round trip: %v", dst.Annotations)
+	}
+}
+
+func TestConvertRoundTripFromV1beta1(t *testing.T) {
+	src := &v1beta1.MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "demo1-demo1pj1-feature-a",
+			Namespace: "operator-system",
+		},
+		Spec: v1beta1.MergeRequestSpec{
+			Repository: v1beta1.RepositorySpec{
+				Host:    "http://gitlab.example.com",
+				Group:   "demo1",
+				Project: "demo1pj1",
+				URL:     "http://gitlab.example.com/demo1/demo1pj1.git",
+			},
+			Source: v1beta1.SourceSpec{
+				Type:           v1beta1.SourceTypeKustomize,
+				Path:           "manifests/overlays/dev",
+				TargetRevision: "feature/a",
+			},
+			Routing: v1beta1.RoutingSpec{
+				Gateway: "review-gateway",
+				Hosts:   []string{"review.example.com"},
+				Port:    80,
+			},
+			Lifecycle: v1beta1.LifecycleSpec{
+				TTL: &metav1.Duration{Duration: 72 * time.Hour},
+			},
+		},
+		Status: v1beta1.MergeRequestStatus{
+			Policy: "default",
+		},
+	}
+
+	spoke := &MergeRequest{}
+	if err := spoke.ConvertFrom(src); err != nil {
+		t.Fatalf("ConvertFrom: %v", err)
+	}
+	if spoke.Spec.Name != "demo1" || spoke.Spec.TargetRevision != "feature/a" {
+		t.Errorf("unexpected spec: %+v", spoke.Spec)
+	}
+
+	dst := &v1beta1.MergeRequest{}
+	if err := spoke.ConvertTo(dst); err != nil {
+		t.Fatalf("ConvertTo: %v", err)
+	}
+	if !reflect.DeepEqual(src.Spec, dst.Spec) {
+		t.Errorf("spec changed in round trip:\n got  %+v\n want %+v", dst.Spec, src.Spec)
+	}
+	if !reflect.DeepEqual(src.Status, dst.Status) {
+		t.Errorf("status changed in round trip:\n got  %+v\n want %+v", dst.Status, src.Status)
+	}
+	if _, ok := dst.Annotations[specAnnotation]; ok {
+		t.Errorf("internal annotation leaked into v1beta1: %v", dst.Annotations)
+	}
+	if src.Annotations != nil {
+		t.Errorf("source annotations mutated: %v", src.Annotations)
+	}
+}
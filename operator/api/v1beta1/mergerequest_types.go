@@ -0,0 +1,809 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MergeRequestSpec defines the desired state of MergeRequest
+type MergeRequestSpec struct {
+	// Repository identifies the git repository the review environment is built from.
+	Repository RepositorySpec `json:"repository"`
+
+	// Source describes how Argo CD renders the manifests of the repository.
+	// +optional
+	Source SourceSpec `json:"source,omitempty"`
+
+	// Routing describes how the review environment is exposed.
+	// +optional
+	Routing RoutingSpec `json:"routing,omitempty"`
+
+	// Lifecycle describes how long the review environment is kept.
+	// +optional
+	Lifecycle LifecycleSpec `json:"lifecycle,omitempty"`
+
+	// ArgoCD describes the Argo CD Application of the review environment.
+	// +optional
+	ArgoCD ArgoCDSpec `json:"argocd,omitempty"`
+
+	// Destination is the cluster the review environment is deployed to.
+	// Chosen by the ReviewEnvironmentPolicy, or the cluster running Argo CD, when empty.
+	// +optional
+	Destination DestinationSpec `json:"destination,omitempty"`
+
+	// Components are the projects of the group deployed together into the review environment,
+	// each as its own Argo CD Application. When empty, only repository.project is deployed.
+	// source.targetRevision remains the branch identifying the review environment.
+	// +optional
+	Components []ComponentSpec `json:"components,omitempty"`
+
+	// Hooks are the jobs run in the namespace of the review environment,
+	// e.g. database migrations and seeding.
+	// +optional
+	Hooks HooksSpec `json:"hooks,omitempty"`
+
+	// SmokeTest is run against the review environment once all the Argo CD Applications are synced and healthy.
+	// +optional
+	SmokeTest SmokeTestSpec `json:"smokeTest,omitempty"`
+
+	// Copies are the Secrets and ConfigMaps copied into the namespace of the review environment.
+	// +optional
+	Copies []CopySpec `json:"copies,omitempty"`
+
+	// Origin is the merge request the review environment is built for. Set by the webhook.
+	// +optional
+	Origin OriginSpec `json:"origin,omitempty"`
+
+	// Variables are the per-environment variables rendered into a ConfigMap in the namespace of the review environment.
+	// +optional
+	Variables VariablesSpec `json:"variables,omitempty"`
+
+	// NetworkPolicy isolates the review environment from the other review environments of the namespace.
+	// +optional
+	NetworkPolicy NetworkPolicySpec `json:"networkPolicy,omitempty"`
+}
+
+// NetworkPolicySpec describes the NetworkPolicy of the review environment.
+// Ingress is allowed from the gateway, the pods of the same review environment and,
+// in Baseline mode, the pods of the baseline environments.
+type NetworkPolicySpec struct {
+	// Enabled creates the NetworkPolicy. Defaults to false.
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// PodLabel is the label of the pods whose value is the name of the Argo CD Application deploying them.
+	// Defaults to "app.kubernetes.io/instance".
+	// +optional
+	PodLabel string `json:"podLabel,omitempty"`
+
+	// GatewayNamespace is the namespace of the Istio ingress gateway. Defaults to "istio-system".
+	// +optional
+	GatewayNamespace string `json:"gatewayNamespace,omitempty"`
+
+	// GatewayLabels select the pods of the Istio ingress gateway. Defaults to istio=ingressgateway.
+	// +optional
+	GatewayLabels map[string]string `json:"gatewayLabels,omitempty"`
+
+	// Ingress are the ingress rules allowed in addition to the defaults.
+	// +optional
+	Ingress []networkingv1.NetworkPolicyIngressRule `json:"ingress,omitempty"`
+
+	// Egress restricts the egress traffic to the pods of the same review environment, the baseline environment in Baseline mode, DNS and these rules.
+	// Egress is not restricted when empty.
+	// +optional
+	Egress []networkingv1.NetworkPolicyEgressRule `json:"egress,omitempty"`
+}
+
+// OriginSpec is the merge request the review environment is built for
+type OriginSpec struct {
+	// IID is the merge request id in the project.
+	// +optional
+	IID int64 `json:"iid,omitempty"`
+
+	// CommitSHA is the last commit of the source branch.
+	// +optional
+	CommitSHA string `json:"commitSHA,omitempty"`
+
+	// Author is the username of the author of the merge request.
+	// +optional
+	Author string `json:"author,omitempty"`
+
+	// ImageTag is the tag of the container image built by the pipeline for CommitSHA.
+	// +optional
+	ImageTag string `json:"imageTag,omitempty"`
+
+	// SourceProject is the path of the fork the merge request comes from.
+	// Empty unless the merge request comes from a fork.
+	// +optional
+	SourceProject string `json:"sourceProject,omitempty"`
+
+	// TargetProject is the path of the project the merge request belongs to, used for notifications.
+	// Defaults to repository.group/repository.project.
+	// +optional
+	TargetProject string `json:"targetProject,omitempty"`
+
+	// Provider is the git hosting that sent the merge request, e.g. gitea or bitbucket-server.
+	// Defaults to GitLab. Notifications are only sent to GitLab.
+	// +optional
+	Provider string `json:"provider,omitempty"`
+}
+
+// VariablesSpec describes the per-environment variables.
+// The ConfigMap always holds REVIEW_URL, REVIEW_BRANCH, REVIEW_MR_IID, REVIEW_COMMIT_SHA, REVIEW_AUTHOR and REVIEW_IMAGE_TAG.
+type VariablesSpec struct {
+	// Values are user-defined variables, rendered as Go templates.
+	// Available fields are .Group, .Project, .Branch, .Revision, .Name, .URL, .IID, .CommitSHA, .Author and .ImageTag.
+	// They override the well-known variables of the same name.
+	// +optional
+	Values map[string]string `json:"values,omitempty"`
+
+	// ConfigMapName is the name of the ConfigMap. Defaults to the name of the Argo CD Application followed by "-env".
+	// +optional
+	ConfigMapName string `json:"configMapName,omitempty"`
+
+	// Inject adds the variables to the Argo CD source. Defaults to None.
+	// +optional
+	Inject VariablesInjection `json:"inject,omitempty"`
+
+	// Prefix is the Helm parameter prefix ("<prefix>.<KEY>", defaults to "review")
+	// or the Kustomize common annotation prefix ("<prefix>/<KEY>", defaults to "review.nautible.com").
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// VariablesInjection is how the variables are added to the Argo CD source
+// +kubebuilder:validation:Enum=None;Helm;Kustomize
+type VariablesInjection string
+
+const (
+	VariablesInjectionNone VariablesInjection = "None"
+	// VariablesInjectionHelm adds the variables as Helm parameters
+	VariablesInjectionHelm VariablesInjection = "Helm"
+	// VariablesInjectionKustomize adds the variables as Kustomize common annotations
+	VariablesInjectionKustomize VariablesInjection = "Kustomize"
+)
+
+// CopyKind is the kind of the object copied into the review namespace
+// +kubebuilder:validation:Enum=Secret;ConfigMap
+type CopyKind string
+
+const (
+	CopyKindSecret    CopyKind = "Secret"
+	CopyKindConfigMap CopyKind = "ConfigMap"
+)
+
+// CopySpec is a Secret or ConfigMap copied from a template namespace into the namespace of the review environment.
+// The copy is kept in sync with the source and removed with the last review environment using it.
+// Label the source with review.nautible.com/copy-source: "true" to sync the copies as soon as it changes,
+// otherwise they are synced on the next periodic reconcile.
+type CopySpec struct {
+	// Kind is the kind of the object.
+	Kind CopyKind `json:"kind"`
+
+	// Namespace is the template namespace of the source object, on the cluster running the operator.
+	Namespace string `json:"namespace"`
+
+	// Name is the name of the source object.
+	Name string `json:"name"`
+
+	// TargetName is a Go template rendering the name of the copy, e.g. "db-{{ .Branch }}". Defaults to name.
+	// Available fields are .Group, .Project, .Branch, .Revision, .Name and .URL.
+	// +optional
+	TargetName string `json:"targetName,omitempty"`
+
+	// Keys are the keys copied, optionally renamed. Every key is copied when empty.
+	// +optional
+	Keys []KeyMapping `json:"keys,omitempty"`
+
+	// Template renders the values as Go templates with the fields of targetName.
+	// +optional
+	Template bool `json:"template,omitempty"`
+}
+
+// KeyMapping is a key copied from the source object
+type KeyMapping struct {
+	// Key is the key in the source object.
+	Key string `json:"key"`
+
+	// As is the key in the copy. Defaults to key.
+	// +optional
+	As string `json:"as,omitempty"`
+}
+
+// SmokeTestSpec describes the smoke test of the review environment.
+// It runs again when the revision synced by Argo CD changes.
+type SmokeTestSpec struct {
+	// URL is the base URL the review environment is reached at, e.g. http://istio-ingressgateway.istio-system.
+	// Defaults to http:// and the first host of routing.hosts.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Probes are HTTP GET requests sent by the operator to the review environment.
+	// +optional
+	Probes []ProbeSpec `json:"probes,omitempty"`
+
+	// Job is run in the namespace of the review environment after the probes pass.
+	// The environment variables REVIEW_URL and REVIEW_BRANCH are added to the container.
+	// +optional
+	Job *HookSpec `json:"job,omitempty"`
+}
+
+// ProbeSpec is an HTTP GET request checking the review environment
+type ProbeSpec struct {
+	// Path is the request path. The branch of the review environment is added as the query parameter "branch".
+	Path string `json:"path"`
+
+	// Status is the expected status code. Defaults to 200.
+	// +optional
+	Status int32 `json:"status,omitempty"`
+
+	// Contains is a string the response body must contain.
+	// +optional
+	Contains string `json:"contains,omitempty"`
+}
+
+// HooksSpec declares the jobs run at each phase of the review environment.
+// The jobs of a phase run one by one in the order listed.
+type HooksSpec struct {
+	// PreSync jobs run before the Argo CD Applications are created or updated.
+	// +optional
+	PreSync []HookSpec `json:"preSync,omitempty"`
+
+	// PostSync jobs run once all the Argo CD Applications are synced and healthy.
+	// +optional
+	PostSync []HookSpec `json:"postSync,omitempty"`
+
+	// Teardown jobs run before the resources of the review environment are removed.
+	// The resources are removed even if they fail.
+	// +optional
+	Teardown []HookSpec `json:"teardown,omitempty"`
+}
+
+// HookSpec is a job run as a Kubernetes Job
+type HookSpec struct {
+	// Name identifies the hook in the phase.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// Image is the container image of the job.
+	Image string `json:"image"`
+
+	// Command overrides the entrypoint of the image.
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Args are the arguments of the command.
+	// +optional
+	Args []string `json:"args,omitempty"`
+
+	// Env are the environment variables of the container.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// BackoffLimit is the number of retries before the job is marked as failed. Defaults to 3.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+
+	// ActiveDeadlineSeconds is the time limit of the job. Defaults to 600.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+}
+
+// ComponentSpec is a project deployed as a part of the review environment
+type ComponentSpec struct {
+	// Project is the GitLab project name in repository.group.
+	Project string `json:"project"`
+
+	// URL overrides the clone URL built from repository.host, repository.group and project.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Type is the kind of manifests. Defaults to source.type.
+	// +optional
+	Type SourceType `json:"type,omitempty"`
+
+	// Path is the manifests root path in the repository. Defaults to source.path.
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// TargetRevision is the revision of the project.
+	// Defaults to "HEAD" (the default branch) for projects without a branch of the review environment.
+	// +optional
+	TargetRevision string `json:"targetRevision,omitempty"`
+
+	// PathPrefix routes the requests whose path starts with the prefix to this component.
+	// The component without prefix receives the other requests.
+	// +optional
+	PathPrefix string `json:"pathPrefix,omitempty"`
+}
+
+// RepositorySpec identifies a git repository
+type RepositorySpec struct {
+	// Host is the base URL of the git host, e.g. http://gitlab.example.com
+	Host string `json:"host"`
+
+	// Group is the GitLab group (namespace) of the project.
+	// It is also used as the namespace of the review environment.
+	Group string `json:"group"`
+
+	// Project is the GitLab project name.
+	// Optional when the review environment is made of components.
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// URL overrides the clone URL built from host, group and project.
+	// +optional
+	URL string `json:"url,omitempty"`
+}
+
+const (
+	// GroupLabel and ProjectLabel are matched by the selector of ReviewEnvironmentPolicy
+	// in addition to the labels of the MergeRequest.
+	GroupLabel   = "review.nautible.com/group"
+	ProjectLabel = "review.nautible.com/project"
+
+	// CopySourceLabel set to "true" marks a Secret or ConfigMap as a source of copies.
+	// The operator watches only labeled sources and syncs the copies as soon as they change.
+	CopySourceLabel = "review.nautible.com/copy-source"
+
+	// BaselineGroupLabel is set on the baseline Application of a group in Baseline mode.
+	BaselineGroupLabel = "review.nautible.com/baseline-group"
+
+	// ForkLabel is set to "true" by the webhook on MergeRequests from forks,
+	// so that a ReviewEnvironmentPolicy can select them.
+	ForkLabel = "review.nautible.com/fork"
+
+	// PriorityAnnotation is an integer moving the MergeRequest ahead of the queue.
+	// Higher values are provisioned first. Defaults to 0.
+	PriorityAnnotation = "review.nautible.com/priority"
+
+	// DeletionReasonAnnotation records why the MergeRequest is deleted.
+	// It is set by the webhook for merged or closed merge requests and by the operator on expiry.
+	DeletionReasonAnnotation = "review.nautible.com/deletion-reason"
+
+	// TTLExtensionAnnotation is a duration added to spec.lifecycle.ttl, capped by the policy's maxTTL.
+	// It is set by the "/review extend" command.
+	TTLExtensionAnnotation = "review.nautible.com/ttl-extension"
+
+	// RedeployAnnotation requests a hard refresh and sync of the Argo CD Applications.
+	// Changing its value (the webhook sets the current time) triggers a new redeploy.
+	RedeployAnnotation = "review.nautible.com/redeploy"
+)
+
+const (
+	DeletionReasonMerged  = "merged"
+	DeletionReasonClosed  = "closed"
+	DeletionReasonExpired = "expired"
+	// DeletionReasonDestroyed is set by the "/review destroy" command.
+	DeletionReasonDestroyed = "destroyed"
+	// DeletionReasonOptedOut is set when the labels of the merge request no longer select a review environment.
+	DeletionReasonOptedOut = "opted-out"
+	// DeletionReasonPathsUnchanged is set when the changed files of the merge request no longer match the path filters.
+	DeletionReasonPathsUnchanged = "paths-unchanged"
+)
+
+// SourceType is the kind of manifests stored in the repository
+// +kubebuilder:validation:Enum=Directory;Kustomize;Helm
+type SourceType string
+
+const (
+	SourceTypeDirectory SourceType = "Directory"
+	SourceTypeKustomize SourceType = "Kustomize"
+	SourceTypeHelm      SourceType = "Helm"
+)
+
+// SourceSpec describes the manifests deployed by Argo CD
+type SourceSpec struct {
+	// Type is the kind of manifests. Argo CD detects it automatically when empty.
+	// +optional
+	Type SourceType `json:"type,omitempty"`
+
+	// Path is the manifests root path in the repository. Defaults to "/".
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// TargetRevision is the branch, tag or commit to deploy. Defaults to "HEAD".
+	// +optional
+	TargetRevision string `json:"targetRevision,omitempty"`
+}
+
+// RoutingSpec describes the VirtualService of the review environment
+type RoutingSpec struct {
+	// Gateway is the Istio gateway the VirtualService is bound to. Defaults to "application-gateway".
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// Hosts are the hosts of the VirtualService. Defaults to "*".
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Port is the port of the service receiving the traffic. Defaults to 8080.
+	// +optional
+	Port uint32 `json:"port,omitempty"`
+
+	// Mode is how the review environment is deployed and routed. Defaults to Isolated.
+	// +optional
+	Mode RoutingMode `json:"mode,omitempty"`
+
+	// Header carries the branch of the review environment in Baseline mode.
+	// Services must propagate it on their outgoing requests. Defaults to "x-review-env".
+	// +optional
+	Header string `json:"header,omitempty"`
+
+	// BaselineService is the service of the baseline environment in Baseline mode.
+	// Defaults to the project name.
+	// +optional
+	BaselineService string `json:"baselineService,omitempty"`
+
+	// Baseline is the baseline environment shared by the MergeRequests of the group in Baseline mode.
+	// +optional
+	Baseline BaselineSpec `json:"baseline,omitempty"`
+}
+
+// BaselineSpec describes the long-lived baseline environment of a group
+type BaselineSpec struct {
+	// Project is the project holding the manifests of every service of the group.
+	// Defaults to "baseline".
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// URL overrides the clone URL built from host, group and project.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Source describes the manifests of the baseline environment.
+	// TargetRevision defaults to "HEAD", the default branch.
+	// +optional
+	Source SourceSpec `json:"source,omitempty"`
+}
+
+// RoutingMode is how the review environment is deployed and routed
+// +kubebuilder:validation:Enum=Isolated;Baseline
+type RoutingMode string
+
+const (
+	// RoutingModeIsolated deploys the review environment on its own
+	RoutingModeIsolated RoutingMode = "Isolated"
+	// RoutingModeBaseline deploys only the changed service and routes the other requests
+	// to the long-lived baseline environment of the default branch
+	RoutingModeBaseline RoutingMode = "Baseline"
+)
+
+// LifecycleSpec describes how long the review environment is kept
+type LifecycleSpec struct {
+	// TTL is the time after which the review environment is deleted. Kept until the merge request is closed when empty.
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+}
+
+// DestinationSpec identifies the cluster the review environment is deployed to
+type DestinationSpec struct {
+	// Name is the Argo CD cluster name. Takes precedence over server.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Server is the API server URL of the cluster.
+	// +optional
+	Server string `json:"server,omitempty"`
+
+	// KubeconfigSecret is the name of the Secret holding the kubeconfig (key "kubeconfig") of the cluster,
+	// used to create the namespace and the routing of the review environment.
+	// Required unless the cluster is the one running the operator.
+	// +optional
+	KubeconfigSecret string `json:"kubeconfigSecret,omitempty"`
+}
+
+// IsZero reports whether no cluster is specified
+func (d DestinationSpec) IsZero() bool {
+	return d.Name == "" && d.Server == ""
+}
+
+// Key identifies the cluster by its name or server URL
+func (d DestinationSpec) Key() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return d.Server
+}
+
+// ArgoCDSpec describes the Argo CD Application of the review environment
+type ArgoCDSpec struct {
+	// Project is the Argo CD AppProject of the Application.
+	// Defaults to the project given by the operator flags.
+	// +optional
+	Project string `json:"project,omitempty"`
+
+	// SyncPolicy controls the automated sync of the Application.
+	// +optional
+	SyncPolicy *SyncPolicySpec `json:"syncPolicy,omitempty"`
+}
+
+// SyncPolicySpec controls the automated sync of the Argo CD Application
+type SyncPolicySpec struct {
+	// SelfHeal reverts manual changes in the cluster. Defaults to true.
+	// +optional
+	SelfHeal *bool `json:"selfHeal,omitempty"`
+
+	// Prune deletes resources removed from git. Defaults to true.
+	// +optional
+	Prune *bool `json:"prune,omitempty"`
+
+	// AllowEmpty allows syncing an Application without resources. Defaults to false.
+	// +optional
+	AllowEmpty *bool `json:"allowEmpty,omitempty"`
+
+	// SyncOptions are the Argo CD sync options, e.g. CreateNamespace=true, ServerSideApply=true.
+	// +optional
+	SyncOptions []string `json:"syncOptions,omitempty"`
+
+	// Retry controls the retry of failed syncs.
+	// +optional
+	Retry *RetrySpec `json:"retry,omitempty"`
+}
+
+// RetrySpec controls the retry of failed syncs
+type RetrySpec struct {
+	// Limit is the maximum number of retries. Defaults to 5.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	Limit *int64 `json:"limit,omitempty"`
+
+	// Backoff controls the interval between retries.
+	// +optional
+	Backoff *BackoffSpec `json:"backoff,omitempty"`
+}
+
+// BackoffSpec controls the interval between retries
+type BackoffSpec struct {
+	// Duration is the interval before the first retry. Defaults to "5s".
+	// +optional
+	Duration string `json:"duration,omitempty"`
+
+	// Factor multiplies the interval after each retry. Defaults to 2.
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	Factor *int64 `json:"factor,omitempty"`
+
+	// MaxDuration is the upper limit of the interval. Defaults to "3m".
+	// +optional
+	MaxDuration string `json:"maxDuration,omitempty"`
+}
+
+// MergeRequestStatus defines the observed state of MergeRequest
+type MergeRequestStatus struct {
+	// Phase is the lifecycle phase of the review environment.
+	// +optional
+	Phase MergeRequestPhase `json:"phase,omitempty"`
+
+	// QueuePosition is the position in the queue while the phase is Queued, starting from 1.
+	// +optional
+	QueuePosition int32 `json:"queuePosition,omitempty"`
+
+	// ReadyTime is when the review environment first became Ready.
+	// +optional
+	ReadyTime *metav1.Time `json:"readyTime,omitempty"`
+
+	// ExpiresAt is when the review environment is deleted by the TTL, including the policy and extensions.
+	// Empty when the review environment has no TTL.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// Policy is the name of the ReviewEnvironmentPolicy applied to this MergeRequest.
+	// +optional
+	Policy string `json:"policy,omitempty"`
+
+	// Destination is the cluster the review environment was deployed to.
+	// Kept once chosen so that the environment does not move between clusters.
+	// +optional
+	Destination *DestinationSpec `json:"destination,omitempty"`
+
+	// Hooks are the states of the hook jobs.
+	// +optional
+	Hooks []HookStatus `json:"hooks,omitempty"`
+
+	// SmokeTest is the result of the smoke test.
+	// +optional
+	SmokeTest *SmokeTestStatus `json:"smokeTest,omitempty"`
+
+	// Notification is the status reported back to the merge request on GitLab.
+	// +optional
+	Notification *NotificationStatus `json:"notification,omitempty"`
+
+	// Copies are the Secrets and ConfigMaps copied into the namespace of the review environment.
+	// +optional
+	Copies []CopiedObject `json:"copies,omitempty"`
+
+	// Redeploy is the value of the redeploy annotation last handled.
+	// +optional
+	Redeploy string `json:"redeploy,omitempty"`
+
+	// Conditions are the latest observations of the review environment.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// CopiedObject is a Secret or ConfigMap copied into the namespace of the review environment
+type CopiedObject struct {
+	// Kind is the kind of the object.
+	Kind CopyKind `json:"kind"`
+
+	// Name is the name of the copy.
+	Name string `json:"name"`
+}
+
+// ConditionSmokeTestPassed is the condition reporting the result of the smoke test.
+// Its status is Unknown while the smoke test is running.
+const ConditionSmokeTestPassed = "SmokeTestPassed"
+
+// SmokeTestResult is the result of the smoke test
+type SmokeTestResult string
+
+const (
+	SmokeTestRunning SmokeTestResult = "Running"
+	SmokeTestPassed  SmokeTestResult = "Passed"
+	SmokeTestFailed  SmokeTestResult = "Failed"
+)
+
+// SmokeTestStatus is the result of the smoke test
+type SmokeTestStatus struct {
+	// Revision is the revision synced by Argo CD the smoke test ran against.
+	Revision string `json:"revision"`
+
+	// Result is the result of the smoke test.
+	Result SmokeTestResult `json:"result"`
+
+	// URL is the URL of the review environment.
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Message describes the failed probe or job.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// ProbeAttempts is the number of failed attempts of the probes for the revision.
+	// +optional
+	ProbeAttempts int32 `json:"probeAttempts,omitempty"`
+
+	// LogTail is the last lines of the log of the smoke test job.
+	// +optional
+	LogTail string `json:"logTail,omitempty"`
+
+	// CompletionTime is the time the smoke test finished.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// NotificationStatus is the status reported back to the merge request on GitLab
+type NotificationStatus struct {
+	// Phase is the last phase reported to the merge request.
+	// +optional
+	Phase MergeRequestPhase `json:"phase,omitempty"`
+
+	// NoteID is the ID of the merge request note updated on every report.
+	// +optional
+	NoteID int64 `json:"noteID,omitempty"`
+
+	// CommitSHA is the commit whose status was last reported.
+	// +optional
+	CommitSHA string `json:"commitSHA,omitempty"`
+
+	// SmokeTest is the last smoke test result reported to the merge request.
+	// +optional
+	SmokeTest SmokeTestResult `json:"smokeTest,omitempty"`
+
+	// Message describes the last failed report.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// MergeRequestPhase is the lifecycle phase of the review environment
+type MergeRequestPhase string
+
+const (
+	// PhaseQueued waits for a free slot of maxConcurrentEnvironments
+	PhaseQueued MergeRequestPhase = "Queued"
+	// PhaseProvisioning creates the resources and waits for the Argo CD Applications to become healthy
+	PhaseProvisioning MergeRequestPhase = "Provisioning"
+	// PhaseReady is synced and healthy
+	PhaseReady MergeRequestPhase = "Ready"
+	// PhaseFailed has a failed hook
+	PhaseFailed MergeRequestPhase = "Failed"
+	// PhaseDeleting removes the resources
+	PhaseDeleting MergeRequestPhase = "Deleting"
+)
+
+// HookPhase is the phase a hook runs at
+type HookPhase string
+
+const (
+	HookPhasePreSync  HookPhase = "PreSync"
+	HookPhasePostSync HookPhase = "PostSync"
+	HookPhaseTeardown HookPhase = "Teardown"
+	// HookPhaseSmokeTest is the phase of the smoke test job, not listed in the hooks
+	HookPhaseSmokeTest HookPhase = "SmokeTest"
+)
+
+// HookState is the state of a hook job
+type HookState string
+
+const (
+	HookStateRunning   HookState = "Running"
+	HookStateSucceeded HookState = "Succeeded"
+	HookStateFailed    HookState = "Failed"
+)
+
+// HookStatus is the observed state of a hook job
+type HookStatus struct {
+	// Name is the name of the hook.
+	Name string `json:"name"`
+
+	// Phase is the phase the hook runs at.
+	Phase HookPhase `json:"phase"`
+
+	// Job is the name of the Kubernetes Job.
+	Job string `json:"job"`
+
+	// State is the state of the job.
+	State HookState `json:"state"`
+
+	// Attempts is the number of failed pods of the job.
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// Message describes why the job failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:name="Group",type=string,JSONPath=`.spec.repository.group`
+//+kubebuilder:printcolumn:name="Project",type=string,JSONPath=`.spec.repository.project`
+//+kubebuilder:printcolumn:name="Revision",type=string,JSONPath=`.spec.source.targetRevision`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Queue",type=integer,JSONPath=`.status.queuePosition`,priority=1
+//+kubebuilder:printcolumn:name="SmokeTest",type=string,JSONPath=`.status.smokeTest.result`
+
+// MergeRequest is the Schema for the mergerequests API
+type MergeRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MergeRequestSpec   `json:"spec,omitempty"`
+	Status MergeRequestStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MergeRequestList contains a list of MergeRequest
+type MergeRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MergeRequest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MergeRequest{}, &MergeRequestList{})
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReviewEnvironmentPolicySpec defines the defaults and limits applied to the selected MergeRequests
+type ReviewEnvironmentPolicySpec struct {
+	// Selector selects MergeRequests by their labels and the review.nautible.com/group,
+	// review.nautible.com/project labels. An empty selector selects every MergeRequest.
+	// +optional
+	Selector metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Priority decides which policy is applied when several policies select a MergeRequest.
+	// The highest priority wins.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+
+	// ArgoCD is the default Argo CD settings of the selected MergeRequests.
+	// +optional
+	ArgoCD ArgoCDSpec `json:"argocd,omitempty"`
+
+	// Destination chooses the cluster of the selected MergeRequests.
+	// +optional
+	Destination DestinationPolicy `json:"destination,omitempty"`
+
+	// Routing is the default routing of the selected MergeRequests.
+	// +optional
+	Routing RoutingPolicy `json:"routing,omitempty"`
+
+	// Lifecycle is the default and the limit of the lifetime of the review environments.
+	// +optional
+	Lifecycle LifecyclePolicy `json:"lifecycle,omitempty"`
+
+	// Quota is the hard limit of the ResourceQuota created in the review namespace.
+	// +optional
+	Quota corev1.ResourceList `json:"quota,omitempty"`
+
+	// MaxConcurrentEnvironments limits the number of review environments provisioned at once
+	// for the selected MergeRequests. Unlimited when zero.
+	// MergeRequests beyond the limit are Queued until a review environment is deleted.
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	MaxConcurrentEnvironments int32 `json:"maxConcurrentEnvironments,omitempty"`
+
+	// ConcurrencyScope is the unit maxConcurrentEnvironments applies to. Defaults to Policy.
+	// +optional
+	ConcurrencyScope ConcurrencyScope `json:"concurrencyScope,omitempty"`
+
+	// Copies are the Secrets and ConfigMaps copied into the namespaces of the selected MergeRequests,
+	// in addition to the copies of the MergeRequest. The MergeRequest takes precedence for the same kind and name.
+	// +optional
+	Copies []CopySpec `json:"copies,omitempty"`
+
+	// NetworkPolicy is the default NetworkPolicy of the selected MergeRequests.
+	// +optional
+	NetworkPolicy NetworkPolicySpec `json:"networkPolicy,omitempty"`
+}
+
+// ConcurrencyScope is the unit maxConcurrentEnvironments applies to
+// +kubebuilder:validation:Enum=Policy;Group;Project
+type ConcurrencyScope string
+
+const (
+	// ConcurrencyScopePolicy limits all the MergeRequests selected by the policy together
+	ConcurrencyScopePolicy ConcurrencyScope = "Policy"
+	// ConcurrencyScopeGroup limits the MergeRequests of each group
+	ConcurrencyScopeGroup ConcurrencyScope = "Group"
+	// ConcurrencyScopeProject limits the MergeRequests of each project
+	ConcurrencyScopeProject ConcurrencyScope = "Project"
+)
+
+// ClusterSelection is the rule choosing a cluster among the candidates
+// +kubebuilder:validation:Enum=First;LeastLoaded
+type ClusterSelection string
+
+const (
+	// ClusterSelectionFirst always chooses the first candidate
+	ClusterSelectionFirst ClusterSelection = "First"
+	// ClusterSelectionLeastLoaded chooses the candidate running the fewest review environments
+	ClusterSelectionLeastLoaded ClusterSelection = "LeastLoaded"
+)
+
+// DestinationPolicy chooses the cluster of the review environments
+type DestinationPolicy struct {
+	// Clusters are the candidate clusters.
+	// +optional
+	Clusters []DestinationSpec `json:"clusters,omitempty"`
+
+	// Selection is the rule choosing a cluster among the candidates. Defaults to First.
+	// +optional
+	Selection ClusterSelection `json:"selection,omitempty"`
+}
+
+// RoutingPolicy is the default routing of the review environments
+type RoutingPolicy struct {
+	// Gateway is the default Istio gateway.
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// Port is the default port of the service receiving the traffic.
+	// +optional
+	Port uint32 `json:"port,omitempty"`
+
+	// Mode is the default routing mode.
+	// +optional
+	Mode RoutingMode `json:"mode,omitempty"`
+
+	// Header is the default header carrying the branch in Baseline mode.
+	// +optional
+	Header string `json:"header,omitempty"`
+
+	// Baseline is the default baseline environment of the group in Baseline mode.
+	// +optional
+	Baseline BaselineSpec `json:"baseline,omitempty"`
+
+	// HostTemplate is a Go template rendering the host of the VirtualService,
+	// e.g. "{{ .Branch }}.{{ .Project }}.review.example.com".
+	// Available fields are .Group, .Project, .Branch and .Name.
+	// +optional
+	HostTemplate string `json:"hostTemplate,omitempty"`
+}
+
+// LifecyclePolicy is the default and the limit of the lifetime of the review environments
+type LifecyclePolicy struct {
+	// TTL is the default TTL of the review environments.
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// MaxTTL is the upper limit of the TTL requested by MergeRequests.
+	// +optional
+	MaxTTL *metav1.Duration `json:"maxTTL,omitempty"`
+}
+
+// ReviewEnvironmentPolicyStatus defines the observed state of ReviewEnvironmentPolicy
+type ReviewEnvironmentPolicyStatus struct {
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Priority",type=integer,JSONPath=`.spec.priority`
+
+// ReviewEnvironmentPolicy is the Schema for the reviewenvironmentpolicies API
+type ReviewEnvironmentPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ReviewEnvironmentPolicySpec   `json:"spec,omitempty"`
+	Status ReviewEnvironmentPolicyStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ReviewEnvironmentPolicyList contains a list of ReviewEnvironmentPolicy
+type ReviewEnvironmentPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ReviewEnvironmentPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ReviewEnvironmentPolicy{}, &ReviewEnvironmentPolicyList{})
+}
@@ -19,33 +19,77 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"strings"
+	"time"
 
 	argocdv1alpha1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/argoproj/gitops-engine/pkg/health"
 	"github.com/nautible/review-env-operator/pkg/argocd"
+	"github.com/nautible/review-env-operator/pkg/cluster"
+	"github.com/nautible/review-env-operator/pkg/copier"
+	"github.com/nautible/review-env-operator/pkg/hook"
 	"github.com/nautible/review-env-operator/pkg/ingress"
+	"github.com/nautible/review-env-operator/pkg/metrics"
 	"github.com/nautible/review-env-operator/pkg/namespace"
+	"github.com/nautible/review-env-operator/pkg/network"
+	"github.com/nautible/review-env-operator/pkg/notify"
+	"github.com/nautible/review-env-operator/pkg/policy"
+	"github.com/nautible/review-env-operator/pkg/preview"
+	"github.com/nautible/review-env-operator/pkg/queue"
+	"github.com/nautible/review-env-operator/pkg/smoketest"
 	istioclient "istio.io/client-go/pkg/apis/networking/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	reviewv1alpha1 "github.com/nautible/review-env-operator/api/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+)
+
+const (
+	// フックのJobの完了を確認する間隔
+	hookPollInterval = 10 * time.Second
+	// Queuedのレビュー環境の空きを確認する間隔
+	queuePollInterval = time.Minute
 )
 
 // MergeRequestReconciler reconciles a MergeRequest object
 type MergeRequestReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	ArgoCD   argocd.Config
+	Clusters *cluster.Provider
+	Recorder record.EventRecorder
+	// Notifier はレビュー環境の状態をマージリクエストに通知する。nilの場合は通知しない
+	Notifier notify.Notifier
 }
 
 //+kubebuilder:rbac:groups=review.nautible.com,resources=mergerequests,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=review.nautible.com,resources=mergerequests/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=review.nautible.com,resources=mergerequests/finalizers,verbs=update
+//+kubebuilder:rbac:groups=review.nautible.com,resources=reviewenvironmentpolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=resourcequotas,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=argoproj.io,resources=applications,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=argoproj.io,resources=appprojects,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=networking.istio.io,resources=virtualservices,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -56,14 +100,26 @@ type MergeRequestReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.13.0/pkg/reconcile
-func (r *MergeRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *MergeRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
 	logger := log.FromContext(ctx)
 	logger.Info("start Reconcile mergerequest_controller")
 	finalizerName := "mergerequest.review.nautible.com"
 
+	// エラーはどの処理で発生したかをメトリクスとイベントに記録する
+	mr := &reviewv1beta1.MergeRequest{}
+	step := "fetch"
+	defer func() {
+		if err == nil {
+			return
+		}
+		metrics.ReconcileErrors.WithLabelValues(step).Inc()
+		if mr.UID != "" {
+			r.Recorder.Eventf(mr, corev1.EventTypeWarning, "ReconcileError", "%s failed: %v", step, err)
+		}
+	}()
+
 	// 1. MergeRequestリソースの取得
-	mr := &reviewv1alpha1.MergeRequest{}
-	err := r.Get(ctx, req.NamespacedName, mr)
+	err = r.Get(ctx, req.NamespacedName, mr)
 	if apierrors.IsNotFound(err) {
 		logger.Info("Fetch the MergeRequest instance. MergeRequest resource not found. Ignoring since object must be deleted")
 		return ctrl.Result{}, nil
@@ -73,6 +129,7 @@ func (r *MergeRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request
 	}
 
 	// 2. finalizer付与
+	step = "finalizer"
 	if !controllerutil.ContainsFinalizer(mr, finalizerName) {
 		controllerutil.AddFinalizer(mr, finalizerName)
 		if err = r.Update(ctx, mr); err != nil {
@@ -82,82 +139,841 @@ func (r *MergeRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request
 
 	// 3. deletion timestampがあれば関連リソースをすべて削除
 	if !mr.ObjectMeta.DeletionTimestamp.IsZero() {
+		step = "delete"
 		if controllerutil.ContainsFinalizer(mr, finalizerName) {
-			r.delete(ctx, mr)
+			if err = r.setPhase(ctx, mr, reviewv1beta1.PhaseDeleting); err != nil {
+				logger.Error(err, "MergeRequest Status Update Error")
+			}
+			// Teardownフックが完了するまでFinalizerを残す
+			if !r.delete(ctx, mr) {
+				return ctrl.Result{RequeueAfter: hookPollInterval}, nil
+			}
+		}
+		// 削除をマージリクエストに通知する。失敗しても削除は続ける
+		if r.Notifier != nil && notify.Enabled(mr) {
+			if _, err := r.Notifier.Notify(ctx, mr, reviewv1beta1.PhaseDeleting); err != nil {
+				logger.Error(err, "Notification Error")
+				r.Recorder.Event(mr, corev1.EventTypeWarning, "NotificationFailed", err.Error())
+			}
 		}
 		// // 関連リソース削除後にFinalizerを削除して更新（Finalizerがなくなったので次はカスタムリソース自体が削除される）
 		controllerutil.RemoveFinalizer(mr, finalizerName)
 		err = r.Update(ctx, mr)
 		if err != nil {
-			logger.Info("RemoveFinalizer Error name : " + mr.Spec.Name)
+			logger.Info("RemoveFinalizer Error name : " + mr.Spec.Repository.Group)
 			return ctrl.Result{}, err
 		}
-		logger.Info("Delete Complete : " + mr.Spec.Name)
+		reason := metrics.DeletionReason(mr)
+		metrics.Deletions.WithLabelValues(reason).Inc()
+		r.Recorder.Eventf(mr, corev1.EventTypeNormal, "Deleted", "Review environment deleted (%s)", reason)
+		logger.Info("Delete Complete : " + mr.Spec.Repository.Group)
 		return ctrl.Result{}, nil
 	}
 
-	// 4. MergeRequestリソースのnameに従いプロジェクト用のNamespaceを作成
-	namespaceSvc := namespace.NewNameSpaceService(mr)
-	namespaceSvc.CreateNamespace(ctx, r.Client)
+	// 4. ReviewEnvironmentPolicyの適用
+	// ポリシーを適用した内容は関連リソースの作成にのみ利用し、MergeRequestには保存しない
+	step = "policy"
+	p, err := policy.Find(ctx, r.Client, mr)
+	if err != nil {
+		logger.Error(err, "ReviewEnvironmentPolicy Find Error")
+		return ctrl.Result{}, err
+	}
+	policyName := ""
+	if p != nil {
+		policyName = p.Name
+	}
+	if mr.Status.Policy != policyName {
+		mr.Status.Policy = policyName
+		if err = r.Status().Update(ctx, mr); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+			return ctrl.Result{}, err
+		}
+	}
+	effective := mr.DeepCopy()
+	if err = policy.Apply(effective, p); err != nil {
+		logger.Error(err, "ReviewEnvironmentPolicy Apply Error policy : "+policyName)
+		return ctrl.Result{}, err
+	}
+	// "/review extend"で延長されたTTLを加える
+	if err = policy.ExtendTTL(effective, p); err != nil {
+		logger.Error(err, "TTL Extension Error")
+		return ctrl.Result{}, err
+	}
 
-	// グループ-プロジェクト-ブランチで名前を作る
-	name := fmt.Sprintf("%s-%s-%s", mr.Spec.Name, mr.Spec.Application, strings.Replace(mr.Spec.TargetRevision, "/", "-", -1))
+	// 5. TTLを過ぎたMergeRequestは削除
+	step = "expire"
+	var requeueAfter time.Duration
+	if ttl := effective.Spec.Lifecycle.TTL; ttl != nil {
+		remaining := time.Until(mr.CreationTimestamp.Add(ttl.Duration))
+		if remaining <= 0 {
+			logger.Info("MergeRequest expired name : " + mr.Name)
+			// 削除理由をメトリクスに記録するためアノテーションに残す
+			if mr.Annotations[reviewv1beta1.DeletionReasonAnnotation] == "" {
+				if mr.Annotations == nil {
+					mr.Annotations = map[string]string{}
+				}
+				mr.Annotations[reviewv1beta1.DeletionReasonAnnotation] = reviewv1beta1.DeletionReasonExpired
+				if err = r.Update(ctx, mr); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+			r.Recorder.Eventf(mr, corev1.EventTypeNormal, "Expired", "TTL %s exceeded", ttl.Duration)
+			if err = r.Delete(ctx, mr); err != nil && !apierrors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, nil
+		}
+		requeueAfter = remaining
+	}
+	// Webhookが"/review extend"でTTLの有無を判定できるよう、ポリシーと延長を反映した期限を記録する
+	var expiresAt *metav1.Time
+	if ttl := effective.Spec.Lifecycle.TTL; ttl != nil {
+		expiresAt = &metav1.Time{Time: mr.CreationTimestamp.Add(ttl.Duration).Truncate(time.Second)}
+	}
+	if !expiresAt.Equal(mr.Status.ExpiresAt) {
+		mr.Status.ExpiresAt = expiresAt
+		if err = r.Status().Update(ctx, mr); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+			return ctrl.Result{}, err
+		}
+	}
 
-	// 5. Application作成
-	applicationSvc := argocd.NewApplicationService(mr)
-	applicationFound := &argocdv1alpha1.Application{}
-	err = r.Get(ctx, types.NamespacedName{Name: name, Namespace: "argocd"}, applicationFound)
-	if err != nil && apierrors.IsNotFound(err) {
-		logger.Info("Application Create")
-		applicationSvc.Create(ctx, r.Client, name)
-	} else if err != nil {
-		logger.Error(err, "Application Get Error")
+	// 6. 同時に構築する環境数の上限を超える場合は空きができるまでQueuedで待つ
+	step = "queue"
+	if p != nil && p.Spec.MaxConcurrentEnvironments > 0 {
+		position, err := r.queuePosition(ctx, mr, p)
+		if err != nil {
+			logger.Error(err, "MergeRequest List Error")
+			return ctrl.Result{}, err
+		}
+		if position > 0 {
+			logger.Info(fmt.Sprintf("MaxConcurrentEnvironments exceeded policy : %s position : %d", p.Name, position))
+			if mr.Status.Phase != reviewv1beta1.PhaseQueued || mr.Status.QueuePosition != int32(position) {
+				if mr.Status.Phase != reviewv1beta1.PhaseQueued {
+					r.Recorder.Eventf(mr, corev1.EventTypeNormal, string(reviewv1beta1.PhaseQueued), "MaxConcurrentEnvironments %d of policy %s reached", p.Spec.MaxConcurrentEnvironments, p.Name)
+				}
+				mr.Status.Phase = reviewv1beta1.PhaseQueued
+				mr.Status.QueuePosition = int32(position)
+				if err = r.Status().Update(ctx, mr); err != nil {
+					logger.Error(err, "MergeRequest Status Update Error")
+					return ctrl.Result{}, err
+				}
+			}
+			return ctrl.Result{RequeueAfter: queuePollInterval}, nil
+		}
+	}
+	if !queue.Active(mr) {
+		if err = r.setPhase(ctx, mr, reviewv1beta1.PhaseProvisioning); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 7. デプロイ先クラスタの決定
+	// 一度決定したクラスタはstatusに保持し、以降は同じクラスタを利用する
+	step = "destination"
+	dest, err := cluster.Select(ctx, r.Client, effective, p)
+	if err != nil {
+		logger.Error(err, "Destination Select Error")
+		return ctrl.Result{}, err
+	}
+	effective.Spec.Destination = dest
+	if !dest.IsZero() && (mr.Status.Destination == nil || *mr.Status.Destination != dest) {
+		r.Recorder.Event(mr, corev1.EventTypeNormal, "DestinationSelected", "Deploying to cluster "+dest.Key())
+		mr.Status.Destination = &dest
+		if err = r.Status().Update(ctx, mr); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+			return ctrl.Result{}, err
+		}
+	}
+	destClient, err := r.Clusters.Client(ctx, dest)
+	if err != nil {
+		logger.Error(err, "Destination Client Error cluster : "+dest.Key())
+		r.Recorder.Event(mr, corev1.EventTypeWarning, "DestinationUnavailable", err.Error())
 		return ctrl.Result{}, err
 	}
 
-	// 6. Ingress(VirtualService)作成
-	virtualServiceSvc := ingress.NewVirtualService(mr)
+	// 8. MergeRequestリソースのnameに従いプロジェクト用のNamespaceを作成
+	step = "namespace"
+	namespaceSvc := namespace.NewNameSpaceService(effective)
+	namespaceSvc.CreateNamespace(ctx, destClient)
+	if p != nil && len(p.Spec.Quota) > 0 {
+		if err = namespaceSvc.ApplyResourceQuota(ctx, destClient, p.Spec.Quota); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// テンプレートNamespaceのSecret、ConfigMapをコピーし、指定から外れたコピーを解放する
+	step = "copy"
+	copySvc := copier.NewCopyService(effective)
+	copies, err := copySvc.Apply(ctx, r.Client, destClient)
+	if err != nil {
+		logger.Error(err, "Copy Error")
+		return ctrl.Result{}, err
+	}
+	if err = copySvc.Release(ctx, destClient, releasedCopies(mr.Status.Copies, copies)); err != nil {
+		logger.Error(err, "Copy Release Error")
+		return ctrl.Result{}, err
+	}
+	if !reflect.DeepEqual(mr.Status.Copies, copies) {
+		r.Recorder.Eventf(mr, corev1.EventTypeNormal, "CopiesUpdated", "%d Secrets and ConfigMaps copied", len(copies))
+		mr.Status.Copies = copies
+		if err = r.Status().Update(ctx, mr); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+			return ctrl.Result{}, err
+		}
+	}
+
+	name := resourceName(mr)
+
+	// レビュー環境ごとの変数をConfigMapに保持する
+	step = "variables"
+	vars, err := preview.Variables(effective)
+	if err != nil {
+		logger.Error(err, "Variables Render Error")
+		return ctrl.Result{}, err
+	}
+	if err = preview.NewVariablesService(effective, name).Apply(ctx, destClient, vars); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// 9. PreSyncフックの実行
+	// すべてのフックが成功するまでApplicationを作成・更新しない
+	step = "presync"
+	hookSvc := hook.NewHookService(effective, name)
+	done, statuses, err := hookSvc.Run(ctx, destClient, reviewv1beta1.HookPhasePreSync)
+	if err != nil {
+		logger.Error(err, "PreSync Hook Error")
+		return ctrl.Result{}, err
+	}
+	if err = r.updateHookStatus(ctx, mr, reviewv1beta1.HookPhasePreSync, statuses); err != nil {
+		logger.Error(err, "MergeRequest Status Update Error")
+		return ctrl.Result{}, err
+	}
+	if !done {
+		if hookFailed(statuses) {
+			logger.Info("PreSync Hook failed name : " + mr.Name)
+			r.Recorder.Event(mr, corev1.EventTypeWarning, "PreSyncHookFailed", "PreSync hook failed, Applications are not synced")
+			if err = r.setPhase(ctx, mr, reviewv1beta1.PhaseFailed); err != nil {
+				logger.Error(err, "MergeRequest Status Update Error")
+				return ctrl.Result{}, err
+			}
+			if err = r.notify(ctx, mr); err != nil {
+				logger.Error(err, "MergeRequest Status Update Error")
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: requeueAfter}, nil
+		}
+		return ctrl.Result{RequeueAfter: hookPollInterval}, nil
+	}
+
+	// 10. Application作成
+	step = "application"
+	if r.ArgoCD.GroupProject && effective.Spec.ArgoCD.Project == "" {
+		appProjectSvc := argocd.NewAppProjectService(effective, r.ArgoCD)
+		if err = appProjectSvc.CreateOrUpdate(ctx, r.Client); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	applicationSvc := argocd.NewApplicationService(effective, r.ArgoCD)
+	applicationSvc.SetVariables(vars)
+	applications := applicationSvc.Applications(name)
+	for _, app := range applications {
+		applicationFound := &argocdv1alpha1.Application{}
+		err = r.Get(ctx, types.NamespacedName{Name: app.Name, Namespace: r.ArgoCD.Namespace}, applicationFound)
+		if err != nil && apierrors.IsNotFound(err) {
+			logger.Info("Application Create")
+			applicationSvc.Create(ctx, r.Client, app)
+			r.Recorder.Event(mr, corev1.EventTypeNormal, "ApplicationCreated", "Application "+app.Name+" created")
+		} else if err != nil {
+			logger.Error(err, "Application Get Error")
+			return ctrl.Result{}, err
+		} else if argocd.Changed(applicationFound, app) {
+			logger.Info("Application Update")
+			applicationSvc.Update(ctx, r.Client, applicationFound, app)
+			r.Recorder.Event(mr, corev1.EventTypeNormal, "ApplicationUpdated", "Application "+app.Name+" updated")
+		}
+	}
+	// コンポーネントから外れたApplicationを削除
+	orphans, err := applicationSvc.Orphans(ctx, r.Client, applications)
+	if err != nil {
+		logger.Error(err, "Application List Error")
+		return ctrl.Result{}, err
+	}
+	for i := range orphans {
+		applicationSvc.Delete(ctx, r.Client, &orphans[i])
+		r.Recorder.Event(mr, corev1.EventTypeNormal, "ApplicationDeleted", "Application "+orphans[i].Name+" deleted")
+	}
+	// "/review redeploy"で要求された場合はApplicationをハードリフレッシュして同期し直す
+	// 処理したアノテーションの値をstatusに保持し、値が変わるまで再実行しない
+	if value := mr.Annotations[reviewv1beta1.RedeployAnnotation]; value != "" && value != mr.Status.Redeploy {
+		for _, app := range applications {
+			applicationFound := &argocdv1alpha1.Application{}
+			if err = r.Get(ctx, types.NamespacedName{Name: app.Name, Namespace: r.ArgoCD.Namespace}, applicationFound); err != nil {
+				logger.Error(err, "Application Get Error")
+				return ctrl.Result{}, err
+			}
+			if err = applicationSvc.Redeploy(ctx, r.Client, applicationFound); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		// 同期し直したリビジョンでスモークテストを再実行する
+		mr.Status.Redeploy = value
+		mr.Status.SmokeTest = nil
+		if err = r.Status().Update(ctx, mr); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Event(mr, corev1.EventTypeNormal, "Redeployed", "Applications refreshed and synced")
+	}
+
+	// 11. Ingress(VirtualService)作成
+	step = "ingress"
+	virtualServiceSvc := ingress.NewVirtualService(effective)
 	virtualserviceFound := &istioclient.VirtualService{}
-	err = r.Get(ctx, types.NamespacedName{Name: name, Namespace: mr.Spec.Name}, virtualserviceFound)
+	err = destClient.Get(ctx, types.NamespacedName{Name: name, Namespace: mr.Spec.Repository.Group}, virtualserviceFound)
 	if err != nil && apierrors.IsNotFound(err) {
 		logger.Info("VirtualService Create")
-		virtualServiceSvc.Create(ctx, r.Client, name)
+		virtualServiceSvc.Create(ctx, destClient, name)
+		r.Recorder.Event(mr, corev1.EventTypeNormal, "VirtualServiceCreated", "VirtualService "+name+" created")
 	} else if err != nil {
 		logger.Error(err, "VirtualService Get Error")
 		return ctrl.Result{}, err
+	} else {
+		virtualServiceSvc.Update(ctx, destClient, virtualserviceFound)
+	}
+	// 同じNamespaceの他のレビュー環境からの通信を制限する
+	step = "networkpolicy"
+	networkPolicySvc := network.NewNetworkPolicyService(effective)
+	if networkPolicySvc.Enabled() {
+		appNames := make([]string, 0, len(applications))
+		for _, app := range applications {
+			appNames = append(appNames, app.Name)
+		}
+		// ベースライン環境のPodはヘッダーに従いレビュー環境のPodを呼び出し、レビュー環境のPodは変更していないサービスをベースライン環境で呼び出すため、双方向の通信を許可する
+		var peers []string
+		if effective.Spec.Routing.Mode == reviewv1beta1.RoutingModeBaseline {
+			peers = []string{argocd.BaselineName(effective.Spec.Repository.Group)}
+		}
+		if err = networkPolicySvc.Apply(ctx, destClient, name, appNames, peers); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if err = networkPolicySvc.Delete(ctx, destClient, name); err != nil {
+		logger.Error(err, "NetworkPolicy Delete Error")
+		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	// 12. Baselineモードの場合はグループのベースライン環境とプロジェクトのサービスの振り分けを作成
+	if effective.Spec.Routing.Mode == reviewv1beta1.RoutingModeBaseline {
+		step = "baseline"
+		// ベースライン環境はグループで1つ。ポリシーなどでソースが変わった場合は更新する
+		baseline := applicationSvc.Baseline()
+		baselineFound := &argocdv1alpha1.Application{}
+		err = r.Get(ctx, types.NamespacedName{Name: baseline.Name, Namespace: r.ArgoCD.Namespace}, baselineFound)
+		if err != nil && apierrors.IsNotFound(err) {
+			logger.Info("Baseline Application Create")
+			applicationSvc.Create(ctx, r.Client, baseline)
+		} else if err != nil {
+			logger.Error(err, "Baseline Application Get Error")
+			return ctrl.Result{}, err
+		} else if !reflect.DeepEqual(baselineFound.Spec.Source, baseline.Spec.Source) {
+			logger.Info("Baseline Application Update")
+			applicationSvc.Update(ctx, r.Client, baselineFound, baseline)
+		}
+	}
+	if effective.Spec.Routing.Mode == reviewv1beta1.RoutingModeBaseline && effective.Spec.Repository.Project != "" {
+		branches, err := r.baselineBranches(ctx, mr, false)
+		if err != nil {
+			logger.Error(err, "MergeRequest List Error")
+			return ctrl.Result{}, err
+		}
+		if err = ingress.NewBaselineVirtualService(effective).Apply(ctx, destClient, branches); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// 13. PostSyncフックの実行
+	// すべてのApplicationが同期済みかつHealthyになってから実行する
+	step = "postsync"
+	postSyncFailed := false
+	if len(effective.Spec.Hooks.PostSync) > 0 {
+		ready, _, err := r.applicationsStatus(ctx, applications)
+		if err != nil {
+			logger.Error(err, "Application Get Error")
+			return ctrl.Result{}, err
+		}
+		if !ready {
+			return ctrl.Result{RequeueAfter: hookPollInterval}, nil
+		}
+		done, statuses, err := hookSvc.Run(ctx, destClient, reviewv1beta1.HookPhasePostSync)
+		if err != nil {
+			logger.Error(err, "PostSync Hook Error")
+			return ctrl.Result{}, err
+		}
+		if err = r.updateHookStatus(ctx, mr, reviewv1beta1.HookPhasePostSync, statuses); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+			return ctrl.Result{}, err
+		}
+		if !done && !hookFailed(statuses) {
+			return ctrl.Result{RequeueAfter: hookPollInterval}, nil
+		}
+		postSyncFailed = hookFailed(statuses)
+		if postSyncFailed && mr.Status.Phase != reviewv1beta1.PhaseFailed {
+			r.Recorder.Event(mr, corev1.EventTypeWarning, "PostSyncHookFailed", "PostSync hook failed")
+		}
+	}
+
+	// Applicationが同期済みかつHealthyであればReady
+	step = "status"
+	phase := reviewv1beta1.PhaseProvisioning
+	if postSyncFailed {
+		phase = reviewv1beta1.PhaseFailed
+	} else if ready, _, err := r.applicationsStatus(ctx, applications); err != nil {
+		logger.Error(err, "Application Get Error")
+		return ctrl.Result{}, err
+	} else if ready {
+		phase = reviewv1beta1.PhaseReady
+	}
+	if err = r.setPhase(ctx, mr, phase); err != nil {
+		logger.Error(err, "MergeRequest Status Update Error")
+		return ctrl.Result{}, err
+	}
+	if err = r.notify(ctx, mr); err != nil {
+		logger.Error(err, "MergeRequest Status Update Error")
+		return ctrl.Result{}, err
+	}
+
+	// 14. スモークテストの実行
+	// Argo CDが同期したリビジョンごとに1回実行する
+	step = "smoketest"
+	smokeTestSvc := smoketest.NewSmokeTestService(effective, name)
+	if smokeTestSvc.Enabled() {
+		ready, revision, err := r.applicationsStatus(ctx, applications)
+		if err != nil {
+			logger.Error(err, "Application Get Error")
+			return ctrl.Result{}, err
+		}
+		if !ready {
+			return ctrl.Result{RequeueAfter: hookPollInterval}, nil
+		}
+		last := mr.Status.SmokeTest
+		if last == nil || last.Revision != revision || last.Result == reviewv1beta1.SmokeTestRunning {
+			clientset, err := r.Clusters.Clientset(ctx, dest)
+			if err != nil {
+				logger.Error(err, "Destination Clientset Error cluster : "+dest.Key())
+				return ctrl.Result{}, err
+			}
+			result, retryAfter, err := smokeTestSvc.Run(ctx, destClient, clientset, revision, last)
+			if err != nil {
+				logger.Error(err, "Smoke Test Error")
+				return ctrl.Result{}, err
+			}
+			if err = r.updateSmokeTestStatus(ctx, mr, result); err != nil {
+				logger.Error(err, "MergeRequest Status Update Error")
+				return ctrl.Result{}, err
+			}
+			switch result.Result {
+			case reviewv1beta1.SmokeTestRunning:
+				if retryAfter > 0 {
+					return ctrl.Result{RequeueAfter: retryAfter}, nil
+				}
+				return ctrl.Result{RequeueAfter: hookPollInterval}, nil
+			case reviewv1beta1.SmokeTestPassed:
+				r.Recorder.Event(mr, corev1.EventTypeNormal, "SmokeTestPassed", "Smoke test passed for revision "+revision)
+			default:
+				r.Recorder.Event(mr, corev1.EventTypeWarning, "SmokeTestFailed", result.Message)
+			}
+			// スモークテストの結果をマージリクエストに通知する
+			if err = r.notify(ctx, mr); err != nil {
+				logger.Error(err, "MergeRequest Status Update Error")
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// Applicationがすべて同期済みかつHealthyか判定し、同期したリビジョンを返す
+// コンポーネント構成の場合はApplicationごとのリビジョンをカンマ区切りで返す
+func (r *MergeRequestReconciler) applicationsStatus(ctx context.Context, applications []*argocdv1alpha1.Application) (bool, string, error) {
+	revisions := make([]string, 0, len(applications))
+	for _, app := range applications {
+		found := &argocdv1alpha1.Application{}
+		if err := r.Get(ctx, types.NamespacedName{Name: app.Name, Namespace: r.ArgoCD.Namespace}, found); err != nil {
+			return false, "", err
+		}
+		if found.Status.Sync.Status != argocdv1alpha1.SyncStatusCodeSynced || found.Status.Health.Status != health.HealthStatusHealthy {
+			return false, "", nil
+		}
+		revisions = append(revisions, found.Status.Sync.Revision)
+	}
+	return true, strings.Join(revisions, ","), nil
+}
+
+// スモークテストの結果をstatusとconditionに反映する
+func (r *MergeRequestReconciler) updateSmokeTestStatus(ctx context.Context, mr *reviewv1beta1.MergeRequest, result reviewv1beta1.SmokeTestStatus) error {
+	condition := metav1.Condition{
+		Type:               reviewv1beta1.ConditionSmokeTestPassed,
+		Status:             metav1.ConditionUnknown,
+		Reason:             string(result.Result),
+		Message:            result.Message,
+		ObservedGeneration: mr.Generation,
+	}
+	switch result.Result {
+	case reviewv1beta1.SmokeTestPassed:
+		condition.Status = metav1.ConditionTrue
+	case reviewv1beta1.SmokeTestFailed:
+		condition.Status = metav1.ConditionFalse
+	}
+	if mr.Status.SmokeTest != nil && reflect.DeepEqual(*mr.Status.SmokeTest, result) {
+		return nil
+	}
+	mr.Status.SmokeTest = &result
+	meta.SetStatusCondition(&mr.Status.Conditions, condition)
+	return r.Status().Update(ctx, mr)
+}
+
+// フェーズのフックの状態をstatusに反映する
+func (r *MergeRequestReconciler) updateHookStatus(ctx context.Context, mr *reviewv1beta1.MergeRequest, phase reviewv1beta1.HookPhase, statuses []reviewv1beta1.HookStatus) error {
+	var hooks []reviewv1beta1.HookStatus
+	for _, s := range mr.Status.Hooks {
+		if s.Phase != phase {
+			hooks = append(hooks, s)
+		}
+	}
+	hooks = append(hooks, statuses...)
+	if reflect.DeepEqual(hooks, mr.Status.Hooks) {
+		return nil
+	}
+	mr.Status.Hooks = hooks
+	return r.Status().Update(ctx, mr)
+}
+
+func hookFailed(statuses []reviewv1beta1.HookStatus) bool {
+	for _, s := range statuses {
+		if s.State == reviewv1beta1.HookStateFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// 同じプロジェクトのレビュー環境のブランチ一覧を返す
+// excludeSelfがtrueの場合は削除中のMergeRequest自身を除く
+func (r *MergeRequestReconciler) baselineBranches(ctx context.Context, mr *reviewv1beta1.MergeRequest, excludeSelf bool) ([]string, error) {
+	list := &reviewv1beta1.MergeRequestList{}
+	if err := r.List(ctx, list, client.InNamespace(mr.Namespace)); err != nil {
+		return nil, err
+	}
+	var branches []string
+	for _, item := range list.Items {
+		if item.Spec.Repository.Group != mr.Spec.Repository.Group || item.Spec.Repository.Project != mr.Spec.Repository.Project {
+			continue
+		}
+		if item.Name == mr.Name && excludeSelf {
+			continue
+		}
+		if item.Name != mr.Name && !item.DeletionTimestamp.IsZero() {
+			continue
+		}
+		branches = append(branches, item.Spec.Source.TargetRevision)
+	}
+	return branches, nil
+}
+
+// 同じグループの削除中でないMergeRequestを返す(MergeRequest自身を除く)
+func (r *MergeRequestReconciler) groupMergeRequests(ctx context.Context, mr *reviewv1beta1.MergeRequest) ([]reviewv1beta1.MergeRequest, error) {
+	list := &reviewv1beta1.MergeRequestList{}
+	if err := r.List(ctx, list, client.InNamespace(mr.Namespace)); err != nil {
+		return nil, err
+	}
+	var items []reviewv1beta1.MergeRequest
+	for _, item := range list.Items {
+		if item.Spec.Repository.Group != mr.Spec.Repository.Group || item.Name == mr.Name || !item.DeletionTimestamp.IsZero() {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ポリシーの上限を超える場合はMergeRequestの待ち順を、構築可能であれば0を返す
+func (r *MergeRequestReconciler) queuePosition(ctx context.Context, mr *reviewv1beta1.MergeRequest, p *reviewv1beta1.ReviewEnvironmentPolicy) (int, error) {
+	list := &reviewv1beta1.MergeRequestList{}
+	if err := r.List(ctx, list, client.InNamespace(mr.Namespace)); err != nil {
+		return 0, err
+	}
+	var candidates []reviewv1beta1.MergeRequest
+	for _, item := range list.Items {
+		if !item.DeletionTimestamp.IsZero() {
+			continue
+		}
+		same, err := queue.SameScope(p, mr, &item)
+		if err != nil {
+			return 0, err
+		}
+		if same {
+			candidates = append(candidates, item)
+		}
+	}
+	return queue.Position(mr, candidates, int(p.Spec.MaxConcurrentEnvironments)), nil
+}
+
+// フェーズが変わった場合のみstatusを更新し、イベントを記録する
+// 初めてReadyになった場合はReadyになるまでの時間をメトリクスに記録する
+func (r *MergeRequestReconciler) setPhase(ctx context.Context, mr *reviewv1beta1.MergeRequest, phase reviewv1beta1.MergeRequestPhase) error {
+	if mr.Status.Phase == phase && mr.Status.QueuePosition == 0 {
+		return nil
+	}
+	changed := mr.Status.Phase != phase
+	firstReady := phase == reviewv1beta1.PhaseReady && mr.Status.ReadyTime == nil
+	mr.Status.Phase = phase
+	mr.Status.QueuePosition = 0
+	if firstReady {
+		now := metav1.Now()
+		mr.Status.ReadyTime = &now
+	}
+	if err := r.Status().Update(ctx, mr); err != nil {
+		return err
+	}
+	if firstReady {
+		metrics.ObserveReady(mr, mr.Status.ReadyTime.Time)
+	}
+	if changed {
+		eventType := corev1.EventTypeNormal
+		if phase == reviewv1beta1.PhaseFailed {
+			eventType = corev1.EventTypeWarning
+		}
+		r.Recorder.Event(mr, eventType, string(phase), "Review environment is "+string(phase))
+	}
+	return nil
+}
+
+// ReadyまたはFailedになった場合、コミットまたはスモークテストの結果が変わった場合はマージリクエストに通知する
+// 通知に失敗した場合はstatusに記録し、次のReconcileで再度通知する
+func (r *MergeRequestReconciler) notify(ctx context.Context, mr *reviewv1beta1.MergeRequest) error {
+	phase := mr.Status.Phase
+	if r.Notifier == nil || !notify.Enabled(mr) || (phase != reviewv1beta1.PhaseReady && phase != reviewv1beta1.PhaseFailed) {
+		return nil
+	}
+	smokeTest := notify.SmokeTestResult(mr)
+	last := mr.Status.Notification
+	sha := mr.Spec.Origin.CommitSHA
+	if last != nil && last.Phase == phase && last.CommitSHA == sha && last.SmokeTest == smokeTest && last.Message == "" {
+		return nil
+	}
+	noteID, err := r.Notifier.Notify(ctx, mr, phase)
+	status := &reviewv1beta1.NotificationStatus{Phase: phase, NoteID: noteID, CommitSHA: sha, SmokeTest: smokeTest}
+	if noteID == 0 && last != nil {
+		status.NoteID = last.NoteID
+	}
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Notification Error")
+		r.Recorder.Event(mr, corev1.EventTypeWarning, "NotificationFailed", err.Error())
+		status.Message = err.Error()
+	} else {
+		r.Recorder.Event(mr, corev1.EventTypeNormal, "Notified", "Reported "+string(phase)+" to the merge request")
+	}
+	mr.Status.Notification = status
+	return r.Status().Update(ctx, mr)
 }
 
 // 関連リソースの削除
-func (r *MergeRequestReconciler) delete(ctx context.Context, mr *reviewv1alpha1.MergeRequest) {
+// Teardownフックの実行中はfalseを返す
+func (r *MergeRequestReconciler) delete(ctx context.Context, mr *reviewv1beta1.MergeRequest) bool {
 	logger := log.FromContext(ctx)
 	logger.Info("start delete")
-	name := fmt.Sprintf("%s-%s-%s", mr.Spec.Name, mr.Spec.Application, strings.Replace(mr.Spec.TargetRevision, "/", "-", -1))
+	name := resourceName(mr)
+
+	// VirtualService、フックのJobはデプロイ先クラスタから削除する
+	dest := mr.Spec.Destination
+	if mr.Status.Destination != nil {
+		dest = *mr.Status.Destination
+	}
+	destClient, err := r.Clusters.Client(ctx, dest)
+	if err != nil {
+		logger.Error(err, "Destination Client Error cluster : "+dest.Key())
+		destClient = r.Client
+	}
+
+	// Teardownフックはリソースを削除する前に実行する
+	// 失敗した場合もリソースは削除する
+	hookSvc := hook.NewHookService(mr, name)
+	done, statuses, err := hookSvc.Run(ctx, destClient, reviewv1beta1.HookPhaseTeardown)
+	if err != nil {
+		logger.Error(err, "Teardown Hook Error")
+	} else {
+		if err = r.updateHookStatus(ctx, mr, reviewv1beta1.HookPhaseTeardown, statuses); err != nil {
+			logger.Error(err, "MergeRequest Status Update Error")
+		}
+		if !done && !hookFailed(statuses) {
+			logger.Info("Teardown Hook running name : " + mr.Name)
+			return false
+		}
+		if hookFailed(statuses) {
+			r.Recorder.Event(mr, corev1.EventTypeWarning, "TeardownHookFailed", "Teardown hook failed, deleting resources anyway")
+		}
+	}
 
 	virtualServiceSvc := ingress.NewVirtualService(mr)
 	virtualserviceFound := &istioclient.VirtualService{}
-	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: mr.Spec.Name}, virtualserviceFound)
+	err = destClient.Get(ctx, types.NamespacedName{Name: name, Namespace: mr.Spec.Repository.Group}, virtualserviceFound)
 	if err != nil {
 		logger.Error(err, "VirtualService delete error name : "+name)
 	}
-	virtualServiceSvc.Delete(ctx, r.Client, virtualserviceFound)
+	virtualServiceSvc.Delete(ctx, destClient, virtualserviceFound)
+
+	// Baselineモードの場合はプロジェクトのサービスの振り分けから外す
+	p, err := policy.Find(ctx, r.Client, mr)
+	if err != nil {
+		logger.Error(err, "ReviewEnvironmentPolicy Find Error")
+	}
+	effective := mr.DeepCopy()
+	if err = policy.Apply(effective, p); err != nil {
+		logger.Error(err, "ReviewEnvironmentPolicy Apply Error")
+	}
+	if effective.Spec.Routing.Mode == reviewv1beta1.RoutingModeBaseline && effective.Spec.Repository.Project != "" {
+		branches, err := r.baselineBranches(ctx, mr, true)
+		if err != nil {
+			logger.Error(err, "MergeRequest List Error")
+		} else {
+			ingress.NewBaselineVirtualService(effective).Apply(ctx, destClient, branches)
+		}
+	}
 
-	applicationSvc := argocd.NewApplicationService(mr)
-	applicationFound := &argocdv1alpha1.Application{}
-	err = r.Get(ctx, types.NamespacedName{Name: name, Namespace: "argocd"}, applicationFound)
+	applicationSvc := argocd.NewApplicationService(mr, r.ArgoCD)
+	for _, app := range applicationSvc.Applications(name) {
+		applicationFound := &argocdv1alpha1.Application{}
+		err = r.Get(ctx, types.NamespacedName{Name: app.Name, Namespace: r.ArgoCD.Namespace}, applicationFound)
+		if err != nil {
+			logger.Error(err, "Application delete error name : "+app.Name)
+			continue
+		}
+		applicationSvc.Delete(ctx, r.Client, applicationFound)
+	}
+	orphans, err := applicationSvc.Orphans(ctx, r.Client, nil)
 	if err != nil {
-		logger.Error(err, "Application delete error name : "+name)
+		logger.Error(err, "Application List Error")
+	}
+	for i := range orphans {
+		applicationSvc.Delete(ctx, r.Client, &orphans[i])
+	}
+
+	// フォークのリポジトリは同じグループのほかのMergeRequestが利用していなければAppProjectの許可から外す
+	if r.ArgoCD.GroupProject && mr.Spec.Repository.URL != "" {
+		remaining, err := r.groupMergeRequests(ctx, mr)
+		if err != nil {
+			logger.Error(err, "MergeRequest List Error")
+		} else if err = argocd.NewAppProjectService(mr, r.ArgoCD).Release(ctx, r.Client, remaining); err != nil {
+			logger.Error(err, "AppProject Release Error")
+		}
+	}
+
+	if err = hookSvc.Delete(ctx, destClient); err != nil {
+		logger.Error(err, "Hook Job delete error")
+	}
+	if err = copier.NewCopyService(mr).Release(ctx, destClient, mr.Status.Copies); err != nil {
+		logger.Error(err, "Copy Release Error")
+	}
+	if err = preview.NewVariablesService(mr, name).Delete(ctx, destClient); err != nil {
+		logger.Error(err, "Variables ConfigMap delete error")
+	}
+	if err = network.NewNetworkPolicyService(mr).Delete(ctx, destClient, name); err != nil {
+		logger.Error(err, "NetworkPolicy delete error")
 	}
-	applicationSvc.Delete(ctx, r.Client, applicationFound)
 
 	logger.Info("end delete")
+	return true
+}
+
+// 前回コピーしたもののうち今回コピーしなかったものを返す
+func releasedCopies(previous []reviewv1beta1.CopiedObject, current []reviewv1beta1.CopiedObject) []reviewv1beta1.CopiedObject {
+	var released []reviewv1beta1.CopiedObject
+	for _, p := range previous {
+		found := false
+		for _, c := range current {
+			if p == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			released = append(released, p)
+		}
+	}
+	return released
+}
+
+// グループ-プロジェクト-ブランチで名前を作る
+// プロジェクトの指定がない(コンポーネント構成の)場合はグループ-ブランチ
+func resourceName(mr *reviewv1beta1.MergeRequest) string {
+	branch := strings.Replace(mr.Spec.Source.TargetRevision, "/", "-", -1)
+	if mr.Spec.Repository.Project == "" {
+		return fmt.Sprintf("%s-%s", mr.Spec.Repository.Group, branch)
+	}
+	return fmt.Sprintf("%s-%s-%s", mr.Spec.Repository.Group, mr.Spec.Repository.Project, branch)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *MergeRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&reviewv1alpha1.MergeRequest{}).
+		For(&reviewv1beta1.MergeRequest{}).
+		Watches(&source.Kind{Type: &reviewv1beta1.ReviewEnvironmentPolicy{}}, handler.EnqueueRequestsFromMapFunc(r.mergeRequestsForPolicy)).
+		Watches(&source.Kind{Type: &argocdv1alpha1.Application{}}, handler.EnqueueRequestsFromMapFunc(mergeRequestForApplication)).
+		// キャッシュはcopier.CacheSelectorsでコピー元のラベルを持つSecret、ConfigMapに絞り込んでいる
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.mergeRequestsForCopySource(reviewv1beta1.CopyKindSecret))).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.mergeRequestsForCopySource(reviewv1beta1.CopyKindConfigMap))).
 		Complete(r)
 }
+
+// ReviewEnvironmentPolicyの変更時はすべてのMergeRequestを再評価する
+func (r *MergeRequestReconciler) mergeRequestsForPolicy(obj client.Object) []reconcile.Request {
+	list := &reviewv1beta1.MergeRequestList{}
+	if err := r.List(context.Background(), list); err != nil {
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, item := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&item)})
+	}
+	return requests
+}
+
+// コピー元のSecret、ConfigMapの変更時はコピーしているMergeRequestを再評価する
+// ポリシーがコピー元に指定している場合はすべてのMergeRequestを再評価する
+func (r *MergeRequestReconciler) mergeRequestsForCopySource(kind reviewv1beta1.CopyKind) handler.MapFunc {
+	return func(obj client.Object) []reconcile.Request {
+		ctx := context.Background()
+		policies := &reviewv1beta1.ReviewEnvironmentPolicyList{}
+		if err := r.List(ctx, policies); err != nil {
+			return nil
+		}
+		all := false
+		for _, p := range policies.Items {
+			if copier.References(p.Spec.Copies, kind, obj.GetNamespace(), obj.GetName()) {
+				all = true
+				break
+			}
+		}
+		list := &reviewv1beta1.MergeRequestList{}
+		if err := r.List(ctx, list); err != nil {
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, item := range list.Items {
+			if all || copier.References(item.Spec.Copies, kind, obj.GetNamespace(), obj.GetName()) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&item)})
+			}
+		}
+		return requests
+	}
+}
+
+// Applicationの同期状態が変わった場合は作成したMergeRequestのフェーズを更新する
+func mergeRequestForApplication(obj client.Object) []reconcile.Request {
+	key, ok := argocd.MergeRequestKey(obj)
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: key}}
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// 通知したフェーズとコミットを記録する
+type recordingNotifier struct {
+	notified []string
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, mr *reviewv1beta1.MergeRequest, phase reviewv1beta1.MergeRequestPhase) (int64, error) {
+	n.notified = append(n.notified, string(phase)+" "+mr.Spec.Origin.CommitSHA)
+	return 1, nil
+}
+
+func TestNotifyOnChange(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := reviewv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	mr := &reviewv1beta1.MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo1-demo1pj1-feature-a", Namespace: "operator-system"},
+		Spec: reviewv1beta1.MergeRequestSpec{
+			Repository: reviewv1beta1.RepositorySpec{Host: "http://gitlab", Group: "demo1", Project: "demo1pj1"},
+			Origin:     reviewv1beta1.OriginSpec{IID: 7, CommitSHA: "abc123"},
+		},
+		Status: reviewv1beta1.MergeRequestStatus{Phase: reviewv1beta1.PhaseReady},
+	}
+	notifier := &recordingNotifier{}
+	r := &MergeRequestReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(mr).Build(),
+		Recorder: record.NewFakeRecorder(10),
+		Notifier: notifier,
+	}
+	ctx := context.Background()
+	notify := func() {
+		t.Helper()
+		if err := r.notify(ctx, mr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notify()
+	// フェーズもコミットも変わらなければ通知しない
+	notify()
+	// 新しいコミットはフェーズが同じでも通知する
+	mr.Spec.Origin.CommitSHA = "def456"
+	notify()
+	// スモークテストの結果が出れば通知する
+	mr.Status.SmokeTest = &reviewv1beta1.SmokeTestStatus{Revision: "def456", Result: reviewv1beta1.SmokeTestFailed}
+	notify()
+	notify()
+
+	want := []string{"Ready abc123", "Ready def456", "Ready def456"}
+	if len(notifier.notified) != len(want) {
+		t.Fatalf("notified = %v, want %v", notifier.notified, want)
+	}
+	for i := range want {
+		if notifier.notified[i] != want[i] {
+			t.Errorf("notified = %v, want %v", notifier.notified, want)
+		}
+	}
+	if n := mr.Status.Notification; n.CommitSHA != "def456" || n.SmokeTest != reviewv1beta1.SmokeTestFailed {
+		t.Errorf("notification = %+v", n)
+	}
+}
@@ -26,15 +26,26 @@ import (
 
 	argocdv1alpha1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
 	istioclient "istio.io/client-go/pkg/apis/networking/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	reviewv1alpha1 "github.com/nautible/review-env-operator/api/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
 	"github.com/nautible/review-env-operator/controllers"
+	"github.com/nautible/review-env-operator/pkg/argocd"
+	"github.com/nautible/review-env-operator/pkg/cluster"
+	"github.com/nautible/review-env-operator/pkg/copier"
+	"github.com/nautible/review-env-operator/pkg/metrics"
+	"github.com/nautible/review-env-operator/pkg/notify"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -47,6 +58,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(reviewv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(reviewv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 
 	utilruntime.Must(argocdv1alpha1.AddToScheme(scheme))
@@ -57,11 +69,27 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var argocdConfig argocd.Config
+	var kubeconfigSecretNamespace string
+	var gitlabTokenSecret types.NamespacedName
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&argocdConfig.Namespace, "argocd-namespace", "argocd", "The namespace where Argo CD Applications and AppProjects are created.")
+	flag.StringVar(&argocdConfig.Project, "argocd-project", "default",
+		"The Argo CD AppProject used when the MergeRequest does not specify one.")
+	flag.BoolVar(&argocdConfig.GroupProject, "argocd-group-project", false,
+		"Create an AppProject per group restricted to the group's repositories and namespace, "+
+			"and use it when the MergeRequest does not specify one.")
+	flag.StringVar(&kubeconfigSecretNamespace, "kubeconfig-secret-namespace", "operator-system",
+		"The namespace of the Secrets holding the kubeconfig of the destination clusters.")
+	flag.StringVar(&gitlabTokenSecret.Name, "gitlab-token-secret", "",
+		"The Secret holding the GitLab API token (key: token) used to report the review environment to the merge request. "+
+			"Reporting is disabled when empty.")
+	flag.StringVar(&gitlabTokenSecret.Namespace, "gitlab-token-secret-namespace", "operator-system",
+		"The namespace of the Secret holding the GitLab API token.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -77,6 +105,9 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "3f232974.nautible.com",
+		// コピー元のラベルを持つSecret、ConfigMapのみを監視し、それ以外はキャッシュせずに取得する
+		NewCache:              cache.BuilderWithOptions(cache.Options{SelectorsByObject: copier.CacheSelectors()}),
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}, &corev1.ConfigMap{}},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -94,15 +125,32 @@ func main() {
 		os.Exit(1)
 	}
 
+	var notifier notify.Notifier
+	if gitlabTokenSecret.Name != "" {
+		notifier = notify.NewGitLabNotifier(mgr.GetClient(), gitlabTokenSecret)
+	}
 	if err = (&controllers.MergeRequestReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		ArgoCD:   argocdConfig,
+		Clusters: cluster.NewProvider(mgr.GetClient(), mgr.GetConfig(), mgr.GetScheme(), kubeconfigSecretNamespace),
+		Recorder: mgr.GetEventRecorderFor("mergerequest-controller"),
+		Notifier: notifier,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "MergeRequest")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&reviewv1beta1.MergeRequest{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "MergeRequest")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
+	// レビュー環境の数と経過時間はスクレイプ時にMergeRequestから集計する
+	crmetrics.Registry.MustRegister(metrics.NewEnvironmentCollector(mgr.GetClient()))
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
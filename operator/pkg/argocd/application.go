@@ -3,28 +3,45 @@ package argocd
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 
 	argocdv1alpha1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
-	reviewv1alpha1 "github.com/nautible/review-env-operator/api/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+// Applicationを作成したMergeRequest(namespace/name)を保持するアノテーション
+const mergeRequestAnnotation = "review.nautible.com/merge-request"
+
+// ベースライン環境のマニフェストを管理するグループのプロジェクト
+const defaultBaselineProject = "baseline"
+
 type ApplicationService struct {
-	reviewv1alpha1.MergeRequest
+	reviewv1beta1.MergeRequest
+	config    Config
+	variables map[string]string
 }
 
-func NewApplicationService(mr *reviewv1alpha1.MergeRequest) *ApplicationService {
-	return &ApplicationService{*mr}
+func NewApplicationService(mr *reviewv1beta1.MergeRequest, config Config) *ApplicationService {
+	return &ApplicationService{MergeRequest: *mr, config: config}
 }
 
-func (p *ApplicationService) Create(ctx context.Context, client client.Client, name string) error {
+// SetVariables はvariables.injectの指定に従いApplicationのsourceに加えるレビュー環境ごとの変数を設定する
+func (p *ApplicationService) SetVariables(vars map[string]string) {
+	p.variables = vars
+}
+
+func (p *ApplicationService) Create(ctx context.Context, client client.Client, app *argocdv1alpha1.Application) error {
 	logger := log.FromContext(ctx)
-	logger.Info("Create Application name : " + name)
+	logger.Info("Create Application name : " + app.Name)
 	finalizerName := "resources-finalizer.argocd.argoproj.io"
-	app := p.createApp(name, p.Spec.Name, p.Spec.Application)
 	if !controllerutil.ContainsFinalizer(app, finalizerName) {
 		controllerutil.AddFinalizer(app, finalizerName)
 	}
@@ -36,6 +53,143 @@ func (p *ApplicationService) Create(ctx context.Context, client client.Client, n
 	return nil
 }
 
+// Changed は作成済みのApplicationとsource、AppProject、同期ポリシー、デプロイ先のいずれかが異なるか判定する
+// ポリシーやデプロイ先の変更を作成済みのApplicationに反映するため、sourceのみでは判定しない
+func Changed(found *argocdv1alpha1.Application, app *argocdv1alpha1.Application) bool {
+	// SyncOptionsは空のスライスが保存時にnilになるため、nilと空を区別しないequality.Semanticで比較する
+	return !reflect.DeepEqual(found.Spec.Source, app.Spec.Source) ||
+		found.Spec.Project != app.Spec.Project ||
+		!equality.Semantic.DeepEqual(found.Spec.SyncPolicy, app.Spec.SyncPolicy) ||
+		!sameDestination(found.Spec.Destination, app.Spec.Destination)
+}
+
+// Update はリビジョンやポリシーの変更などで内容が変わったApplicationを更新する
+func (p *ApplicationService) Update(ctx context.Context, client client.Client, found *argocdv1alpha1.Application, app *argocdv1alpha1.Application) error {
+	logger := log.FromContext(ctx)
+	logger.Info("Update Application name : " + found.Name)
+
+	found.Spec.Source = app.Spec.Source
+	found.Spec.Project = app.Spec.Project
+	found.Spec.SyncPolicy = app.Spec.SyncPolicy
+	found.Spec.Destination = app.Spec.Destination
+	err := client.Update(ctx, found)
+	if err != nil {
+		logger.Error(err, "Check if the Application update error", "Application", found.Name)
+		return err
+	}
+	return nil
+}
+
+// Redeploy はApplicationをハードリフレッシュし、現在のリビジョンで同期し直す
+func (p *ApplicationService) Redeploy(ctx context.Context, client client.Client, found *argocdv1alpha1.Application) error {
+	logger := log.FromContext(ctx)
+	logger.Info("Redeploy Application name : " + found.Name)
+
+	if found.Annotations == nil {
+		found.Annotations = map[string]string{}
+	}
+	found.Annotations[argocdv1alpha1.AnnotationKeyRefresh] = string(argocdv1alpha1.RefreshTypeHard)
+	found.Operation = &argocdv1alpha1.Operation{
+		Sync:        &argocdv1alpha1.SyncOperation{Revision: found.Spec.Source.TargetRevision},
+		InitiatedBy: argocdv1alpha1.OperationInitiator{Username: "review-env-operator"},
+	}
+	err := client.Update(ctx, found)
+	if err != nil {
+		logger.Error(err, "Check if the Application redeploy error", "Application", found.Name)
+		return err
+	}
+	return nil
+}
+
+// Applications はMergeRequestから作成するApplicationを返す
+// コンポーネントの指定があればコンポーネントごとのApplicationを返す
+func (p *ApplicationService) Applications(name string) []*argocdv1alpha1.Application {
+	if len(p.Spec.Components) == 0 {
+		return []*argocdv1alpha1.Application{p.createApp(name, p.Spec.Repository.Group, p.Spec.Repository.Project)}
+	}
+	branch := strings.Replace(p.Spec.Source.TargetRevision, "/", "-", -1)
+	apps := make([]*argocdv1alpha1.Application, 0, len(p.Spec.Components))
+	for _, c := range p.Spec.Components {
+		component := &ApplicationService{*p.MergeRequest.DeepCopy(), p.config, p.variables}
+		component.Spec.Repository.Project = c.Project
+		component.Spec.Repository.URL = c.URL
+		if c.Type != "" {
+			component.Spec.Source.Type = c.Type
+		}
+		if c.Path != "" {
+			component.Spec.Source.Path = c.Path
+		}
+		// ブランチがないプロジェクトはデフォルトブランチをデプロイする
+		component.Spec.Source.TargetRevision = c.TargetRevision
+		appName := fmt.Sprintf("%s-%s-%s", p.Spec.Repository.Group, c.Project, branch)
+		apps = append(apps, component.createApp(appName, p.Spec.Repository.Group, c.Project))
+	}
+	return apps
+}
+
+// Baseline はBaselineモードで利用するグループのベースライン環境のApplicationを返す
+// グループのすべてのサービスをデフォルトブランチでデプロイし、同じグループのMergeRequestで共有する
+// グループに属するためMergeRequestのアノテーションは付けず、MergeRequestの削除時には削除しない
+func (p *ApplicationService) Baseline() *argocdv1alpha1.Application {
+	group := p.Spec.Repository.Group
+	spec := p.Spec.Routing.Baseline
+	project := spec.Project
+	if project == "" {
+		project = defaultBaselineProject // default
+	}
+	// ベースライン環境は共有するためレビュー環境ごとの変数を加えない
+	baseline := &ApplicationService{MergeRequest: *p.MergeRequest.DeepCopy(), config: p.config}
+	baseline.Spec.Repository.Project = project
+	baseline.Spec.Repository.URL = spec.URL
+	baseline.Spec.Source = spec.Source
+	app := baseline.createApp(BaselineName(group), group, project)
+	delete(app.Annotations, mergeRequestAnnotation)
+	app.Labels = map[string]string{reviewv1beta1.BaselineGroupLabel: group}
+	return app
+}
+
+// BaselineName はグループのベースライン環境のApplicationの名前を返す
+func BaselineName(group string) string {
+	return fmt.Sprintf("%s-baseline", group)
+}
+
+// Orphans はMergeRequestから作成されたApplicationのうちappsに含まれないものを返す
+func (p *ApplicationService) Orphans(ctx context.Context, c client.Client, apps []*argocdv1alpha1.Application) ([]argocdv1alpha1.Application, error) {
+	list := &argocdv1alpha1.ApplicationList{}
+	if err := c.List(ctx, list, client.InNamespace(p.config.Namespace)); err != nil {
+		return nil, err
+	}
+	desired := map[string]bool{}
+	for _, app := range apps {
+		desired[app.Name] = true
+	}
+	var orphans []argocdv1alpha1.Application
+	for _, item := range list.Items {
+		if item.Annotations[mergeRequestAnnotation] == p.key() && !desired[item.Name] {
+			orphans = append(orphans, item)
+		}
+	}
+	return orphans, nil
+}
+
+// MergeRequestKey はApplicationを作成したMergeRequestを返す
+// ベースライン環境など、MergeRequestに属さないApplicationの場合はfalseを返す
+func MergeRequestKey(app client.Object) (types.NamespacedName, bool) {
+	value, ok := app.GetAnnotations()[mergeRequestAnnotation]
+	if !ok {
+		return types.NamespacedName{}, false
+	}
+	namespace, name, found := strings.Cut(value, "/")
+	if !found {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}, true
+}
+
+func (p *ApplicationService) key() string {
+	return p.Namespace + "/" + p.Name
+}
+
 func (p *ApplicationService) Delete(ctx context.Context, client client.Client, found *argocdv1alpha1.Application) error {
 	logger := log.FromContext(ctx)
 	logger.Info("Delete Application name : " + found.Name)
@@ -52,13 +206,16 @@ func (p *ApplicationService) createApp(name string, groupName string, applicatio
 	app := &argocdv1alpha1.Application{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
-			Namespace: "argocd",
+			Namespace: p.config.Namespace,
+			Annotations: map[string]string{
+				mergeRequestAnnotation: p.key(),
+			},
 		},
 		Spec: argocdv1alpha1.ApplicationSpec{
-			Source:               source(p.Spec.BaseUrl, groupName, applicationName, p.Spec.ManifestPath, p.Spec.TargetRevision),
-			Destination:          *destination(groupName, "https://kubernetes.default.svc", ""),
-			Project:              "default",
-			SyncPolicy:           syncPolicy(true, true, false),
+			Source:               inject(source(p.Spec.Repository, p.Spec.Source), p.Spec.Variables, p.variables),
+			Destination:          *clusterDestination(p.Spec.Destination, groupName),
+			Project:              p.config.ProjectName(&p.MergeRequest),
+			SyncPolicy:           syncPolicy(p.Spec.ArgoCD.SyncPolicy),
 			IgnoreDifferences:    nil,
 			Info:                 nil,
 			RevisionHistoryLimit: nil,
@@ -68,11 +225,16 @@ func (p *ApplicationService) createApp(name string, groupName string, applicatio
 }
 
 // リポジトリ指定のみサポート
-func source(baseUrl string, groupName string, applicationName string, manifestPath string, targetRevision string) *argocdv1alpha1.ApplicationSource {
-	repoURL := fmt.Sprintf("%s/%s/%s.git", baseUrl, groupName, applicationName)
+func source(repository reviewv1beta1.RepositorySpec, src reviewv1beta1.SourceSpec) *argocdv1alpha1.ApplicationSource {
+	repoURL := repository.URL
+	if repoURL == "" {
+		repoURL = fmt.Sprintf("%s/%s/%s.git", repository.Host, repository.Group, repository.Project)
+	}
+	manifestPath := src.Path
 	if manifestPath == "" {
 		manifestPath = "/" // default
 	}
+	targetRevision := src.TargetRevision
 	if targetRevision == "" {
 		targetRevision = "HEAD" // default
 	}
@@ -86,9 +248,76 @@ func source(baseUrl string, groupName string, applicationName string, manifestPa
 		Plugin:         nil,
 		Chart:          "",
 	}
+	// 種別の指定がなければArgo CDの自動判別に任せる
+	switch src.Type {
+	case reviewv1beta1.SourceTypeHelm:
+		res.Helm = &argocdv1alpha1.ApplicationSourceHelm{}
+	case reviewv1beta1.SourceTypeKustomize:
+		res.Kustomize = &argocdv1alpha1.ApplicationSourceKustomize{}
+	case reviewv1beta1.SourceTypeDirectory:
+		res.Directory = &argocdv1alpha1.ApplicationSourceDirectory{}
+	}
 	return res
 }
 
+// Helmの場合はパラメーター、Kustomizeの場合は共通のアノテーションとして変数を加える
+func inject(res *argocdv1alpha1.ApplicationSource, spec reviewv1beta1.VariablesSpec, vars map[string]string) *argocdv1alpha1.ApplicationSource {
+	if len(vars) == 0 {
+		return res
+	}
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	switch spec.Inject {
+	case reviewv1beta1.VariablesInjectionHelm:
+		prefix := spec.Prefix
+		if prefix == "" {
+			prefix = "review" // default
+		}
+		if res.Helm == nil {
+			res.Helm = &argocdv1alpha1.ApplicationSourceHelm{}
+		}
+		for _, k := range keys {
+			res.Helm.Parameters = append(res.Helm.Parameters, argocdv1alpha1.HelmParameter{
+				Name:        prefix + "." + k,
+				Value:       vars[k],
+				ForceString: true,
+			})
+		}
+	case reviewv1beta1.VariablesInjectionKustomize:
+		prefix := spec.Prefix
+		if prefix == "" {
+			prefix = "review.nautible.com" // default
+		}
+		if res.Kustomize == nil {
+			res.Kustomize = &argocdv1alpha1.ApplicationSourceKustomize{}
+		}
+		res.Kustomize.CommonAnnotations = map[string]string{}
+		for _, k := range keys {
+			res.Kustomize.CommonAnnotations[prefix+"/"+k] = vars[k]
+		}
+	}
+	return res
+}
+
+// クラスタ名の指定があればクラスタ名を、なければサーバーURLを利用する
+func clusterDestination(dest reviewv1beta1.DestinationSpec, namespace string) *argocdv1alpha1.ApplicationDestination {
+	if dest.Name != "" {
+		return destination(namespace, "", dest.Name)
+	}
+	if dest.Server != "" {
+		return destination(namespace, dest.Server, "")
+	}
+	return destination(namespace, "https://kubernetes.default.svc", "") // default
+}
+
+// ApplicationDestinationは非公開の項目を持つため、公開されている項目で比較する
+func sameDestination(a argocdv1alpha1.ApplicationDestination, b argocdv1alpha1.ApplicationDestination) bool {
+	return a.Server == b.Server && a.Name == b.Name && a.Namespace == b.Namespace
+}
+
 func destination(namespace string, server string, name string) *argocdv1alpha1.ApplicationDestination {
 	res := &argocdv1alpha1.ApplicationDestination{
 		Namespace: namespace,
@@ -98,7 +327,20 @@ func destination(namespace string, server string, name string) *argocdv1alpha1.A
 	return res
 }
 
-func syncPolicy(selfHeal bool, prune bool, allowEmpty bool) *argocdv1alpha1.SyncPolicy {
+func syncPolicy(spec *reviewv1beta1.SyncPolicySpec) *argocdv1alpha1.SyncPolicy {
+	// default
+	selfHeal, prune, allowEmpty := true, true, false
+	if spec != nil {
+		if spec.SelfHeal != nil {
+			selfHeal = *spec.SelfHeal
+		}
+		if spec.Prune != nil {
+			prune = *spec.Prune
+		}
+		if spec.AllowEmpty != nil {
+			allowEmpty = *spec.AllowEmpty
+		}
+	}
 	res := &argocdv1alpha1.SyncPolicy{
 		Automated: &argocdv1alpha1.SyncPolicyAutomated{
 			SelfHeal:   selfHeal,
@@ -106,7 +348,42 @@ func syncPolicy(selfHeal bool, prune bool, allowEmpty bool) *argocdv1alpha1.Sync
 			AllowEmpty: allowEmpty,
 		},
 		SyncOptions: argocdv1alpha1.SyncOptions{},
-		Retry:       &argocdv1alpha1.RetryStrategy{},
+		Retry:       retry(nil),
+	}
+	if spec != nil {
+		res.SyncOptions = append(res.SyncOptions, spec.SyncOptions...)
+		res.Retry = retry(spec.Retry)
+	}
+	return res
+}
+
+func retry(spec *reviewv1beta1.RetrySpec) *argocdv1alpha1.RetryStrategy {
+	// default
+	limit, factor := int64(5), int64(2)
+	duration, maxDuration := "5s", "3m"
+	if spec != nil {
+		if spec.Limit != nil {
+			limit = *spec.Limit
+		}
+		if b := spec.Backoff; b != nil {
+			if b.Duration != "" {
+				duration = b.Duration
+			}
+			if b.Factor != nil {
+				factor = *b.Factor
+			}
+			if b.MaxDuration != "" {
+				maxDuration = b.MaxDuration
+			}
+		}
+	}
+	res := &argocdv1alpha1.RetryStrategy{
+		Limit: limit,
+		Backoff: &argocdv1alpha1.Backoff{
+			Duration:    duration,
+			Factor:      &factor,
+			MaxDuration: maxDuration,
+		},
 	}
 	return res
 }
@@ -0,0 +1,139 @@
+package argocd
+
+import (
+	"context"
+	"testing"
+
+	argocdv1alpha1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestApplicationsInjectVariables(t *testing.T) {
+	vars := map[string]string{"REVIEW_URL": "http://demo1.review.example.com/?branch=feature%2Fa", "REVIEW_MR_IID": "12"}
+	for _, tc := range []struct {
+		name      string
+		variables reviewv1beta1.VariablesSpec
+		check     func(src *argocdv1alpha1.ApplicationSource) bool
+	}{
+		{
+			"helm",
+			reviewv1beta1.VariablesSpec{Inject: reviewv1beta1.VariablesInjectionHelm},
+			func(src *argocdv1alpha1.ApplicationSource) bool {
+				helm := src.Helm
+				return helm != nil && len(helm.Parameters) == 2 && helm.Parameters[0].Name == "review.REVIEW_MR_IID" && helm.Parameters[1].Value == vars["REVIEW_URL"]
+			},
+		},
+		{
+			"kustomize",
+			reviewv1beta1.VariablesSpec{Inject: reviewv1beta1.VariablesInjectionKustomize, Prefix: "example.com"},
+			func(src *argocdv1alpha1.ApplicationSource) bool {
+				return src.Kustomize != nil && src.Kustomize.CommonAnnotations["example.com/REVIEW_MR_IID"] == "12"
+			},
+		},
+		{
+			"without inject",
+			reviewv1beta1.VariablesSpec{},
+			func(src *argocdv1alpha1.ApplicationSource) bool {
+				return src.Helm == nil && src.Kustomize == nil
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{Variables: tc.variables}}
+			svc := NewApplicationService(mr, Config{Namespace: "argocd"})
+			svc.SetVariables(vars)
+			if src := svc.Applications("demo1-demo1pj1-feature-a")[0].Spec.Source; !tc.check(src) {
+				t.Errorf("unexpected source: %+v", src)
+			}
+			if svc.Baseline().Spec.Source.Helm != nil {
+				t.Error("variables injected into the baseline application")
+			}
+		})
+	}
+}
+
+func TestBaselinePerGroup(t *testing.T) {
+	config := Config{Namespace: "argocd"}
+	mergeRequest := func(project string) *reviewv1beta1.MergeRequest {
+		return &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+			Repository: reviewv1beta1.RepositorySpec{Host: "http://gitlab", Group: "demo1", Project: project},
+			Routing:    reviewv1beta1.RoutingSpec{Mode: reviewv1beta1.RoutingModeBaseline},
+		}}
+	}
+	api, web := mergeRequest("demo1pj1"), mergeRequest("demo1pj2")
+
+	// 同じグループのMergeRequestは同じベースライン環境を共有する
+	baseline := NewApplicationService(api, config).Baseline()
+	if other := NewApplicationService(web, config).Baseline(); other.Name != baseline.Name || other.Spec.Source.RepoURL != baseline.Spec.Source.RepoURL {
+		t.Errorf("baseline differs between projects: %s %s, %s %s", baseline.Name, baseline.Spec.Source.RepoURL, other.Name, other.Spec.Source.RepoURL)
+	}
+	if baseline.Name != "demo1-baseline" || baseline.Labels[reviewv1beta1.BaselineGroupLabel] != "demo1" {
+		t.Errorf("unexpected baseline: %s %v", baseline.Name, baseline.Labels)
+	}
+	if _, ok := MergeRequestKey(baseline); ok {
+		t.Error("baseline application is owned by a merge request")
+	}
+	if src := baseline.Spec.Source; src.RepoURL != "http://gitlab/demo1/baseline.git" || src.TargetRevision != "HEAD" {
+		t.Errorf("unexpected baseline source: %s %s", src.RepoURL, src.TargetRevision)
+	}
+
+	api.Spec.Routing.Baseline = reviewv1beta1.BaselineSpec{
+		URL:    "http://gitlab/platform/environments.git",
+		Source: reviewv1beta1.SourceSpec{Type: reviewv1beta1.SourceTypeKustomize, Path: "demo1"},
+	}
+	src := NewApplicationService(api, config).Baseline().Spec.Source
+	if src.RepoURL != "http://gitlab/platform/environments.git" || src.Path != "demo1" || src.Kustomize == nil {
+		t.Errorf("baseline source was not configured: %+v", src)
+	}
+}
+
+func TestApplicationUpdatedByPolicy(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := argocdv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+	config := Config{Namespace: "argocd"}
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Host: "http://gitlab", Group: "demo1", Project: "demo1pj1"},
+	}}
+	svc := NewApplicationService(mr, config)
+	if err := svc.Create(ctx, c, svc.Applications("demo1-demo1pj1-feature-a")[0]); err != nil {
+		t.Fatal(err)
+	}
+	found := &argocdv1alpha1.Application{}
+	key := client.ObjectKey{Name: "demo1-demo1pj1-feature-a", Namespace: "argocd"}
+	if err := c.Get(ctx, key, found); err != nil {
+		t.Fatal(err)
+	}
+	// 保存した内容と同じであれば更新しない
+	if Changed(found, svc.Applications("demo1-demo1pj1-feature-a")[0]) {
+		t.Error("unchanged application is reported as changed")
+	}
+
+	// ポリシーの同期ポリシー、AppProject、デプロイ先の変更を作成済みのApplicationに反映する
+	selfHeal, limit := false, int64(1)
+	updated := mr.DeepCopy()
+	updated.Spec.ArgoCD.Project = "review"
+	updated.Spec.ArgoCD.SyncPolicy = &reviewv1beta1.SyncPolicySpec{SelfHeal: &selfHeal, Retry: &reviewv1beta1.RetrySpec{Limit: &limit}}
+	updated.Spec.Destination = reviewv1beta1.DestinationSpec{Name: "east"}
+	svc = NewApplicationService(updated, config)
+	app := svc.Applications("demo1-demo1pj1-feature-a")[0]
+	if !Changed(found, app) {
+		t.Fatal("policy change is not detected")
+	}
+	if err := svc.Update(ctx, c, found, app); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, found); err != nil {
+		t.Fatal(err)
+	}
+	if found.Spec.Project != "review" || found.Spec.Destination.Name != "east" ||
+		found.Spec.SyncPolicy.Automated.SelfHeal || found.Spec.SyncPolicy.Retry.Limit != 1 {
+		t.Errorf("application was not updated: %+v", found.Spec)
+	}
+}
@@ -0,0 +1,30 @@
+package argocd
+
+import (
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+)
+
+// Config はオペレーターの起動オプションで指定するArgo CDの設定
+type Config struct {
+	// Argo CDがApplication、AppProjectを監視するNamespace
+	Namespace string
+	// MergeRequestで指定がない場合に利用するAppProject
+	Project string
+	// trueの場合、MergeRequestで指定がなければグループ単位のAppProjectを作成して利用する
+	GroupProject bool
+}
+
+// ProjectName はApplicationに設定するAppProject名を返す
+// MergeRequest(ポリシー適用後)の指定 > グループ単位のAppProject > 起動オプションの順で決定する
+func (c Config) ProjectName(mr *reviewv1beta1.MergeRequest) string {
+	if mr.Spec.ArgoCD.Project != "" {
+		return mr.Spec.ArgoCD.Project
+	}
+	if c.GroupProject {
+		return mr.Spec.Repository.Group
+	}
+	if c.Project != "" {
+		return c.Project
+	}
+	return "default" // default
+}
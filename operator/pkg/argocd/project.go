@@ -0,0 +1,136 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	argocdv1alpha1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// AppProjectService はグループ単位のAppProjectを管理する
+// 同じグループのMergeRequestで共有するため、MergeRequestの削除時には削除しない
+type AppProjectService struct {
+	reviewv1beta1.MergeRequest
+	config Config
+}
+
+func NewAppProjectService(mr *reviewv1beta1.MergeRequest, config Config) *AppProjectService {
+	return &AppProjectService{*mr, config}
+}
+
+// CreateOrUpdate はグループのリポジトリとNamespaceのみを許可するAppProjectを作成・更新する
+// 同じグループのMergeRequestが別のクラスタやリポジトリを利用していることがあるため、既存の許可は残して追加する
+func (p *AppProjectService) CreateOrUpdate(ctx context.Context, c client.Client) error {
+	logger := log.FromContext(ctx)
+	group := p.Spec.Repository.Group
+	project := &argocdv1alpha1.AppProject{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      group,
+			Namespace: p.config.Namespace,
+		},
+	}
+	// ApplicationDestinationは非公開の項目を持ちequality.Semanticで比較できないため、CreateOrUpdateを使わず項目ごとに比較する
+	found := &argocdv1alpha1.AppProject{}
+	err := c.Get(ctx, client.ObjectKeyFromObject(project), found)
+	if apierrors.IsNotFound(err) {
+		p.merge(project)
+		if err := c.Create(ctx, project); err != nil {
+			logger.Error(err, "AppProject create error", "AppProject", group)
+			return err
+		}
+		logger.Info("AppProject created", "AppProject", group)
+		return nil
+	} else if err != nil {
+		logger.Error(err, "AppProject get error", "AppProject", group)
+		return err
+	}
+	before := found.DeepCopy()
+	p.merge(found)
+	if found.Spec.Description == before.Spec.Description && reflect.DeepEqual(found.Spec.SourceRepos, before.Spec.SourceRepos) &&
+		len(found.Spec.Destinations) == len(before.Spec.Destinations) && before.Spec.ClusterResourceWhitelist == nil {
+		return nil
+	}
+	if err := c.Update(ctx, found); err != nil {
+		logger.Error(err, "AppProject update error", "AppProject", group)
+		return err
+	}
+	logger.Info("AppProject updated", "AppProject", group)
+	return nil
+}
+
+// merge はMergeRequestのリポジトリとデプロイ先をAppProjectの許可に加える
+func (p *AppProjectService) merge(project *argocdv1alpha1.AppProject) {
+	group := p.Spec.Repository.Group
+	project.Spec.Description = fmt.Sprintf("review environments of %s", group)
+	project.Spec.SourceRepos = appendRepo(project.Spec.SourceRepos, fmt.Sprintf("%s/%s/*", p.Spec.Repository.Host, group))
+	if p.Spec.Repository.URL != "" {
+		project.Spec.SourceRepos = appendRepo(project.Spec.SourceRepos, p.Spec.Repository.URL)
+	}
+	project.Spec.Destinations = appendDestination(project.Spec.Destinations, *clusterDestination(p.Spec.Destination, group))
+	// クラスタスコープのリソースはデプロイさせない
+	project.Spec.ClusterResourceWhitelist = nil
+}
+
+func appendRepo(repos []string, repo string) []string {
+	for _, r := range repos {
+		if r == repo {
+			return repos
+		}
+	}
+	return append(repos, repo)
+}
+
+func appendDestination(dests []argocdv1alpha1.ApplicationDestination, dest argocdv1alpha1.ApplicationDestination) []argocdv1alpha1.ApplicationDestination {
+	for _, d := range dests {
+		if sameDestination(d, dest) {
+			return dests
+		}
+	}
+	return append(dests, dest)
+}
+
+// Release は削除するMergeRequestのリポジトリ(フォークなど)をAppProjectの許可から外す
+// remaining(同じグループの削除中でないMergeRequest)が利用しているリポジトリは残す
+func (p *AppProjectService) Release(ctx context.Context, c client.Client, remaining []reviewv1beta1.MergeRequest) error {
+	logger := log.FromContext(ctx)
+	url := p.Spec.Repository.URL
+	if url == "" {
+		return nil
+	}
+	for _, mr := range remaining {
+		if mr.Spec.Repository.URL == url {
+			return nil
+		}
+	}
+	group := p.Spec.Repository.Group
+	project := &argocdv1alpha1.AppProject{}
+	err := c.Get(ctx, client.ObjectKey{Name: group, Namespace: p.config.Namespace}, project)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		logger.Error(err, "AppProject get error", "AppProject", group)
+		return err
+	}
+	repos := []string{}
+	for _, r := range project.Spec.SourceRepos {
+		if r != url {
+			repos = append(repos, r)
+		}
+	}
+	if len(repos) == len(project.Spec.SourceRepos) {
+		return nil
+	}
+	project.Spec.SourceRepos = repos
+	if err := c.Update(ctx, project); err != nil {
+		logger.Error(err, "AppProject update error", "AppProject", group)
+		return err
+	}
+	logger.Info("AppProject repository released", "AppProject", group, "repository", url)
+	return nil
+}
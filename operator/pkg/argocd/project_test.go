@@ -0,0 +1,93 @@
+package argocd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	argocdv1alpha1 "github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAppProjectDestinations(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := argocdv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+	config := Config{Namespace: "argocd", GroupProject: true}
+
+	// 同じグループのMergeRequestを別のクラスタに配置しても、先に処理したクラスタの許可を残す
+	for _, cluster := range []string{"east", "west", "east"} {
+		mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+			Repository:  reviewv1beta1.RepositorySpec{Host: "http://gitlab", Group: "demo1"},
+			Destination: reviewv1beta1.DestinationSpec{Name: cluster},
+		}}
+		if err := NewAppProjectService(mr, config).CreateOrUpdate(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	project := &argocdv1alpha1.AppProject{}
+	if err := c.Get(ctx, client.ObjectKey{Name: "demo1", Namespace: "argocd"}, project); err != nil {
+		t.Fatal(err)
+	}
+	dests := project.Spec.Destinations
+	if len(dests) != 2 || dests[0].Name != "east" || dests[1].Name != "west" || dests[0].Namespace != "demo1" {
+		t.Errorf("destinations = %+v, want east and west", dests)
+	}
+	if repos := project.Spec.SourceRepos; len(repos) != 1 || repos[0] != "http://gitlab/demo1/*" {
+		t.Errorf("source repos = %v", repos)
+	}
+}
+
+func TestAppProjectForkRepositories(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := argocdv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+	config := Config{Namespace: "argocd", GroupProject: true}
+	fork := func(url string) *reviewv1beta1.MergeRequest {
+		return &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+			Repository: reviewv1beta1.RepositorySpec{Host: "http://gitlab", Group: "demo1", URL: url},
+		}}
+	}
+	first, second := fork("http://gitlab/alice/pj1.git"), fork("http://gitlab/bob/pj1.git")
+	repos := func() []string {
+		project := &argocdv1alpha1.AppProject{}
+		if err := c.Get(ctx, client.ObjectKey{Name: "demo1", Namespace: "argocd"}, project); err != nil {
+			t.Fatal(err)
+		}
+		return project.Spec.SourceRepos
+	}
+
+	// 2つ目のフォークを処理しても1つ目のフォークのリポジトリを残す
+	for _, mr := range []*reviewv1beta1.MergeRequest{first, second, first} {
+		if err := NewAppProjectService(mr, config).CreateOrUpdate(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := repos(); !reflect.DeepEqual(got, []string{"http://gitlab/demo1/*", "http://gitlab/alice/pj1.git", "http://gitlab/bob/pj1.git"}) {
+		t.Errorf("source repos = %v", got)
+	}
+
+	// 同じフォークのMergeRequestが残っていれば外さない
+	if err := NewAppProjectService(first, config).Release(ctx, c, []reviewv1beta1.MergeRequest{*first, *second}); err != nil {
+		t.Fatal(err)
+	}
+	if got := repos(); len(got) != 3 {
+		t.Errorf("source repos after releasing a shared fork = %v", got)
+	}
+	// 削除したMergeRequestのフォークのみ外す
+	if err := NewAppProjectService(first, config).Release(ctx, c, []reviewv1beta1.MergeRequest{*second}); err != nil {
+		t.Fatal(err)
+	}
+	if got := repos(); !reflect.DeepEqual(got, []string{"http://gitlab/demo1/*", "http://gitlab/bob/pj1.git"}) {
+		t.Errorf("source repos after deleting the first fork = %v", got)
+	}
+}
@@ -0,0 +1,184 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const kubeconfigKey = "kubeconfig"
+
+// Argo CDがオペレーターと同じクラスタを指す名前とURL
+const (
+	inClusterName   = "in-cluster"
+	inClusterServer = "https://kubernetes.default.svc"
+)
+
+// Provider はレビュー環境のデプロイ先クラスタのクライアントを提供する
+type Provider struct {
+	local     client.Client
+	config    *rest.Config
+	scheme    *runtime.Scheme
+	namespace string
+
+	mu      sync.Mutex
+	clients map[string]cachedClient
+	// オペレーターが動作するクラスタのclientset。初回の利用時に作成する
+	clientset kubernetes.Interface
+}
+
+type cachedClient struct {
+	resourceVersion string
+	client          client.Client
+	clientset       kubernetes.Interface
+}
+
+// NewProvider はkubeconfigを保持するSecretをnamespaceから読み込むProviderを作成する
+// configはオペレーターが動作するクラスタの接続情報
+func NewProvider(local client.Client, config *rest.Config, scheme *runtime.Scheme, namespace string) *Provider {
+	return &Provider{
+		local:     local,
+		config:    config,
+		scheme:    scheme,
+		namespace: namespace,
+		clients:   map[string]cachedClient{},
+	}
+}
+
+// Client はデプロイ先クラスタのクライアントを返す
+// kubeconfigのSecretが指定されていなければオペレーターが動作するクラスタのクライアントを返す
+// ほかのクラスタをkubeconfigのSecretなしで指定した場合はエラー
+func (p *Provider) Client(ctx context.Context, dest reviewv1beta1.DestinationSpec) (client.Client, error) {
+	if dest.KubeconfigSecret == "" {
+		if !isLocal(dest) {
+			return nil, errNoKubeconfig(dest)
+		}
+		return p.local, nil
+	}
+	cached, err := p.cached(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	return cached.client, nil
+}
+
+// Clientset はPodのログの取得など、controller-runtimeのクライアントで扱えない操作に利用するクライアントを返す
+func (p *Provider) Clientset(ctx context.Context, dest reviewv1beta1.DestinationSpec) (kubernetes.Interface, error) {
+	if dest.KubeconfigSecret == "" {
+		if !isLocal(dest) {
+			return nil, errNoKubeconfig(dest)
+		}
+		return p.localClientset()
+	}
+	cached, err := p.cached(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	return cached.clientset, nil
+}
+
+// isLocal はデプロイ先がオペレーターの動作するクラスタ(指定なし、in-cluster)か判定する
+// 名前の指定はURLより優先する
+func isLocal(dest reviewv1beta1.DestinationSpec) bool {
+	if dest.Name != "" {
+		return dest.Name == inClusterName
+	}
+	return dest.Server == "" || dest.Server == inClusterServer
+}
+
+func errNoKubeconfig(dest reviewv1beta1.DestinationSpec) error {
+	return fmt.Errorf("destination %s is not the local cluster and has no kubeconfigSecret", dest.Key())
+}
+
+// 接続情報は変わらないため、作成したclientsetを使い続ける
+func (p *Provider) localClientset() (kubernetes.Interface, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clientset != nil {
+		return p.clientset, nil
+	}
+	clientset, err := kubernetes.NewForConfig(p.config)
+	if err != nil {
+		return nil, err
+	}
+	p.clientset = clientset
+	return clientset, nil
+}
+
+func (p *Provider) cached(ctx context.Context, dest reviewv1beta1.DestinationSpec) (cachedClient, error) {
+	secret := &corev1.Secret{}
+	if err := p.local.Get(ctx, client.ObjectKey{Name: dest.KubeconfigSecret, Namespace: p.namespace}, secret); err != nil {
+		return cachedClient{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Secretが更新されていなければ作成済みのクライアントを再利用する
+	if cached, ok := p.clients[secret.Name]; ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached, nil
+	}
+	data, ok := secret.Data[kubeconfigKey]
+	if !ok {
+		return cachedClient{}, fmt.Errorf("secret %s/%s has no %q key", p.namespace, secret.Name, kubeconfigKey)
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return cachedClient{}, err
+	}
+	c, err := client.New(config, client.Options{Scheme: p.scheme})
+	if err != nil {
+		return cachedClient{}, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return cachedClient{}, err
+	}
+	cached := cachedClient{resourceVersion: secret.ResourceVersion, client: c, clientset: clientset}
+	p.clients[secret.Name] = cached
+	return cached, nil
+}
+
+// Select はレビュー環境のデプロイ先クラスタを決定する
+// MergeRequestの指定 > 選択済みのクラスタ > ポリシーの候補の順で決定し、いずれもなければゼロ値(Argo CDと同じクラスタ)を返す
+func Select(ctx context.Context, c client.Client, mr *reviewv1beta1.MergeRequest, p *reviewv1beta1.ReviewEnvironmentPolicy) (reviewv1beta1.DestinationSpec, error) {
+	if !mr.Spec.Destination.IsZero() {
+		return mr.Spec.Destination, nil
+	}
+	if mr.Status.Destination != nil {
+		return *mr.Status.Destination, nil
+	}
+	if p == nil || len(p.Spec.Destination.Clusters) == 0 {
+		return reviewv1beta1.DestinationSpec{}, nil
+	}
+	candidates := p.Spec.Destination.Clusters
+	if p.Spec.Destination.Selection != reviewv1beta1.ClusterSelectionLeastLoaded {
+		return candidates[0], nil
+	}
+
+	// デプロイ済みのレビュー環境が最も少ないクラスタを選択する
+	list := &reviewv1beta1.MergeRequestList{}
+	if err := c.List(ctx, list); err != nil {
+		return reviewv1beta1.DestinationSpec{}, err
+	}
+	load := map[string]int{}
+	for _, item := range list.Items {
+		if item.Status.Destination != nil {
+			load[item.Status.Destination.Key()]++
+		}
+	}
+	selected := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if load[candidate.Key()] < load[selected.Key()] {
+			selected = candidate
+		}
+	}
+	return selected, nil
+}
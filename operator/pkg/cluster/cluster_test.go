@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func deployedTo(name string, dest string) *reviewv1beta1.MergeRequest {
+	return &reviewv1beta1.MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "operator-system"},
+		Status: reviewv1beta1.MergeRequestStatus{
+			Destination: &reviewv1beta1.DestinationSpec{Name: dest},
+		},
+	}
+}
+
+func TestSelect(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := reviewv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		deployedTo("a", "cluster-1"),
+		deployedTo("b", "cluster-1"),
+		deployedTo("c", "cluster-2"),
+	).Build()
+	p := &reviewv1beta1.ReviewEnvironmentPolicy{
+		Spec: reviewv1beta1.ReviewEnvironmentPolicySpec{
+			Destination: reviewv1beta1.DestinationPolicy{
+				Clusters: []reviewv1beta1.DestinationSpec{{Name: "cluster-1"}, {Name: "cluster-2"}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		mr        *reviewv1beta1.MergeRequest
+		selection reviewv1beta1.ClusterSelection
+		want      string
+	}{
+		{"first candidate", &reviewv1beta1.MergeRequest{}, "", "cluster-1"},
+		{"least loaded", &reviewv1beta1.MergeRequest{}, reviewv1beta1.ClusterSelectionLeastLoaded, "cluster-2"},
+		{"already selected", deployedTo("d", "cluster-1"), reviewv1beta1.ClusterSelectionLeastLoaded, "cluster-1"},
+		{"spec", &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+			Destination: reviewv1beta1.DestinationSpec{Name: "cluster-3"},
+		}}, reviewv1beta1.ClusterSelectionLeastLoaded, "cluster-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.Spec.Destination.Selection = tt.selection
+			got, err := Select(context.Background(), c, tt.mr, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("got %q, want %q", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientsetCached(t *testing.T) {
+	p := NewProvider(nil, &rest.Config{Host: "https://kubernetes.default.svc"}, runtime.NewScheme(), "operator-system")
+	first, err := p.Clientset(context.Background(), reviewv1beta1.DestinationSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Clientset(context.Background(), reviewv1beta1.DestinationSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("clientset was created on every call")
+	}
+}
+
+func TestClientLocalOnly(t *testing.T) {
+	local := fake.NewClientBuilder().Build()
+	p := NewProvider(local, &rest.Config{Host: "https://kubernetes.default.svc"}, runtime.NewScheme(), "operator-system")
+	for _, tc := range []struct {
+		dest  reviewv1beta1.DestinationSpec
+		local bool
+	}{
+		{reviewv1beta1.DestinationSpec{}, true},
+		{reviewv1beta1.DestinationSpec{Name: "in-cluster"}, true},
+		{reviewv1beta1.DestinationSpec{Server: "https://kubernetes.default.svc"}, true},
+		// ほかのクラスタにオペレーターのクラスタのクライアントを使わない
+		{reviewv1beta1.DestinationSpec{Name: "east"}, false},
+		{reviewv1beta1.DestinationSpec{Server: "https://east.example.com"}, false},
+		{reviewv1beta1.DestinationSpec{Name: "east", Server: "https://kubernetes.default.svc"}, false},
+	} {
+		c, err := p.Client(context.Background(), tc.dest)
+		if tc.local && (err != nil || c != local) {
+			t.Errorf("Client(%+v) = %v, %v, want the local client", tc.dest, c, err)
+		}
+		if !tc.local && err == nil {
+			t.Errorf("Client(%+v) succeeded without kubeconfigSecret", tc.dest)
+		}
+		if _, err := p.Clientset(context.Background(), tc.dest); (err == nil) != tc.local {
+			t.Errorf("Clientset(%+v) error = %v, want local %v", tc.dest, err, tc.local)
+		}
+	}
+}
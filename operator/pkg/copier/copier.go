@@ -0,0 +1,251 @@
+package copier
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"github.com/nautible/review-env-operator/pkg/preview"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// コピーを利用しているMergeRequest(namespace/name)をカンマ区切りで保持するアノテーション
+// 同じグループのレビュー環境はNamespaceを共有するため、利用するMergeRequestがなくなったときにコピーを削除する
+const ownersAnnotation = "review.nautible.com/copied-for"
+
+type CopyService struct {
+	reviewv1beta1.MergeRequest
+}
+
+func NewCopyService(mr *reviewv1beta1.MergeRequest) *CopyService {
+	return &CopyService{*mr}
+}
+
+// Apply はsourceのクラスタのテンプレートNamespaceからtargetのクラスタのレビュー環境のNamespaceへSecret、ConfigMapをコピーし、
+// コピーしたオブジェクトを返す
+func (p *CopyService) Apply(ctx context.Context, source client.Client, target client.Client) ([]reviewv1beta1.CopiedObject, error) {
+	logger := log.FromContext(ctx)
+	data := preview.NewData(&p.MergeRequest)
+	var copied []reviewv1beta1.CopiedObject
+	for _, spec := range p.Spec.Copies {
+		name := spec.Name
+		if spec.TargetName != "" {
+			rendered, err := preview.Render(spec.TargetName, data)
+			if err != nil {
+				return copied, fmt.Errorf("copies %s/%s targetName: %w", spec.Namespace, spec.Name, err)
+			}
+			name = rendered
+		}
+		var err error
+		switch spec.Kind {
+		case reviewv1beta1.CopyKindSecret:
+			err = p.copySecret(ctx, source, target, spec, name, data)
+		case reviewv1beta1.CopyKindConfigMap:
+			err = p.copyConfigMap(ctx, source, target, spec, name, data)
+		default:
+			err = fmt.Errorf("copies %s/%s: unsupported kind %q", spec.Namespace, spec.Name, spec.Kind)
+		}
+		if err != nil {
+			logger.Error(err, "copy error", "Kind", spec.Kind, "Name", name)
+			return copied, err
+		}
+		copied = append(copied, reviewv1beta1.CopiedObject{Kind: spec.Kind, Name: name})
+	}
+	return copied, nil
+}
+
+// Release はコピーの利用者からMergeRequestを外し、利用者がいなくなったコピーを削除する
+func (p *CopyService) Release(ctx context.Context, target client.Client, objects []reviewv1beta1.CopiedObject) error {
+	logger := log.FromContext(ctx)
+	for _, object := range objects {
+		var obj client.Object
+		switch object.Kind {
+		case reviewv1beta1.CopyKindSecret:
+			obj = &corev1.Secret{}
+		case reviewv1beta1.CopyKindConfigMap:
+			obj = &corev1.ConfigMap{}
+		default:
+			continue
+		}
+		err := target.Get(ctx, client.ObjectKey{Name: object.Name, Namespace: p.Spec.Repository.Group}, obj)
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		owners := removeOwner(obj.GetAnnotations()[ownersAnnotation], p.owner())
+		if owners == "" {
+			logger.Info("Delete copy name : " + object.Name)
+			if err := target.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+			continue
+		}
+		annotations := obj.GetAnnotations()
+		annotations[ownersAnnotation] = owners
+		obj.SetAnnotations(annotations)
+		if err := target.Update(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *CopyService) copySecret(ctx context.Context, source client.Client, target client.Client, spec reviewv1beta1.CopySpec, name string, data preview.Data) error {
+	src := &corev1.Secret{}
+	if err := source.Get(ctx, client.ObjectKey{Name: spec.Name, Namespace: spec.Namespace}, src); err != nil {
+		return err
+	}
+	values, err := transform(spec, src.Data, data)
+	if err != nil {
+		return err
+	}
+	dst := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: p.Spec.Repository.Group},
+	}
+	result, err := controllerutil.CreateOrUpdate(ctx, target, dst, func() error {
+		// typeは作成後に変更できない
+		if dst.CreationTimestamp.IsZero() {
+			dst.Type = src.Type
+		}
+		dst.Data = values
+		p.addOwner(dst)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Secret "+string(result), "Name", name)
+	return nil
+}
+
+func (p *CopyService) copyConfigMap(ctx context.Context, source client.Client, target client.Client, spec reviewv1beta1.CopySpec, name string, data preview.Data) error {
+	src := &corev1.ConfigMap{}
+	if err := source.Get(ctx, client.ObjectKey{Name: spec.Name, Namespace: spec.Namespace}, src); err != nil {
+		return err
+	}
+	in := make(map[string][]byte, len(src.Data))
+	for k, v := range src.Data {
+		in[k] = []byte(v)
+	}
+	values, err := transform(spec, in, data)
+	if err != nil {
+		return err
+	}
+	dst := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: p.Spec.Repository.Group},
+	}
+	result, err := controllerutil.CreateOrUpdate(ctx, target, dst, func() error {
+		dst.Data = make(map[string]string, len(values))
+		for k, v := range values {
+			dst.Data[k] = string(v)
+		}
+		p.addOwner(dst)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("ConfigMap "+string(result), "Name", name)
+	return nil
+}
+
+// keysの指定に従いキーを選択・変更し、templateの指定があれば値にレビュー環境ごとの値を埋め込む
+func transform(spec reviewv1beta1.CopySpec, in map[string][]byte, data preview.Data) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	if len(spec.Keys) == 0 {
+		for k, v := range in {
+			out[k] = v
+		}
+	}
+	for _, mapping := range spec.Keys {
+		v, ok := in[mapping.Key]
+		if !ok {
+			return nil, fmt.Errorf("%s %s/%s has no key %q", spec.Kind, spec.Namespace, spec.Name, mapping.Key)
+		}
+		key := mapping.As
+		if key == "" {
+			key = mapping.Key
+		}
+		out[key] = v
+	}
+	if !spec.Template {
+		return out, nil
+	}
+	for k, v := range out {
+		rendered, err := preview.Render(string(v), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s/%s key %q: %w", spec.Kind, spec.Namespace, spec.Name, k, err)
+		}
+		out[k] = []byte(rendered)
+	}
+	return out, nil
+}
+
+func (p *CopyService) owner() string {
+	return p.Namespace + "/" + p.Name
+}
+
+func (p *CopyService) addOwner(obj client.Object) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	owners := splitOwners(annotations[ownersAnnotation])
+	for _, o := range owners {
+		if o == p.owner() {
+			return
+		}
+	}
+	owners = append(owners, p.owner())
+	sort.Strings(owners)
+	annotations[ownersAnnotation] = strings.Join(owners, ",")
+	obj.SetAnnotations(annotations)
+}
+
+func removeOwner(value string, owner string) string {
+	var owners []string
+	for _, o := range splitOwners(value) {
+		if o != owner {
+			owners = append(owners, o)
+		}
+	}
+	return strings.Join(owners, ",")
+}
+
+func splitOwners(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// CacheSelectors はコピー元のラベルを持つSecret、ConfigMapのみをキャッシュする設定を返す
+// クラスタのすべてのSecret、ConfigMapを監視・キャッシュしないよう、コピー元にはラベルを付ける
+// ラベルのないコピー元も定期的なReconcileでコピーするため、ClientDisableCacheForと合わせてAPIサーバーから直接取得する
+func CacheSelectors() cache.SelectorsByObject {
+	selector := cache.ObjectSelector{Label: labels.SelectorFromSet(labels.Set{reviewv1beta1.CopySourceLabel: "true"})}
+	return cache.SelectorsByObject{
+		&corev1.Secret{}:    selector,
+		&corev1.ConfigMap{}: selector,
+	}
+}
+
+// References はMergeRequestのコピー元にNamespace、名前が一致するオブジェクトが含まれるか判定する
+func References(copies []reviewv1beta1.CopySpec, kind reviewv1beta1.CopyKind, namespace string, name string) bool {
+	for _, c := range copies {
+		if c.Kind == kind && c.Namespace == namespace && c.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package copier
+
+import (
+	"context"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestApplyAndRelease(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "review-templates"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte("{}")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "review-templates"},
+			Data: map[string]string{
+				"callback": "{{ .URL }}&path=/oauth/callback",
+				"unused":   "x",
+			},
+		},
+	).Build()
+	ctx := context.Background()
+
+	copies := []reviewv1beta1.CopySpec{
+		{Kind: reviewv1beta1.CopyKindSecret, Namespace: "review-templates", Name: "registry"},
+		{
+			Kind:       reviewv1beta1.CopyKindConfigMap,
+			Namespace:  "review-templates",
+			Name:       "app-config",
+			TargetName: "app-config-{{ .Branch }}",
+			Keys:       []reviewv1beta1.KeyMapping{{Key: "callback", As: "OAUTH_CALLBACK_URL"}},
+			Template:   true,
+		},
+	}
+	services := map[string]*CopyService{}
+	for name, branch := range map[string]string{"demo1-demo1pj1-feature-a": "feature/a", "demo1-demo1pj1-feature-b": "feature/b"} {
+		services[branch] = NewCopyService(&reviewv1beta1.MergeRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "operator-system"},
+			Spec: reviewv1beta1.MergeRequestSpec{
+				Repository: reviewv1beta1.RepositorySpec{Group: "demo1"},
+				Source:     reviewv1beta1.SourceSpec{TargetRevision: branch},
+				Routing:    reviewv1beta1.RoutingSpec{Hosts: []string{"demo1.review.example.com"}},
+				Copies:     copies,
+			},
+		})
+	}
+	a, b := services["feature/a"], services["feature/b"]
+	copiedA, err := a.Apply(ctx, c, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Apply(ctx, c, c); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := &corev1.Secret{}
+	if err = c.Get(ctx, client.ObjectKey{Name: "registry", Namespace: "demo1"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Type != corev1.SecretTypeDockerConfigJson || secret.Annotations[ownersAnnotation] != "operator-system/demo1-demo1pj1-feature-a,operator-system/demo1-demo1pj1-feature-b" {
+		t.Errorf("unexpected secret: %+v", secret)
+	}
+	cm := &corev1.ConfigMap{}
+	if err = c.Get(ctx, client.ObjectKey{Name: "app-config-feature-a", Namespace: "demo1"}, cm); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"OAUTH_CALLBACK_URL": "http://demo1.review.example.com/?branch=feature%2Fa&path=/oauth/callback"}
+	if len(cm.Data) != 1 || cm.Data["OAUTH_CALLBACK_URL"] != expected["OAUTH_CALLBACK_URL"] {
+		t.Errorf("unexpected config map data: %v", cm.Data)
+	}
+
+	// 共有しているSecretは残り、環境ごとのConfigMapは削除される
+	if err = a.Release(ctx, c, copiedA); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Get(ctx, client.ObjectKey{Name: "registry", Namespace: "demo1"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Annotations[ownersAnnotation] != "operator-system/demo1-demo1pj1-feature-b" {
+		t.Errorf("unexpected owners: %q", secret.Annotations[ownersAnnotation])
+	}
+	err = c.Get(ctx, client.ObjectKey{Name: "app-config-feature-a", Namespace: "demo1"}, cm)
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("config map not deleted: %v", err)
+	}
+}
+
+func TestCacheSelectors(t *testing.T) {
+	selectors := CacheSelectors()
+	if len(selectors) != 2 {
+		t.Fatalf("selectors = %d, want Secret and ConfigMap", len(selectors))
+	}
+	for obj, selector := range selectors {
+		if !selector.Label.Matches(labels.Set{reviewv1beta1.CopySourceLabel: "true"}) {
+			t.Errorf("%T: labeled source does not match", obj)
+		}
+		if selector.Label.Matches(labels.Set{"app": "demo1"}) {
+			t.Errorf("%T: unlabeled object matches", obj)
+		}
+	}
+}
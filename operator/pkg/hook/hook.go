@@ -0,0 +1,213 @@
+package hook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Jobを作成したフックの定義のハッシュを保持するアノテーション
+// 定義が変わった場合はJobを作り直す
+const specHashAnnotation = "review.nautible.com/hook-hash"
+
+const (
+	defaultBackoffLimit          int32 = 3
+	defaultActiveDeadlineSeconds int64 = 600
+	maxNameLength                      = 63
+)
+
+type HookService struct {
+	reviewv1beta1.MergeRequest
+	name string
+}
+
+// NewHookService はnameを接頭辞とするJobでフックを実行するHookServiceを作成する
+func NewHookService(mr *reviewv1beta1.MergeRequest, name string) *HookService {
+	return &HookService{*mr, name}
+}
+
+// Hooks はフェーズに定義されたフックを返す
+func (p *HookService) Hooks(phase reviewv1beta1.HookPhase) []reviewv1beta1.HookSpec {
+	switch phase {
+	case reviewv1beta1.HookPhasePreSync:
+		return p.Spec.Hooks.PreSync
+	case reviewv1beta1.HookPhasePostSync:
+		return p.Spec.Hooks.PostSync
+	case reviewv1beta1.HookPhaseTeardown:
+		return p.Spec.Hooks.Teardown
+	case reviewv1beta1.HookPhaseSmokeTest:
+		if p.Spec.SmokeTest.Job != nil {
+			return []reviewv1beta1.HookSpec{*p.Spec.SmokeTest.Job}
+		}
+	}
+	return nil
+}
+
+// Run はフェーズのフックを定義順に1つずつJobとして実行し、各フックの状態を返す
+// すべてのJobが成功した場合にdoneがtrueになる
+// Jobが失敗した場合は以降のフックを実行しない(Job内のリトライはbackoffLimitに従う)
+func (p *HookService) Run(ctx context.Context, c client.Client, phase reviewv1beta1.HookPhase) (bool, []reviewv1beta1.HookStatus, error) {
+	var statuses []reviewv1beta1.HookStatus
+	for _, hook := range p.Hooks(phase) {
+		status, err := p.RunJob(ctx, c, phase, hook)
+		if err != nil {
+			return false, statuses, err
+		}
+		statuses = append(statuses, status)
+		if status.State != reviewv1beta1.HookStateSucceeded {
+			return false, statuses, nil
+		}
+	}
+	return true, statuses, nil
+}
+
+// RunJob はフックをJobとして実行し、Jobの状態を返す
+// Jobがなければ作成し、定義が変わっていれば作り直す
+func (p *HookService) RunJob(ctx context.Context, c client.Client, phase reviewv1beta1.HookPhase, hook reviewv1beta1.HookSpec) (reviewv1beta1.HookStatus, error) {
+	logger := log.FromContext(ctx)
+	job, err := p.job(phase, hook)
+	if err != nil {
+		return reviewv1beta1.HookStatus{}, err
+	}
+	status := reviewv1beta1.HookStatus{Name: hook.Name, Phase: phase, Job: job.Name, State: reviewv1beta1.HookStateRunning}
+
+	found := &batchv1.Job{}
+	err = c.Get(ctx, client.ObjectKeyFromObject(job), found)
+	if apierrors.IsNotFound(err) {
+		logger.Info("Create hook Job name : " + job.Name)
+		if err := c.Create(ctx, job); err != nil {
+			logger.Error(err, "hook Job create error", "Job", job.Name)
+			return status, err
+		}
+		return status, nil
+	} else if err != nil {
+		logger.Error(err, "hook Job get error", "Job", job.Name)
+		return status, err
+	}
+
+	// 定義が変わったJobは削除し、次回のReconcileで作り直す
+	if found.Annotations[specHashAnnotation] != job.Annotations[specHashAnnotation] {
+		logger.Info("Recreate hook Job name : " + job.Name)
+		if err := deleteJob(ctx, c, found); err != nil {
+			return status, err
+		}
+		return status, nil
+	}
+
+	status.Attempts = found.Status.Failed
+	if jobCondition(found, batchv1.JobComplete) != nil {
+		status.State = reviewv1beta1.HookStateSucceeded
+	} else if failed := jobCondition(found, batchv1.JobFailed); failed != nil {
+		status.State = reviewv1beta1.HookStateFailed
+		status.Message = failed.Message
+	}
+	return status, nil
+}
+
+// Delete はMergeRequestのフックのJobをすべて削除する
+func (p *HookService) Delete(ctx context.Context, c client.Client) error {
+	logger := log.FromContext(ctx)
+	for _, phase := range []reviewv1beta1.HookPhase{reviewv1beta1.HookPhasePreSync, reviewv1beta1.HookPhasePostSync, reviewv1beta1.HookPhaseTeardown, reviewv1beta1.HookPhaseSmokeTest} {
+		for _, hook := range p.Hooks(phase) {
+			job := &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      p.jobName(phase, hook.Name),
+					Namespace: p.Spec.Repository.Group,
+				},
+			}
+			logger.Info("Delete hook Job name : " + job.Name)
+			if err := deleteJob(ctx, c, job); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *HookService) job(phase reviewv1beta1.HookPhase, hook reviewv1beta1.HookSpec) (*batchv1.Job, error) {
+	hash, err := specHash(hook)
+	if err != nil {
+		return nil, err
+	}
+	backoffLimit := defaultBackoffLimit
+	if hook.BackoffLimit != nil {
+		backoffLimit = *hook.BackoffLimit
+	}
+	activeDeadlineSeconds := defaultActiveDeadlineSeconds
+	if hook.ActiveDeadlineSeconds != nil {
+		activeDeadlineSeconds = *hook.ActiveDeadlineSeconds
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      p.jobName(phase, hook.Name),
+			Namespace: p.Spec.Repository.Group,
+			Annotations: map[string]string{
+				specHashAnnotation: hash,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &activeDeadlineSeconds,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    hook.Name,
+							Image:   hook.Image,
+							Command: hook.Command,
+							Args:    hook.Args,
+							Env:     hook.Env,
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// 名前-フェーズ-フック名でJobの名前を作る
+// Podのラベルに使われるため63文字を超える場合は末尾をハッシュに置き換える
+func (p *HookService) jobName(phase reviewv1beta1.HookPhase, hook string) string {
+	name := fmt.Sprintf("%s-%s-%s", p.name, strings.ToLower(string(phase)), hook)
+	if len(name) <= maxNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := hex.EncodeToString(sum[:])[:10]
+	return strings.TrimRight(name[:maxNameLength-len(suffix)-1], "-") + "-" + suffix
+}
+
+func specHash(hook reviewv1beta1.HookSpec) (string, error) {
+	data, err := json.Marshal(hook)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+func jobCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for i, condition := range job.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == corev1.ConditionTrue {
+			return &job.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// Podも合わせて削除する
+func deleteJob(ctx context.Context, c client.Client, job *batchv1.Job) error {
+	return c.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+}
@@ -0,0 +1,110 @@
+package hook
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func setCondition(t *testing.T, c client.Client, name string, conditionType batchv1.JobConditionType) {
+	job := &batchv1.Job{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: name, Namespace: "demo1"}, job); err != nil {
+		t.Fatal(err)
+	}
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{Type: conditionType, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"})
+	if err := c.Status().Update(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Group: "demo1"},
+		Hooks: reviewv1beta1.HooksSpec{
+			PreSync: []reviewv1beta1.HookSpec{
+				{Name: "migrate", Image: "migrate:latest", Command: []string{"migrate", "up"}},
+				{Name: "seed", Image: "seed:latest"},
+			},
+		},
+	}}
+	svc := NewHookService(mr, "demo1-demo1pj1-feature-a")
+
+	// 1つ目のフックのみ実行される
+	done, statuses, err := svc.Run(ctx, c, reviewv1beta1.HookPhasePreSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done || len(statuses) != 1 || statuses[0].Job != "demo1-demo1pj1-feature-a-presync-migrate" || statuses[0].State != reviewv1beta1.HookStateRunning {
+		t.Fatalf("unexpected result: done=%v statuses=%+v", done, statuses)
+	}
+
+	// 1つ目が成功すると2つ目が実行される
+	setCondition(t, c, "demo1-demo1pj1-feature-a-presync-migrate", batchv1.JobComplete)
+	done, statuses, err = svc.Run(ctx, c, reviewv1beta1.HookPhasePreSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done || len(statuses) != 2 || statuses[0].State != reviewv1beta1.HookStateSucceeded || statuses[1].State != reviewv1beta1.HookStateRunning {
+		t.Fatalf("unexpected result: done=%v statuses=%+v", done, statuses)
+	}
+
+	// 2つ目が失敗すると完了しない
+	setCondition(t, c, "demo1-demo1pj1-feature-a-presync-seed", batchv1.JobFailed)
+	done, statuses, err = svc.Run(ctx, c, reviewv1beta1.HookPhasePreSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done || statuses[1].State != reviewv1beta1.HookStateFailed || statuses[1].Message != "BackoffLimitExceeded" {
+		t.Fatalf("unexpected result: done=%v statuses=%+v", done, statuses)
+	}
+
+	// 定義を変更すると失敗したJobを作り直す
+	mr = mr.DeepCopy()
+	mr.Spec.Hooks.PreSync[1].Image = "seed:fixed"
+	svc = NewHookService(mr, "demo1-demo1pj1-feature-a")
+	if _, _, err = svc.Run(ctx, c, reviewv1beta1.HookPhasePreSync); err != nil {
+		t.Fatal(err)
+	}
+	if _, statuses, err = svc.Run(ctx, c, reviewv1beta1.HookPhasePreSync); err != nil {
+		t.Fatal(err)
+	}
+	if statuses[1].State != reviewv1beta1.HookStateRunning {
+		t.Fatalf("job not recreated: %+v", statuses)
+	}
+
+	if err = svc.Delete(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	jobs := &batchv1.JobList{}
+	if err = c.List(ctx, jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Items) != 0 {
+		t.Errorf("jobs not deleted: %d", len(jobs.Items))
+	}
+}
+
+func TestJobName(t *testing.T) {
+	svc := NewHookService(&reviewv1beta1.MergeRequest{}, strings.Repeat("a", 70))
+	name := svc.jobName(reviewv1beta1.HookPhasePostSync, "seed")
+	if len(name) > maxNameLength {
+		t.Errorf("job name too long: %q", name)
+	}
+	if name == svc.jobName(reviewv1beta1.HookPhasePostSync, "migrate") {
+		t.Errorf("job names conflict: %q", name)
+	}
+}
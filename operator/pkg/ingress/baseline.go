@@ -0,0 +1,106 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"google.golang.org/protobuf/proto"
+	networkingv1beta1 "istio.io/api/networking/v1beta1"
+	istioclient "istio.io/client-go/pkg/apis/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const defaultHeader = "x-review-env"
+
+// BaselineVirtualService はBaselineモードでプロジェクトのサービスへのリクエストを振り分けるVirtualService
+// ヘッダーでブランチを指定したリクエストはレビュー環境のサービスへ、それ以外はベースライン環境のサービスへルーティングする
+// 同じプロジェクトのMergeRequestで共有する
+type BaselineVirtualService struct {
+	reviewv1beta1.MergeRequest
+}
+
+func NewBaselineVirtualService(mr *reviewv1beta1.MergeRequest) *BaselineVirtualService {
+	return &BaselineVirtualService{*mr}
+}
+
+// Apply はbranchesのレビュー環境へのルーティングを持つVirtualServiceを作成・更新する
+func (p *BaselineVirtualService) Apply(ctx context.Context, c client.Client, branches []string) error {
+	logger := log.FromContext(ctx)
+	project := p.Spec.Repository.Project
+	service := p.Spec.Routing.BaselineService
+	if service == "" {
+		service = project // default
+	}
+	vs := &istioclient.VirtualService{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-baseline", project),
+			Namespace: p.Spec.Repository.Group,
+		},
+	}
+	vs.Spec.Gateways = []string{"mesh"}
+	vs.Spec.Hosts = []string{service}
+	vs.Spec.Http = p.httpRoutes(project, service, branches)
+
+	// istioのspecはprotobufの型でequality.Semanticで比較できないため、CreateOrUpdateを使わずproto.Equalで比較する
+	found := &istioclient.VirtualService{}
+	err := c.Get(ctx, client.ObjectKeyFromObject(vs), found)
+	if apierrors.IsNotFound(err) {
+		if err := c.Create(ctx, vs); err != nil {
+			logger.Error(err, "Baseline VirtualService create error", "VirtualService", vs.Name)
+			return err
+		}
+		logger.Info("Baseline VirtualService created", "VirtualService", vs.Name)
+		return nil
+	} else if err != nil {
+		logger.Error(err, "Baseline VirtualService get error", "VirtualService", vs.Name)
+		return err
+	}
+	if proto.Equal(&found.Spec, &vs.Spec) {
+		return nil
+	}
+	found.Spec.Gateways = vs.Spec.Gateways
+	found.Spec.Hosts = vs.Spec.Hosts
+	found.Spec.Http = vs.Spec.Http
+	if err := c.Update(ctx, found); err != nil {
+		logger.Error(err, "Baseline VirtualService update error", "VirtualService", vs.Name)
+		return err
+	}
+	logger.Info("Baseline VirtualService updated", "VirtualService", vs.Name)
+	return nil
+}
+
+func (p *BaselineVirtualService) httpRoutes(project string, service string, branches []string) []*networkingv1beta1.HTTPRoute {
+	header := headerName(p.Spec.Routing.Header)
+	sorted := append([]string{}, branches...)
+	sort.Strings(sorted)
+	routes := make([]*networkingv1beta1.HTTPRoute, 0, len(sorted)+1)
+	for _, branch := range sorted {
+		routes = append(routes, &networkingv1beta1.HTTPRoute{
+			Name: branch,
+			Match: []*networkingv1beta1.HTTPMatchRequest{{
+				Headers: map[string]*networkingv1beta1.StringMatch{
+					header: {MatchType: &networkingv1beta1.StringMatch_Exact{Exact: branch}},
+				},
+			}},
+			Route: route(fmt.Sprintf("%s-%s", project, branch), p.Spec.Routing.Port),
+		})
+	}
+	// ヘッダーがない、またはレビュー環境がないブランチのリクエストはベースライン環境へ
+	routes = append(routes, &networkingv1beta1.HTTPRoute{
+		Name:  "baseline",
+		Route: route(service, p.Spec.Routing.Port),
+	})
+	return routes
+}
+
+func headerName(header string) string {
+	if header == "" {
+		return defaultHeader // default
+	}
+	return header
+}
@@ -0,0 +1,86 @@
+package ingress
+
+import (
+	"context"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	istioclient "istio.io/client-go/pkg/apis/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBaselineHTTPRoutes(t *testing.T) {
+	mr := &reviewv1beta1.MergeRequest{}
+	routes := NewBaselineVirtualService(mr).httpRoutes("api", "api", []string{"feature-b", "feature-a"})
+	if len(routes) != 3 {
+		t.Fatalf("routes = %d, want 3", len(routes))
+	}
+	// ブランチの順に並べ、最後はベースライン環境
+	for i, want := range []struct {
+		name string
+		host string
+	}{
+		{"feature-a", "api-feature-a"},
+		{"feature-b", "api-feature-b"},
+		{"baseline", "api"},
+	} {
+		route := routes[i]
+		if route.Name != want.name || route.Route[0].Destination.Host != want.host {
+			t.Errorf("routes[%d] = %s -> %s, want %s -> %s", i, route.Name, route.Route[0].Destination.Host, want.name, want.host)
+		}
+	}
+	if got := routes[0].Match[0].Headers[defaultHeader].GetExact(); got != "feature-a" {
+		t.Errorf("header %s = %q, want feature-a", defaultHeader, got)
+	}
+	if routes[2].Match != nil {
+		t.Errorf("baseline route has match: %v", routes[2].Match)
+	}
+
+	mr.Spec.Routing.Header = "x-branch"
+	routes = NewBaselineVirtualService(mr).httpRoutes("api", "api", []string{"feature-a"})
+	if _, ok := routes[0].Match[0].Headers["x-branch"]; !ok {
+		t.Errorf("header was not configured: %v", routes[0].Match[0].Headers)
+	}
+}
+
+func TestBaselineApply(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := istioclient.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Group: "demo1", Project: "api"},
+		Routing:    reviewv1beta1.RoutingSpec{Mode: reviewv1beta1.RoutingModeBaseline, BaselineService: "api-svc"},
+	}}
+	svc := NewBaselineVirtualService(mr)
+
+	if err := svc.Apply(ctx, c, []string{"feature-a"}); err != nil {
+		t.Fatal(err)
+	}
+	vs := &istioclient.VirtualService{}
+	key := client.ObjectKey{Name: "api-baseline", Namespace: "demo1"}
+	if err := c.Get(ctx, key, vs); err != nil {
+		t.Fatal(err)
+	}
+	if len(vs.Spec.Hosts) != 1 || vs.Spec.Hosts[0] != "api-svc" || len(vs.Spec.Gateways) != 1 || vs.Spec.Gateways[0] != "mesh" {
+		t.Errorf("unexpected virtual service: hosts %v, gateways %v", vs.Spec.Hosts, vs.Spec.Gateways)
+	}
+	if len(vs.Spec.Http) != 2 || vs.Spec.Http[1].Route[0].Destination.Host != "api-svc" {
+		t.Errorf("unexpected routes: %v", vs.Spec.Http)
+	}
+
+	// 最後のレビュー環境を削除した後はベースライン環境へのルーティングのみ残す
+	if err := svc.Apply(ctx, c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, vs); err != nil {
+		t.Fatal(err)
+	}
+	if len(vs.Spec.Http) != 1 || vs.Spec.Http[0].Name != "baseline" {
+		t.Errorf("unexpected routes after removing the branch: %v", vs.Spec.Http)
+	}
+}
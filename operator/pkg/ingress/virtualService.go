@@ -4,7 +4,8 @@ import (
 	"context"
 	"fmt"
 
-	reviewv1alpha1 "github.com/nautible/review-env-operator/api/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"google.golang.org/protobuf/proto"
 	networkingv1beta1 "istio.io/api/networking/v1beta1"
 	istioclient "istio.io/client-go/pkg/apis/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -13,10 +14,10 @@ import (
 )
 
 type VirtualService struct {
-	reviewv1alpha1.MergeRequest
+	reviewv1beta1.MergeRequest
 }
 
-func NewVirtualService(mr *reviewv1alpha1.MergeRequest) *VirtualService {
+func NewVirtualService(mr *reviewv1beta1.MergeRequest) *VirtualService {
 	return &VirtualService{*mr}
 }
 
@@ -24,7 +25,7 @@ func (p *VirtualService) Create(ctx context.Context, client client.Client, name
 	logger := log.FromContext(ctx)
 	logger.Info("Create VirtualSerivce name : " + name)
 
-	app := p.makeApp(name, p.Spec.Name, p.Spec.Application, p.Spec.TargetRevision)
+	app := p.makeApp(name, p.Spec.Repository.Group, p.Spec.Repository.Project, p.Spec.Source.TargetRevision)
 	err := client.Create(ctx, app)
 	if err != nil {
 		logger.Error(err, "Check if the VirtualSerivce already exists, if not create a new one. Failed to create new VirtualSerivce", "VirtualSerivce", app.Name)
@@ -33,6 +34,27 @@ func (p *VirtualService) Create(ctx context.Context, client client.Client, name
 	return nil
 }
 
+// Update はコンポーネントの変更などでルーティングが変わったVirtualServiceを更新する
+// 変更がなければ何もしない
+func (p *VirtualService) Update(ctx context.Context, client client.Client, found *istioclient.VirtualService) error {
+	logger := log.FromContext(ctx)
+
+	app := p.makeApp(found.Name, p.Spec.Repository.Group, p.Spec.Repository.Project, p.Spec.Source.TargetRevision)
+	if proto.Equal(&found.Spec, &app.Spec) {
+		return nil
+	}
+	logger.Info("Update VirtualSerivce name : " + found.Name)
+	found.Spec.Gateways = app.Spec.Gateways
+	found.Spec.Hosts = app.Spec.Hosts
+	found.Spec.Http = app.Spec.Http
+	err := client.Update(ctx, found)
+	if err != nil {
+		logger.Error(err, "Check if the VirtualService update error", "VirtualService", found.Name)
+		return err
+	}
+	return nil
+}
+
 func (p *VirtualService) Delete(ctx context.Context, client client.Client, found *istioclient.VirtualService) error {
 	logger := log.FromContext(ctx)
 	logger.Info("Delete VirtualSerivce name : " + found.Name)
@@ -47,8 +69,15 @@ func (p *VirtualService) Delete(ctx context.Context, client client.Client, found
 }
 
 func (p *VirtualService) makeApp(name, groupName string, applicationName string, branch string) *istioclient.VirtualService {
-	hosts := []string{"*"}
-	gateways := []string{"application-gateway"}
+	hosts := p.Spec.Routing.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"*"} // default
+	}
+	gateway := p.Spec.Routing.Gateway
+	if gateway == "" {
+		gateway = "application-gateway" // default
+	}
+	gateways := []string{gateway}
 	app := &istioclient.VirtualService{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
@@ -57,23 +86,51 @@ func (p *VirtualService) makeApp(name, groupName string, applicationName string,
 		Spec: networkingv1beta1.VirtualService{
 			Gateways: gateways,
 			Hosts:    hosts,
-			Http:     httpRoute(groupName, applicationName, branch),
+			Http:     p.httpRoutes(groupName, applicationName, branch),
 		},
 	}
 	return app
 }
 
-func httpRoute(groupName string, applicationName string, branch string) []*networkingv1beta1.HTTPRoute {
+// コンポーネント構成の場合はパスのプレフィックスでコンポーネントに振り分ける
+// プレフィックスの指定がないコンポーネントは最後に評価する
+func (p *VirtualService) httpRoutes(groupName string, applicationName string, branch string) []*networkingv1beta1.HTTPRoute {
+	port := p.Spec.Routing.Port
+	header := ""
+	if p.Spec.Routing.Mode == reviewv1beta1.RoutingModeBaseline {
+		header = headerName(p.Spec.Routing.Header)
+	}
+	if len(p.Spec.Components) == 0 {
+		return httpRoute(groupName, applicationName, branch, port, header)
+	}
+	var prefixed, fallback []*networkingv1beta1.HTTPRoute
+	for _, c := range p.Spec.Components {
+		res := &networkingv1beta1.HTTPRoute{
+			Name:  fmt.Sprintf("%s-%s", branch, c.Project),
+			Match: match(branch, c.PathPrefix, header),
+			Route: route(fmt.Sprintf("%s-%s", c.Project, branch), port),
+		}
+		if c.PathPrefix == "" {
+			fallback = append(fallback, res)
+		} else {
+			prefixed = append(prefixed, res)
+		}
+	}
+	return append(prefixed, fallback...)
+}
+
+func httpRoute(groupName string, applicationName string, branch string, port uint32, header string) []*networkingv1beta1.HTTPRoute {
 	// spec.http
 	res := &networkingv1beta1.HTTPRoute{
 		Name:  branch,
-		Match: match(branch),
-		Route: route(fmt.Sprintf("%s-%s", applicationName, branch)),
+		Match: match(branch, "", header),
+		Route: route(fmt.Sprintf("%s-%s", applicationName, branch), port),
 	}
 	return []*networkingv1beta1.HTTPRoute{res}
 }
 
-func match(branch string) []*networkingv1beta1.HTTPMatchRequest {
+// ヘッダーの指定があればクエリパラメータに加えてヘッダーでもブランチを指定できる
+func match(branch string, prefix string, header string) []*networkingv1beta1.HTTPMatchRequest {
 	// spec.http.match
 	param := &networkingv1beta1.StringMatch{
 		MatchType: &networkingv1beta1.StringMatch_Exact{
@@ -85,16 +142,36 @@ func match(branch string) []*networkingv1beta1.HTTPMatchRequest {
 			"branch": param,
 		},
 	}
-	return []*networkingv1beta1.HTTPMatchRequest{res}
+	matches := []*networkingv1beta1.HTTPMatchRequest{res}
+	if header != "" {
+		matches = append(matches, &networkingv1beta1.HTTPMatchRequest{
+			Headers: map[string]*networkingv1beta1.StringMatch{
+				header: param,
+			},
+		})
+	}
+	if prefix != "" {
+		for _, m := range matches {
+			m.Uri = &networkingv1beta1.StringMatch{
+				MatchType: &networkingv1beta1.StringMatch_Prefix{
+					Prefix: prefix,
+				},
+			}
+		}
+	}
+	return matches
 }
 
-func route(name string) []*networkingv1beta1.HTTPRouteDestination {
+func route(name string, port uint32) []*networkingv1beta1.HTTPRouteDestination {
 	// spec.http.route
+	if port == 0 {
+		port = 8080 // default
+	}
 	res := &networkingv1beta1.HTTPRouteDestination{
 		Destination: &networkingv1beta1.Destination{
 			Host: name,
 			Port: &networkingv1beta1.PortSelector{
-				Number: 8080,
+				Number: port,
 			},
 		},
 	}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	namespace = "review"
+
+	// 集計時にMergeRequestを一覧取得する際のタイムアウト
+	collectTimeout = 10 * time.Second
+)
+
+var (
+	// TimeToReady はMergeRequestの作成からレビュー環境がReadyになるまでの時間
+	TimeToReady = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "environment_time_to_ready_seconds",
+		Help:      "Time from MergeRequest creation until the review environment becomes Ready.",
+		Buckets:   []float64{30, 60, 120, 300, 600, 900, 1800, 3600},
+	}, []string{"group", "project"})
+
+	// ReconcileErrors はReconcileの処理ごとのエラー数
+	ReconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_errors_total",
+		Help:      "Number of reconcile errors by step.",
+	}, []string{"step"})
+
+	// Deletions は削除理由(merged/closed/expired)ごとのレビュー環境の削除数
+	Deletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "environment_deletions_total",
+		Help:      "Number of deleted review environments by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	crmetrics.Registry.MustRegister(TimeToReady, ReconcileErrors, Deletions)
+}
+
+// ObserveReady はレビュー環境がReadyになるまでの時間を記録する
+func ObserveReady(mr *reviewv1beta1.MergeRequest, now time.Time) {
+	TimeToReady.WithLabelValues(mr.Spec.Repository.Group, mr.Spec.Repository.Project).
+		Observe(now.Sub(mr.CreationTimestamp.Time).Seconds())
+}
+
+// DeletionReason はMergeRequestの削除理由を返す
+// アノテーションがない場合はunknown
+func DeletionReason(mr *reviewv1beta1.MergeRequest) string {
+	if reason := mr.Annotations[reviewv1beta1.DeletionReasonAnnotation]; reason != "" {
+		return reason
+	}
+	return "unknown"
+}
+
+var (
+	environmentsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "environments"),
+		"Number of review environments by group, project and phase.",
+		[]string{"group", "project", "phase"}, nil,
+	)
+	ageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "environment_age_seconds"),
+		"Seconds since the MergeRequest of the review environment was created.",
+		[]string{"namespace", "name", "group", "project"}, nil,
+	)
+)
+
+// EnvironmentCollector はスクレイプ時にMergeRequestを一覧取得し、フェーズごとの環境数と経過時間を返す
+type EnvironmentCollector struct {
+	client.Reader
+	now func() time.Time
+}
+
+func NewEnvironmentCollector(c client.Reader) *EnvironmentCollector {
+	return &EnvironmentCollector{Reader: c, now: time.Now}
+}
+
+func (e *EnvironmentCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- environmentsDesc
+	ch <- ageDesc
+}
+
+func (e *EnvironmentCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	list := &reviewv1beta1.MergeRequestList{}
+	if err := e.List(ctx, list); err != nil {
+		log.FromContext(ctx).Error(err, "MergeRequest List Error")
+		return
+	}
+	type key struct{ group, project, phase string }
+	counts := map[key]int{}
+	now := e.now()
+	for _, mr := range list.Items {
+		phase := string(mr.Status.Phase)
+		if phase == "" {
+			phase = "Pending"
+		}
+		counts[key{mr.Spec.Repository.Group, mr.Spec.Repository.Project, phase}]++
+		ch <- prometheus.MustNewConstMetric(ageDesc, prometheus.GaugeValue, now.Sub(mr.CreationTimestamp.Time).Seconds(),
+			mr.Namespace, mr.Name, mr.Spec.Repository.Group, mr.Spec.Repository.Project)
+	}
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(environmentsDesc, prometheus.GaugeValue, float64(count), k.group, k.project, k.phase)
+	}
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var created = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestEnvironmentCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := reviewv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	builder := fake.NewClientBuilder().WithScheme(scheme)
+	for _, env := range []struct {
+		name    string
+		project string
+		phase   reviewv1beta1.MergeRequestPhase
+	}{
+		{"a", "pj1", reviewv1beta1.PhaseReady},
+		{"b", "pj1", reviewv1beta1.PhaseReady},
+		{"c", "pj2", ""},
+	} {
+		builder.WithObjects(&reviewv1beta1.MergeRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: env.name, Namespace: "operator-system", CreationTimestamp: metav1.NewTime(created)},
+			Spec:       reviewv1beta1.MergeRequestSpec{Repository: reviewv1beta1.RepositorySpec{Group: "demo1", Project: env.project}},
+			Status:     reviewv1beta1.MergeRequestStatus{Phase: env.phase},
+		})
+	}
+	c := builder.Build()
+	collector := NewEnvironmentCollector(c)
+	collector.now = func() time.Time { return created.Add(time.Hour) }
+
+	expected := `
+# HELP review_environments Number of review environments by group, project and phase.
+# TYPE review_environments gauge
+review_environments{group="demo1",phase="Pending",project="pj2"} 1
+review_environments{group="demo1",phase="Ready",project="pj1"} 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "review_environments"); err != nil {
+		t.Error(err)
+	}
+	expected = `
+# HELP review_environment_age_seconds Seconds since the MergeRequest of the review environment was created.
+# TYPE review_environment_age_seconds gauge
+review_environment_age_seconds{group="demo1",name="a",namespace="operator-system",project="pj1"} 3600
+review_environment_age_seconds{group="demo1",name="b",namespace="operator-system",project="pj1"} 3600
+review_environment_age_seconds{group="demo1",name="c",namespace="operator-system",project="pj2"} 3600
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "review_environment_age_seconds"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeletionReason(t *testing.T) {
+	mr := &reviewv1beta1.MergeRequest{}
+	if got := DeletionReason(mr); got != "unknown" {
+		t.Errorf("DeletionReason() = %s, want unknown", got)
+	}
+	mr.Annotations = map[string]string{reviewv1beta1.DeletionReasonAnnotation: reviewv1beta1.DeletionReasonMerged}
+	if got := DeletionReason(mr); got != reviewv1beta1.DeletionReasonMerged {
+		t.Errorf("DeletionReason() = %s, want merged", got)
+	}
+}
@@ -3,24 +3,27 @@ package namespace
 import (
 	"context"
 
-	reviewv1alpha1 "github.com/nautible/review-env-operator/api/v1alpha1"
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+const resourceQuotaName = "review-environment-quota"
+
 type NameSpaceService struct {
-	reviewv1alpha1.MergeRequest
+	reviewv1beta1.MergeRequest
 }
 
-func NewNameSpaceService(mr *reviewv1alpha1.MergeRequest) *NameSpaceService {
+func NewNameSpaceService(mr *reviewv1beta1.MergeRequest) *NameSpaceService {
 	return &NameSpaceService{*mr}
 }
 
 func (p *NameSpaceService) CreateNamespace(ctx context.Context, r client.Client) error {
-	name := p.Spec.Name
+	name := p.Spec.Repository.Group
 	logger := log.FromContext(ctx)
 	logger.Info("Create Namespace name : " + name)
 	ns := &corev1.Namespace{
@@ -44,3 +47,25 @@ func (p *NameSpaceService) CreateNamespace(ctx context.Context, r client.Client)
 	logger.Info("Fetch the Namespace instance. found namespace")
 	return nil
 }
+
+// ReviewEnvironmentPolicyのquotaに従いNamespaceにResourceQuotaを作成・更新する
+func (p *NameSpaceService) ApplyResourceQuota(ctx context.Context, r client.Client, hard corev1.ResourceList) error {
+	name := p.Spec.Repository.Group
+	logger := log.FromContext(ctx)
+	quota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      resourceQuotaName,
+			Namespace: name,
+		},
+	}
+	result, err := controllerutil.CreateOrUpdate(ctx, r, quota, func() error {
+		quota.Spec.Hard = hard
+		return nil
+	})
+	if err != nil {
+		logger.Error(err, "ResourceQuota create or update error", "Namespace", name)
+		return err
+	}
+	logger.Info("ResourceQuota "+string(result), "Namespace", name)
+	return nil
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"context"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	defaultPodLabel         = "app.kubernetes.io/instance"
+	defaultGatewayNamespace = "istio-system"
+	namespaceNameLabel      = "kubernetes.io/metadata.name"
+)
+
+type NetworkPolicyService struct {
+	reviewv1beta1.MergeRequest
+}
+
+func NewNetworkPolicyService(mr *reviewv1beta1.MergeRequest) *NetworkPolicyService {
+	return &NetworkPolicyService{*mr}
+}
+
+// Enabled はNetworkPolicyを作成するか判定する
+func (p *NetworkPolicyService) Enabled() bool {
+	return p.Spec.NetworkPolicy.Enabled != nil && *p.Spec.NetworkPolicy.Enabled
+}
+
+// Apply はレビュー環境のPodへの通信を制限するNetworkPolicyを作成・更新する
+// appsはレビュー環境のApplication、peersはレビュー環境のPodとの通信を許可するApplication(ベースライン環境)の名前
+func (p *NetworkPolicyService) Apply(ctx context.Context, c client.Client, name string, apps []string, peers []string) error {
+	logger := log.FromContext(ctx)
+	np := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: p.Spec.Repository.Group,
+		},
+	}
+	desired := p.networkPolicySpec(apps, peers)
+	result, err := controllerutil.CreateOrUpdate(ctx, c, np, func() error {
+		np.Spec = desired
+		return nil
+	})
+	if err != nil {
+		logger.Error(err, "NetworkPolicy create or update error", "NetworkPolicy", name)
+		return err
+	}
+	logger.Info("NetworkPolicy "+string(result), "NetworkPolicy", name)
+	return nil
+}
+
+// Delete はレビュー環境のNetworkPolicyを削除する
+func (p *NetworkPolicyService) Delete(ctx context.Context, c client.Client, name string) error {
+	np := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: p.Spec.Repository.Group,
+		},
+	}
+	if err := c.Delete(ctx, np); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *NetworkPolicyService) networkPolicySpec(apps []string, peers []string) networkingv1.NetworkPolicySpec {
+	spec := p.Spec.NetworkPolicy
+	podLabel := spec.PodLabel
+	if podLabel == "" {
+		podLabel = defaultPodLabel // default
+	}
+	gatewayNamespace := spec.GatewayNamespace
+	if gatewayNamespace == "" {
+		gatewayNamespace = defaultGatewayNamespace // default
+	}
+	gatewayLabels := spec.GatewayLabels
+	if len(gatewayLabels) == 0 {
+		gatewayLabels = map[string]string{"istio": "ingressgateway"} // default
+	}
+
+	self := podSelector(podLabel, apps)
+	ingressFrom := []networkingv1.NetworkPolicyPeer{
+		{PodSelector: self},
+		{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{namespaceNameLabel: gatewayNamespace}},
+			PodSelector:       &metav1.LabelSelector{MatchLabels: gatewayLabels},
+		},
+	}
+	if len(peers) > 0 {
+		ingressFrom = append(ingressFrom, networkingv1.NetworkPolicyPeer{PodSelector: podSelector(podLabel, peers)})
+	}
+	res := networkingv1.NetworkPolicySpec{
+		PodSelector: *self,
+		Ingress:     append([]networkingv1.NetworkPolicyIngressRule{{From: ingressFrom}}, spec.Ingress...),
+		PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+	}
+	if len(spec.Egress) == 0 {
+		return res
+	}
+
+	// 同じレビュー環境のPodとDNSへの通信は常に許可する
+	// Baselineモードでは変更したサービスが依存するベースライン環境のPodへの通信も許可する
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dns := intstr.FromInt(53)
+	egressTo := []networkingv1.NetworkPolicyPeer{{PodSelector: self}}
+	if len(peers) > 0 {
+		egressTo = append(egressTo, networkingv1.NetworkPolicyPeer{PodSelector: podSelector(podLabel, peers)})
+	}
+	res.Egress = append([]networkingv1.NetworkPolicyEgressRule{
+		{To: egressTo},
+		{Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}}},
+	}, spec.Egress...)
+	res.PolicyTypes = append(res.PolicyTypes, networkingv1.PolicyTypeEgress)
+	return res
+}
+
+func podSelector(label string, values []string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: label, Operator: metav1.LabelSelectorOpIn, Values: values},
+		},
+	}
+}
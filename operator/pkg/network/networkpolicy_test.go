@@ -0,0 +1,90 @@
+package network
+
+import (
+	"context"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestApply(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+	name := "demo1-demo1pj1-feature-a"
+
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Group: "demo1"},
+	}}
+	svc := NewNetworkPolicyService(mr)
+	if err := svc.Apply(ctx, c, name, []string{name}, []string{"demo1-baseline"}); err != nil {
+		t.Fatal(err)
+	}
+	np := &networkingv1.NetworkPolicy{}
+	if err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: "demo1"}, np); err != nil {
+		t.Fatal(err)
+	}
+	selector := np.Spec.PodSelector.MatchExpressions[0]
+	if selector.Key != defaultPodLabel || len(selector.Values) != 1 || selector.Values[0] != name {
+		t.Errorf("unexpected pod selector: %+v", np.Spec.PodSelector)
+	}
+	if len(np.Spec.Ingress) != 1 || len(np.Spec.Ingress[0].From) != 3 {
+		t.Errorf("unexpected ingress: %+v", np.Spec.Ingress)
+	}
+	if gateway := np.Spec.Ingress[0].From[1]; gateway.NamespaceSelector.MatchLabels[namespaceNameLabel] != "istio-system" {
+		t.Errorf("unexpected gateway peer: %+v", gateway)
+	}
+	if len(np.Spec.PolicyTypes) != 1 || np.Spec.Egress != nil {
+		t.Errorf("egress restricted without rules: %+v", np.Spec)
+	}
+
+	// egressの指定があればDNSと同じレビュー環境のPodに加えて許可する
+	mr.Spec.NetworkPolicy.Egress = []networkingv1.NetworkPolicyEgressRule{
+		{To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"}}}},
+	}
+	svc = NewNetworkPolicyService(mr)
+	if err := svc.Apply(ctx, c, name, []string{name}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: "demo1"}, np); err != nil {
+		t.Fatal(err)
+	}
+	if len(np.Spec.PolicyTypes) != 2 || len(np.Spec.Egress) != 3 || len(np.Spec.Ingress[0].From) != 2 {
+		t.Errorf("unexpected network policy: %+v", np.Spec)
+	}
+
+	if to := np.Spec.Egress[0].To; len(to) != 1 {
+		t.Errorf("egress to baseline allowed outside Baseline mode: %+v", to)
+	}
+
+	// Baselineモードでは変更したサービスからベースライン環境のPodへの通信を許可する
+	if err := svc.Apply(ctx, c, name, []string{name}, []string{"demo1-baseline"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: "demo1"}, np); err != nil {
+		t.Fatal(err)
+	}
+	to := np.Spec.Egress[0].To
+	if len(to) != 2 || to[1].PodSelector.MatchExpressions[0].Values[0] != "demo1-baseline" {
+		t.Errorf("egress to baseline not allowed: %+v", to)
+	}
+	if len(np.Spec.Egress) != 3 || len(np.Spec.Ingress[0].From) != 3 {
+		t.Errorf("unexpected network policy in Baseline mode: %+v", np.Spec)
+	}
+
+	if err := svc.Delete(ctx, c, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: "demo1"}, np); !apierrors.IsNotFound(err) {
+		t.Errorf("network policy not deleted: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"github.com/nautible/review-env-operator/pkg/preview"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// 更新するノートを見分けるためにノートの先頭に付ける
+	noteMarker = "<!-- review-env-operator -->"
+	// コミットステータスの名前
+	statusName = "review-environment"
+	// トークンを保持するSecretのキー
+	tokenKey = "token"
+
+	requestTimeout = 10 * time.Second
+)
+
+// Notifier はレビュー環境の状態をマージリクエストに通知する
+type Notifier interface {
+	// Notify はフェーズをマージリクエストのノートとコミットステータスに反映し、更新したノートのIDを返す
+	Notify(ctx context.Context, mr *reviewv1beta1.MergeRequest, phase reviewv1beta1.MergeRequestPhase) (int64, error)
+}
+
+// GitLabNotifier はGitLab APIでマージリクエストに通知する
+// トークンは通知のたびにSecretから読み込むため、Secretを更新すれば再起動せずに切り替わる
+type GitLabNotifier struct {
+	client.Reader
+	secret     types.NamespacedName
+	httpClient *http.Client
+}
+
+func NewGitLabNotifier(c client.Reader, secret types.NamespacedName) *GitLabNotifier {
+	return &GitLabNotifier{Reader: c, secret: secret, httpClient: &http.Client{Timeout: requestTimeout}}
+}
+
+// Enabled は通知できるマージリクエストか判定する
+// マージリクエストのIIDが分からない、プロジェクトを特定できない(コンポーネント構成の)、またはGitLab以外の場合は通知しない
+func Enabled(mr *reviewv1beta1.MergeRequest) bool {
+	if mr.Spec.Origin.Provider != "" && mr.Spec.Origin.Provider != "gitlab" {
+		return false
+	}
+	return mr.Spec.Origin.IID > 0 && mr.Spec.Repository.Host != "" && mr.Spec.Repository.Project != ""
+}
+
+func (n *GitLabNotifier) Notify(ctx context.Context, mr *reviewv1beta1.MergeRequest, phase reviewv1beta1.MergeRequestPhase) (int64, error) {
+	token, err := n.token(ctx)
+	if err != nil {
+		return 0, err
+	}
+	api := &gitlabAPI{
+		baseURL:    strings.TrimSuffix(mr.Spec.Repository.Host, "/") + "/api/v4",
+		project:    url.PathEscape(projectPath(mr)),
+		token:      token,
+		httpClient: n.httpClient,
+	}
+	noteID, err := api.upsertNote(ctx, mr, noteBody(mr, phase))
+	if err != nil {
+		return 0, err
+	}
+	if sha := mr.Spec.Origin.CommitSHA; sha != "" {
+		if err := api.setCommitStatus(ctx, sha, mr, phase); err != nil {
+			return noteID, err
+		}
+	}
+	return noteID, nil
+}
+
+// SmokeTestResult は通知するスモークテストの結果を返す
+// 実行中または未実行の場合は空文字を返す
+func SmokeTestResult(mr *reviewv1beta1.MergeRequest) reviewv1beta1.SmokeTestResult {
+	if s := mr.Status.SmokeTest; s != nil && (s.Result == reviewv1beta1.SmokeTestPassed || s.Result == reviewv1beta1.SmokeTestFailed) {
+		return s.Result
+	}
+	return ""
+}
+
+// マージリクエストのプロジェクトのパスを返す
+// フォークからのマージリクエストはレビュー環境のグループ、プロジェクトと異なるためoriginの値を利用する
+func projectPath(mr *reviewv1beta1.MergeRequest) string {
+	if mr.Spec.Origin.TargetProject != "" {
+		return mr.Spec.Origin.TargetProject
+	}
+	return mr.Spec.Repository.Group + "/" + mr.Spec.Repository.Project
+}
+
+func (n *GitLabNotifier) token(ctx context.Context) (string, error) {
+	secret := &corev1.Secret{}
+	if err := n.Get(ctx, n.secret, secret); err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(secret.Data[tokenKey]))
+	if token == "" {
+		return "", fmt.Errorf("secret %s has no %s", n.secret, tokenKey)
+	}
+	return token, nil
+}
+
+type gitlabAPI struct {
+	baseURL    string
+	project    string
+	token      string
+	httpClient *http.Client
+}
+
+type note struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// upsertNote はレビュー環境のノートを1つだけ作成し、以降は同じノートを更新する
+func (a *gitlabAPI) upsertNote(ctx context.Context, mr *reviewv1beta1.MergeRequest, body string) (int64, error) {
+	notesPath := fmt.Sprintf("/projects/%s/merge_requests/%d/notes", a.project, mr.Spec.Origin.IID)
+	noteID := int64(0)
+	if mr.Status.Notification != nil {
+		noteID = mr.Status.Notification.NoteID
+	}
+	if noteID == 0 {
+		// statusにノートがない場合(MergeRequestを作り直した場合など)は作成済みのノートを探す
+		var notes []note
+		if err := a.do(ctx, http.MethodGet, notesPath+"?sort=desc&per_page=100", nil, &notes); err != nil {
+			return 0, err
+		}
+		for _, n := range notes {
+			if strings.HasPrefix(n.Body, noteMarker) {
+				noteID = n.ID
+				break
+			}
+		}
+	}
+	payload := map[string]string{"body": body}
+	result := note{}
+	if noteID > 0 {
+		err := a.do(ctx, http.MethodPut, fmt.Sprintf("%s/%d", notesPath, noteID), payload, &result)
+		if err == nil {
+			return result.ID, nil
+		}
+		// ノートが削除されていれば作り直す
+		if apiErr, ok := err.(*apiError); !ok || apiErr.status != http.StatusNotFound {
+			return 0, err
+		}
+	}
+	if err := a.do(ctx, http.MethodPost, notesPath, payload, &result); err != nil {
+		return 0, err
+	}
+	return result.ID, nil
+}
+
+// setCommitStatus はコミットステータスにレビュー環境のURLを設定する
+func (a *gitlabAPI) setCommitStatus(ctx context.Context, sha string, mr *reviewv1beta1.MergeRequest, phase reviewv1beta1.MergeRequestPhase) error {
+	payload := map[string]string{
+		"state":       commitState(phase),
+		"name":        statusName,
+		"ref":         mr.Spec.Source.TargetRevision,
+		"description": "Review environment is " + string(phase),
+	}
+	// 環境がReadyでもスモークテストが失敗したコミットは失敗とする
+	if phase == reviewv1beta1.PhaseReady && SmokeTestResult(mr) == reviewv1beta1.SmokeTestFailed {
+		payload["state"] = "failed"
+		payload["description"] = "Smoke test failed"
+	}
+	if u := preview.URL(mr); u != "" && phase != reviewv1beta1.PhaseDeleting {
+		payload["target_url"] = u
+	}
+	return a.do(ctx, http.MethodPost, fmt.Sprintf("/projects/%s/statuses/%s", a.project, url.PathEscape(sha)), payload, nil)
+}
+
+type apiError struct {
+	method string
+	path   string
+	status int
+	body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("GitLab API %s %s returned %d: %s", e.method, e.path, e.status, e.body)
+}
+
+func (a *gitlabAPI) do(ctx context.Context, method string, path string, payload interface{}, result interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", a.token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return &apiError{method: method, path: path, status: res.StatusCode, body: strings.TrimSpace(string(b))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func commitState(phase reviewv1beta1.MergeRequestPhase) string {
+	switch phase {
+	case reviewv1beta1.PhaseReady:
+		return "success"
+	case reviewv1beta1.PhaseFailed:
+		return "failed"
+	case reviewv1beta1.PhaseDeleting:
+		return "canceled"
+	}
+	return "running"
+}
+
+func noteBody(mr *reviewv1beta1.MergeRequest, phase reviewv1beta1.MergeRequestPhase) string {
+	var b strings.Builder
+	b.WriteString(noteMarker + "\n")
+	switch phase {
+	case reviewv1beta1.PhaseReady:
+		b.WriteString("### :white_check_mark: Review environment is ready\n\n")
+	case reviewv1beta1.PhaseFailed:
+		b.WriteString("### :x: Review environment failed\n\n")
+	case reviewv1beta1.PhaseDeleting:
+		b.WriteString("### :wastebasket: Review environment was deleted\n\n")
+	default:
+		b.WriteString("### :hourglass: Review environment is " + string(phase) + "\n\n")
+	}
+	b.WriteString("| | |\n| --- | --- |\n")
+	if u := preview.URL(mr); u != "" && phase != reviewv1beta1.PhaseDeleting {
+		fmt.Fprintf(&b, "| URL | %s |\n", u)
+	}
+	fmt.Fprintf(&b, "| Branch | `%s` |\n", mr.Spec.Source.TargetRevision)
+	if sha := mr.Spec.Origin.CommitSHA; sha != "" {
+		fmt.Fprintf(&b, "| Commit | %s |\n", sha)
+	}
+	switch SmokeTestResult(mr) {
+	case reviewv1beta1.SmokeTestPassed:
+		b.WriteString("| Smoke test | :white_check_mark: passed |\n")
+	case reviewv1beta1.SmokeTestFailed:
+		b.WriteString("| Smoke test | :x: failed |\n")
+		if message := mr.Status.SmokeTest.Message; message != "" {
+			fmt.Fprintf(&b, "\n**Smoke test:** %s\n", message)
+		}
+	}
+	if phase == reviewv1beta1.PhaseFailed {
+		if reason := failureReason(mr); reason != "" {
+			fmt.Fprintf(&b, "\n**Reason:** %s\n", reason)
+		}
+	}
+	return b.String()
+}
+
+// 失敗したフックの内容を返す
+func failureReason(mr *reviewv1beta1.MergeRequest) string {
+	for _, h := range mr.Status.Hooks {
+		if h.State == reviewv1beta1.HookStateFailed {
+			return fmt.Sprintf("%s hook %s failed: %s", h.Phase, h.Name, h.Message)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,247 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// GitLab APIのノートとコミットステータスを記録する
+type fakeGitLab struct {
+	mu       sync.Mutex
+	notes    map[int64]string
+	nextID   int64
+	statuses []map[string]string
+	tokens   []string
+}
+
+func newFakeGitLab() *fakeGitLab {
+	return &fakeGitLab{notes: map[int64]string{}, nextID: 100}
+}
+
+func (g *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.tokens = append(g.tokens, r.Header.Get("PRIVATE-TOKEN"))
+	notesPath := "/api/v4/projects/demo1%2Fdemo1pj1/merge_requests/7/notes"
+	payload := map[string]string{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&payload)
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.EscapedPath() == notesPath:
+		notes := []note{}
+		for id, body := range g.notes {
+			notes = append(notes, note{ID: id, Body: body})
+		}
+		json.NewEncoder(w).Encode(notes)
+	case r.Method == http.MethodPost && r.URL.EscapedPath() == notesPath:
+		g.nextID++
+		g.notes[g.nextID] = payload["body"]
+		json.NewEncoder(w).Encode(note{ID: g.nextID, Body: payload["body"]})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.EscapedPath(), notesPath+"/"):
+		var id int64
+		json.Unmarshal([]byte(strings.TrimPrefix(r.URL.EscapedPath(), notesPath+"/")), &id)
+		if _, ok := g.notes[id]; !ok {
+			http.Error(w, `{"message":"404 Not found"}`, http.StatusNotFound)
+			return
+		}
+		g.notes[id] = payload["body"]
+		json.NewEncoder(w).Encode(note{ID: id, Body: payload["body"]})
+	case r.Method == http.MethodPost && r.URL.EscapedPath() == "/api/v4/projects/demo1%2Fdemo1pj1/statuses/abc123":
+		g.statuses = append(g.statuses, payload)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	default:
+		http.Error(w, `{"message":"404 Not found"}`, http.StatusNotFound)
+	}
+}
+
+func newNotifier(t *testing.T, token string) *GitLabNotifier {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "gitlab-token", Namespace: "operator-system"},
+		Data:       map[string][]byte{"token": []byte(token)},
+	}).Build()
+	return NewGitLabNotifier(c, types.NamespacedName{Name: "gitlab-token", Namespace: "operator-system"})
+}
+
+func TestNotify(t *testing.T) {
+	gitlab := newFakeGitLab()
+	server := httptest.NewServer(gitlab)
+	defer server.Close()
+	n := newNotifier(t, "glpat-test")
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Host: server.URL, Group: "demo1", Project: "demo1pj1"},
+		Source:     reviewv1beta1.SourceSpec{TargetRevision: "feature/a"},
+		Routing:    reviewv1beta1.RoutingSpec{Hosts: []string{"demo1.example.com"}},
+		Origin:     reviewv1beta1.OriginSpec{IID: 7, CommitSHA: "abc123"},
+	}}
+
+	// 最初の通知はノートを作成する
+	noteID, err := n.Notify(context.Background(), mr, reviewv1beta1.PhaseReady)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gitlab.notes) != 1 {
+		t.Fatalf("notes = %d, want 1", len(gitlab.notes))
+	}
+	body := gitlab.notes[noteID]
+	if !strings.HasPrefix(body, noteMarker) || !strings.Contains(body, "http://demo1.example.com/?branch=feature%2Fa") {
+		t.Errorf("note body = %q, want marker and preview URL", body)
+	}
+	status := gitlab.statuses[0]
+	if status["state"] != "success" || status["target_url"] != "http://demo1.example.com/?branch=feature%2Fa" || status["name"] != statusName {
+		t.Errorf("commit status = %v", status)
+	}
+
+	// 以降の通知は同じノートを更新する
+	mr.Status.Notification = &reviewv1beta1.NotificationStatus{Phase: reviewv1beta1.PhaseReady, NoteID: noteID}
+	mr.Status.Hooks = []reviewv1beta1.HookStatus{{Name: "migrate", Phase: reviewv1beta1.HookPhasePostSync, State: reviewv1beta1.HookStateFailed, Message: "BackoffLimitExceeded"}}
+	updated, err := n.Notify(context.Background(), mr, reviewv1beta1.PhaseFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != noteID || len(gitlab.notes) != 1 {
+		t.Errorf("note = %d (%d notes), want %d updated", updated, len(gitlab.notes), noteID)
+	}
+	if !strings.Contains(gitlab.notes[noteID], "migrate failed: BackoffLimitExceeded") {
+		t.Errorf("note body = %q, want failure reason", gitlab.notes[noteID])
+	}
+	if gitlab.statuses[1]["state"] != "failed" {
+		t.Errorf("commit status = %v, want failed", gitlab.statuses[1])
+	}
+
+	// statusにノートがない場合も作成済みのノートを更新する
+	mr.Status.Notification = nil
+	if found, err := n.Notify(context.Background(), mr, reviewv1beta1.PhaseDeleting); err != nil || found != noteID {
+		t.Errorf("Notify() = %d, %v, want %d", found, err, noteID)
+	}
+	if gitlab.statuses[2]["state"] != "canceled" || gitlab.statuses[2]["target_url"] != "" {
+		t.Errorf("commit status = %v, want canceled without URL", gitlab.statuses[2])
+	}
+
+	// 削除されたノートは作り直す
+	mr.Status.Notification = &reviewv1beta1.NotificationStatus{NoteID: noteID}
+	delete(gitlab.notes, noteID)
+	if recreated, err := n.Notify(context.Background(), mr, reviewv1beta1.PhaseReady); err != nil || recreated == noteID {
+		t.Errorf("Notify() = %d, %v, want a new note", recreated, err)
+	}
+
+	for _, token := range gitlab.tokens {
+		if token != "glpat-test" {
+			t.Errorf("PRIVATE-TOKEN = %q, want glpat-test", token)
+		}
+	}
+}
+
+func TestNotifyError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Host: server.URL, Group: "demo1", Project: "demo1pj1"},
+		Origin:     reviewv1beta1.OriginSpec{IID: 7},
+	}}
+	_, err := newNotifier(t, "invalid").Notify(context.Background(), mr, reviewv1beta1.PhaseReady)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Notify() error = %v, want 401", err)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		origin reviewv1beta1.OriginSpec
+		want   bool
+	}{
+		{"gitlab", reviewv1beta1.OriginSpec{IID: 7}, true},
+		{"without IID", reviewv1beta1.OriginSpec{}, false},
+		{"gitea", reviewv1beta1.OriginSpec{IID: 7, Provider: "gitea"}, false},
+	} {
+		mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+			Repository: reviewv1beta1.RepositorySpec{Host: "http://gitlab", Project: "demo1pj1"},
+			Origin:     tc.origin,
+		}}
+		if got := Enabled(mr); got != tc.want {
+			t.Errorf("Enabled() for %s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNotifyFork(t *testing.T) {
+	gitlab := newFakeGitLab()
+	server := httptest.NewServer(gitlab)
+	defer server.Close()
+	// フォークのレビュー環境はフォーク用のグループに作成されるが、通知はターゲットのプロジェクトに行う
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Host: server.URL, Group: "review-forks", Project: "alice-demo1pj1"},
+		Origin:     reviewv1beta1.OriginSpec{IID: 7, CommitSHA: "abc123", SourceProject: "alice/demo1pj1", TargetProject: "demo1/demo1pj1"},
+	}}
+	if _, err := newNotifier(t, "glpat-test").Notify(context.Background(), mr, reviewv1beta1.PhaseReady); err != nil {
+		t.Fatal(err)
+	}
+	if len(gitlab.notes) != 1 || len(gitlab.statuses) != 1 {
+		t.Errorf("notes = %d, statuses = %d, want 1 each", len(gitlab.notes), len(gitlab.statuses))
+	}
+}
+
+func TestNotifySmokeTest(t *testing.T) {
+	gitlab := newFakeGitLab()
+	server := httptest.NewServer(gitlab)
+	defer server.Close()
+	n := newNotifier(t, "glpat-test")
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Host: server.URL, Group: "demo1", Project: "demo1pj1"},
+		Origin:     reviewv1beta1.OriginSpec{IID: 7, CommitSHA: "abc123"},
+	}}
+
+	// 実行中のスモークテストは通知しない
+	mr.Status.SmokeTest = &reviewv1beta1.SmokeTestStatus{Result: reviewv1beta1.SmokeTestRunning}
+	noteID, err := n.Notify(context.Background(), mr, reviewv1beta1.PhaseReady)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := gitlab.notes[noteID]; strings.Contains(body, "Smoke test") {
+		t.Errorf("note body = %q, want no smoke test", body)
+	}
+
+	mr.Status.Notification = &reviewv1beta1.NotificationStatus{Phase: reviewv1beta1.PhaseReady, NoteID: noteID}
+	mr.Status.SmokeTest = &reviewv1beta1.SmokeTestStatus{Result: reviewv1beta1.SmokeTestPassed}
+	if _, err := n.Notify(context.Background(), mr, reviewv1beta1.PhaseReady); err != nil {
+		t.Fatal(err)
+	}
+	if body := gitlab.notes[noteID]; !strings.Contains(body, "| Smoke test | :white_check_mark: passed |") {
+		t.Errorf("note body = %q, want smoke test passed", body)
+	}
+	if gitlab.statuses[1]["state"] != "success" {
+		t.Errorf("commit status = %v, want success", gitlab.statuses[1])
+	}
+
+	// 失敗したスモークテストはメッセージを載せ、コミットステータスを失敗にする
+	mr.Status.SmokeTest = &reviewv1beta1.SmokeTestStatus{Result: reviewv1beta1.SmokeTestFailed, Message: "GET /healthz returned 503"}
+	if _, err := n.Notify(context.Background(), mr, reviewv1beta1.PhaseReady); err != nil {
+		t.Fatal(err)
+	}
+	if body := gitlab.notes[noteID]; !strings.Contains(body, "| Smoke test | :x: failed |") || !strings.Contains(body, "GET /healthz returned 503") {
+		t.Errorf("note body = %q, want smoke test failure", body)
+	}
+	if status := gitlab.statuses[2]; status["state"] != "failed" || status["description"] != "Smoke test failed" {
+		t.Errorf("commit status = %v, want failed by smoke test", status)
+	}
+}
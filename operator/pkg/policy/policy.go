@@ -0,0 +1,218 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Find はMergeRequestを選択するReviewEnvironmentPolicyのうち優先度が最も高いものを返す
+// 選択するポリシーがなければnilを返す
+func Find(ctx context.Context, c client.Client, mr *reviewv1beta1.MergeRequest) (*reviewv1beta1.ReviewEnvironmentPolicy, error) {
+	list := &reviewv1beta1.ReviewEnvironmentPolicyList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+	var matched []reviewv1beta1.ReviewEnvironmentPolicy
+	for _, p := range list.Items {
+		ok, err := Selects(&p, mr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, p)
+		}
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+	// 優先度が同じ場合は名前順
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Spec.Priority != matched[j].Spec.Priority {
+			return matched[i].Spec.Priority > matched[j].Spec.Priority
+		}
+		return matched[i].Name < matched[j].Name
+	})
+	return &matched[0], nil
+}
+
+// Selects はポリシーのselectorがMergeRequestを選択するか判定する
+func Selects(p *reviewv1beta1.ReviewEnvironmentPolicy, mr *reviewv1beta1.MergeRequest) (bool, error) {
+	selector, err := metav1.LabelSelectorAsSelector(&p.Spec.Selector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(Labels(mr)), nil
+}
+
+// Labels はポリシーの選択に利用するラベルを返す
+// MergeRequestのラベルにグループ、プロジェクトのラベルを加えたもの
+func Labels(mr *reviewv1beta1.MergeRequest) labels.Set {
+	set := labels.Set{}
+	for k, v := range mr.Labels {
+		set[k] = v
+	}
+	set[reviewv1beta1.GroupLabel] = mr.Spec.Repository.Group
+	set[reviewv1beta1.ProjectLabel] = mr.Spec.Repository.Project
+	return set
+}
+
+// Apply はMergeRequestで指定されていない項目をポリシーのデフォルト値で補い、上限を適用する
+func Apply(mr *reviewv1beta1.MergeRequest, p *reviewv1beta1.ReviewEnvironmentPolicy) error {
+	if p == nil {
+		return nil
+	}
+	spec := &mr.Spec
+
+	// Argo CD
+	if spec.ArgoCD.Project == "" {
+		spec.ArgoCD.Project = p.Spec.ArgoCD.Project
+	}
+	if p.Spec.ArgoCD.SyncPolicy != nil {
+		if spec.ArgoCD.SyncPolicy == nil {
+			spec.ArgoCD.SyncPolicy = &reviewv1beta1.SyncPolicySpec{}
+		}
+		sp := spec.ArgoCD.SyncPolicy
+		if sp.SelfHeal == nil {
+			sp.SelfHeal = p.Spec.ArgoCD.SyncPolicy.SelfHeal
+		}
+		if sp.Prune == nil {
+			sp.Prune = p.Spec.ArgoCD.SyncPolicy.Prune
+		}
+		if sp.AllowEmpty == nil {
+			sp.AllowEmpty = p.Spec.ArgoCD.SyncPolicy.AllowEmpty
+		}
+		if len(sp.SyncOptions) == 0 {
+			sp.SyncOptions = p.Spec.ArgoCD.SyncPolicy.SyncOptions
+		}
+		if sp.Retry == nil {
+			sp.Retry = p.Spec.ArgoCD.SyncPolicy.Retry
+		}
+	}
+
+	// Routing
+	if spec.Routing.Gateway == "" {
+		spec.Routing.Gateway = p.Spec.Routing.Gateway
+	}
+	if spec.Routing.Port == 0 {
+		spec.Routing.Port = p.Spec.Routing.Port
+	}
+	if spec.Routing.Mode == "" {
+		spec.Routing.Mode = p.Spec.Routing.Mode
+	}
+	if spec.Routing.Header == "" {
+		spec.Routing.Header = p.Spec.Routing.Header
+	}
+	if spec.Routing.Baseline == (reviewv1beta1.BaselineSpec{}) {
+		spec.Routing.Baseline = p.Spec.Routing.Baseline
+	}
+	if len(spec.Routing.Hosts) == 0 && p.Spec.Routing.HostTemplate != "" {
+		host, err := renderHost(p.Spec.Routing.HostTemplate, mr)
+		if err != nil {
+			return err
+		}
+		spec.Routing.Hosts = []string{host}
+	}
+
+	// Copies
+	// 種類とコピー先の名前が同じものはMergeRequestの指定を優先する
+	for _, c := range p.Spec.Copies {
+		if !hasCopy(spec.Copies, c) {
+			spec.Copies = append(spec.Copies, c)
+		}
+	}
+
+	// NetworkPolicy
+	np, defaults := &spec.NetworkPolicy, p.Spec.NetworkPolicy
+	if np.Enabled == nil {
+		np.Enabled = defaults.Enabled
+	}
+	if np.PodLabel == "" {
+		np.PodLabel = defaults.PodLabel
+	}
+	if np.GatewayNamespace == "" {
+		np.GatewayNamespace = defaults.GatewayNamespace
+	}
+	if len(np.GatewayLabels) == 0 {
+		np.GatewayLabels = defaults.GatewayLabels
+	}
+	if len(np.Ingress) == 0 {
+		np.Ingress = defaults.Ingress
+	}
+	if len(np.Egress) == 0 {
+		np.Egress = defaults.Egress
+	}
+
+	// Lifecycle
+	if spec.Lifecycle.TTL == nil {
+		spec.Lifecycle.TTL = p.Spec.Lifecycle.TTL
+	}
+	if max := p.Spec.Lifecycle.MaxTTL; max != nil {
+		if spec.Lifecycle.TTL == nil || spec.Lifecycle.TTL.Duration > max.Duration {
+			spec.Lifecycle.TTL = max
+		}
+	}
+	return nil
+}
+
+// ExtendTTL はアノテーションで延長された分をTTLに加える
+// ポリシーのMaxTTLを超える場合はMaxTTLまで、TTLがない(クローズまで保持する)場合は何もしない
+func ExtendTTL(mr *reviewv1beta1.MergeRequest, p *reviewv1beta1.ReviewEnvironmentPolicy) error {
+	value, ok := mr.Annotations[reviewv1beta1.TTLExtensionAnnotation]
+	if !ok || mr.Spec.Lifecycle.TTL == nil {
+		return nil
+	}
+	extension, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("annotation %s is invalid: %w", reviewv1beta1.TTLExtensionAnnotation, err)
+	}
+	ttl := mr.Spec.Lifecycle.TTL.Duration + extension
+	if p != nil && p.Spec.Lifecycle.MaxTTL != nil && ttl > p.Spec.Lifecycle.MaxTTL.Duration {
+		ttl = p.Spec.Lifecycle.MaxTTL.Duration
+	}
+	mr.Spec.Lifecycle.TTL = &metav1.Duration{Duration: ttl}
+	return nil
+}
+
+func hasCopy(copies []reviewv1beta1.CopySpec, c reviewv1beta1.CopySpec) bool {
+	for _, item := range copies {
+		if item.Kind == c.Kind && copyTarget(item) == copyTarget(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyTarget(c reviewv1beta1.CopySpec) string {
+	if c.TargetName != "" {
+		return c.TargetName
+	}
+	return c.Name
+}
+
+func renderHost(text string, mr *reviewv1beta1.MergeRequest) (string, error) {
+	tmpl, err := template.New("host").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	data := map[string]string{
+		"Group":   mr.Spec.Repository.Group,
+		"Project": mr.Spec.Repository.Project,
+		"Branch":  strings.Replace(mr.Spec.Source.TargetRevision, "/", "-", -1),
+		"Name":    mr.Name,
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newPolicy(name string, priority int32, group string) *reviewv1beta1.ReviewEnvironmentPolicy {
+	p := &reviewv1beta1.ReviewEnvironmentPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       reviewv1beta1.ReviewEnvironmentPolicySpec{Priority: priority},
+	}
+	if group != "" {
+		p.Spec.Selector.MatchLabels = map[string]string{reviewv1beta1.GroupLabel: group}
+	}
+	return p
+}
+
+func TestFind(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := reviewv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		newPolicy("cluster-default", 0, ""),
+		newPolicy("demo1", 10, "demo1"),
+		newPolicy("demo2", 20, "demo2"),
+	).Build()
+
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Group: "demo1"},
+	}}
+	p, err := Find(context.Background(), c, mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Name != "demo1" {
+		t.Errorf("expected policy demo1, got %v", p)
+	}
+}
+
+func TestApply(t *testing.T) {
+	yes, no := true, false
+	p := newPolicy("demo1", 0, "demo1")
+	p.Spec.ArgoCD = reviewv1beta1.ArgoCDSpec{
+		Project:    "demo1",
+		SyncPolicy: &reviewv1beta1.SyncPolicySpec{SelfHeal: &no, Prune: &no},
+	}
+	p.Spec.Routing = reviewv1beta1.RoutingPolicy{
+		Gateway:      "review-gateway",
+		HostTemplate: "{{ .Branch }}.{{ .Project }}.review.example.com",
+		Baseline:     reviewv1beta1.BaselineSpec{Project: "environments"},
+	}
+	p.Spec.Lifecycle = reviewv1beta1.LifecyclePolicy{
+		TTL:    &metav1.Duration{Duration: 24 * time.Hour},
+		MaxTTL: &metav1.Duration{Duration: 72 * time.Hour},
+	}
+
+	p.Spec.Copies = []reviewv1beta1.CopySpec{
+		{Kind: reviewv1beta1.CopyKindSecret, Namespace: "review-templates", Name: "registry"},
+		{Kind: reviewv1beta1.CopyKindSecret, Namespace: "review-templates", Name: "db"},
+	}
+
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Project: "demo1pj1"},
+		Source:     reviewv1beta1.SourceSpec{TargetRevision: "feature/a"},
+		ArgoCD:     reviewv1beta1.ArgoCDSpec{SyncPolicy: &reviewv1beta1.SyncPolicySpec{Prune: &yes}},
+		Lifecycle:  reviewv1beta1.LifecycleSpec{TTL: &metav1.Duration{Duration: 240 * time.Hour}},
+		Copies: []reviewv1beta1.CopySpec{
+			{Kind: reviewv1beta1.CopyKindSecret, Namespace: "demo1-templates", Name: "db"},
+		},
+	}}
+	if err := Apply(mr, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if mr.Spec.ArgoCD.Project != "demo1" {
+		t.Errorf("project: got %q", mr.Spec.ArgoCD.Project)
+	}
+	if *mr.Spec.ArgoCD.SyncPolicy.SelfHeal != false || *mr.Spec.ArgoCD.SyncPolicy.Prune != true {
+		t.Errorf("sync policy not merged: %+v", mr.Spec.ArgoCD.SyncPolicy)
+	}
+	if mr.Spec.Routing.Gateway != "review-gateway" {
+		t.Errorf("gateway: got %q", mr.Spec.Routing.Gateway)
+	}
+	if len(mr.Spec.Routing.Hosts) != 1 || mr.Spec.Routing.Hosts[0] != "feature-a.demo1pj1.review.example.com" {
+		t.Errorf("hosts: got %v", mr.Spec.Routing.Hosts)
+	}
+	if mr.Spec.Routing.Baseline.Project != "environments" {
+		t.Errorf("baseline: got %+v", mr.Spec.Routing.Baseline)
+	}
+	if len(mr.Spec.Copies) != 2 || mr.Spec.Copies[0].Namespace != "demo1-templates" || mr.Spec.Copies[1].Name != "registry" {
+		t.Errorf("copies not merged: %+v", mr.Spec.Copies)
+	}
+	if mr.Spec.Lifecycle.TTL.Duration != 72*time.Hour {
+		t.Errorf("ttl not capped by maxTTL: got %v", mr.Spec.Lifecycle.TTL.Duration)
+	}
+}
+
+func TestExtendTTL(t *testing.T) {
+	p := newPolicy("default", 0, "")
+	p.Spec.Lifecycle = reviewv1beta1.LifecyclePolicy{
+		TTL:    &metav1.Duration{Duration: 24 * time.Hour},
+		MaxTTL: &metav1.Duration{Duration: 96 * time.Hour},
+	}
+	for value, want := range map[string]time.Duration{
+		"":     24 * time.Hour,
+		"48h":  72 * time.Hour,
+		"240h": 96 * time.Hour,
+	} {
+		mr := &reviewv1beta1.MergeRequest{}
+		if value != "" {
+			mr.Annotations = map[string]string{reviewv1beta1.TTLExtensionAnnotation: value}
+		}
+		if err := Apply(mr, p); err != nil {
+			t.Fatal(err)
+		}
+		if err := ExtendTTL(mr, p); err != nil {
+			t.Fatal(err)
+		}
+		if mr.Spec.Lifecycle.TTL.Duration != want {
+			t.Errorf("ttl with extension %q: got %v, want %v", value, mr.Spec.Lifecycle.TTL.Duration, want)
+		}
+	}
+
+	// TTLがなければ延長しない
+	mr := &reviewv1beta1.MergeRequest{}
+	mr.Annotations = map[string]string{reviewv1beta1.TTLExtensionAnnotation: "48h"}
+	if err := ExtendTTL(mr, nil); err != nil || mr.Spec.Lifecycle.TTL != nil {
+		t.Errorf("ttl without lifecycle: got %v, %v", mr.Spec.Lifecycle.TTL, err)
+	}
+	mr.Spec.Lifecycle.TTL = &metav1.Duration{Duration: time.Hour}
+	mr.Annotations[reviewv1beta1.TTLExtensionAnnotation] = "3d"
+	if err := ExtendTTL(mr, nil); err == nil {
+		t.Error("invalid extension was accepted")
+	}
+}
@@ -0,0 +1,71 @@
+package preview
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"text/template"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+)
+
+// Data はレビュー環境ごとの値をテンプレートに渡す
+type Data struct {
+	Group    string
+	Project  string
+	Branch   string
+	Revision string
+	Name     string
+	URL      string
+
+	IID       int64
+	CommitSHA string
+	Author    string
+	ImageTag  string
+}
+
+// NewData はMergeRequestからテンプレートに渡す値を作る
+// Branchは"/"を"-"に置き換えたブランチ名、Revisionはブランチ名そのもの
+func NewData(mr *reviewv1beta1.MergeRequest) Data {
+	return Data{
+		Group:    mr.Spec.Repository.Group,
+		Project:  mr.Spec.Repository.Project,
+		Branch:   strings.Replace(mr.Spec.Source.TargetRevision, "/", "-", -1),
+		Revision: mr.Spec.Source.TargetRevision,
+		Name:     mr.Name,
+		URL:      URL(mr),
+
+		IID:       mr.Spec.Origin.IID,
+		CommitSHA: mr.Spec.Origin.CommitSHA,
+		Author:    mr.Spec.Origin.Author,
+		ImageTag:  mr.Spec.Origin.ImageTag,
+	}
+}
+
+// URL はレビュー環境の公開URLを返す
+// ワイルドカードでないrouting.hostsの先頭のホストに、VirtualServiceがブランチの振り分けに使うクエリパラメータを付ける
+// ホストが決まらない場合は空文字を返す
+func URL(mr *reviewv1beta1.MergeRequest) string {
+	for _, host := range mr.Spec.Routing.Hosts {
+		if strings.HasPrefix(host, "*") {
+			continue
+		}
+		u := url.URL{Scheme: "http", Host: host, Path: "/"}
+		u.RawQuery = url.Values{"branch": []string{mr.Spec.Source.TargetRevision}}.Encode()
+		return u.String()
+	}
+	return ""
+}
+
+// Render はGoテンプレートにレビュー環境ごとの値を埋め込む
+func Render(text string, data Data) (string, error) {
+	tmpl, err := template.New("preview").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,52 @@
+package preview
+
+import (
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+)
+
+func TestVariables(t *testing.T) {
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Source:  reviewv1beta1.SourceSpec{TargetRevision: "feature/a"},
+		Routing: reviewv1beta1.RoutingSpec{Hosts: []string{"*", "demo1.review.example.com"}},
+		Origin:  reviewv1beta1.OriginSpec{IID: 12, CommitSHA: "0123abcd", Author: "alice", ImageTag: "0123abcd"},
+		Variables: reviewv1beta1.VariablesSpec{Values: map[string]string{
+			"OAUTH_CALLBACK_URL": "{{ .URL }}&path=/callback",
+			"BANNER":             "!{{ .IID }} {{ .Branch }} by {{ .Author }}",
+			"IMAGE":              "registry.example.com/demo1pj1:{{ .ImageTag }}",
+		}},
+	}}
+	vars, err := Variables(mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"REVIEW_URL":         "http://demo1.review.example.com/?branch=feature%2Fa",
+		"REVIEW_BRANCH":      "feature/a",
+		"REVIEW_MR_IID":      "12",
+		"REVIEW_COMMIT_SHA":  "0123abcd",
+		"REVIEW_AUTHOR":      "alice",
+		"REVIEW_IMAGE_TAG":   "0123abcd",
+		"OAUTH_CALLBACK_URL": "http://demo1.review.example.com/?branch=feature%2Fa&path=/callback",
+		"BANNER":             "!12 feature-a by alice",
+		"IMAGE":              "registry.example.com/demo1pj1:0123abcd",
+	}
+	if len(vars) != len(expected) {
+		t.Errorf("unexpected variables: %v", vars)
+	}
+	for k, v := range expected {
+		if vars[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, vars[k])
+		}
+	}
+}
+
+func TestVariablesInvalidTemplate(t *testing.T) {
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Variables: reviewv1beta1.VariablesSpec{Values: map[string]string{"X": "{{ .Unknown }}"}},
+	}}
+	if _, err := Variables(mr); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
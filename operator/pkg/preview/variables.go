@@ -0,0 +1,93 @@
+package preview
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Variables はレビュー環境ごとの変数を返す
+// 既定の変数にvariables.valuesをテンプレートとして展開した値を加える
+func Variables(mr *reviewv1beta1.MergeRequest) (map[string]string, error) {
+	data := NewData(mr)
+	vars := map[string]string{
+		"REVIEW_URL":        data.URL,
+		"REVIEW_BRANCH":     data.Revision,
+		"REVIEW_MR_IID":     "",
+		"REVIEW_COMMIT_SHA": data.CommitSHA,
+		"REVIEW_AUTHOR":     data.Author,
+		"REVIEW_IMAGE_TAG":  data.ImageTag,
+	}
+	if data.IID != 0 {
+		vars["REVIEW_MR_IID"] = strconv.FormatInt(data.IID, 10)
+	}
+	for k, v := range mr.Spec.Variables.Values {
+		rendered, err := Render(v, data)
+		if err != nil {
+			return nil, fmt.Errorf("variables.values %q: %w", k, err)
+		}
+		vars[k] = rendered
+	}
+	return vars, nil
+}
+
+type VariablesService struct {
+	reviewv1beta1.MergeRequest
+	name string
+}
+
+// NewVariablesService はnameを元にした名前のConfigMapに変数を保持するVariablesServiceを作成する
+func NewVariablesService(mr *reviewv1beta1.MergeRequest, name string) *VariablesService {
+	return &VariablesService{*mr, name}
+}
+
+// ConfigMapName は変数を保持するConfigMapの名前を返す
+func (p *VariablesService) ConfigMapName() string {
+	if p.Spec.Variables.ConfigMapName != "" {
+		return p.Spec.Variables.ConfigMapName
+	}
+	return p.name + "-env"
+}
+
+// Apply は変数を保持するConfigMapを作成・更新する
+func (p *VariablesService) Apply(ctx context.Context, c client.Client, vars map[string]string) error {
+	logger := log.FromContext(ctx)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      p.ConfigMapName(),
+			Namespace: p.Spec.Repository.Group,
+		},
+	}
+	result, err := controllerutil.CreateOrUpdate(ctx, c, cm, func() error {
+		cm.Data = vars
+		return nil
+	})
+	if err != nil {
+		logger.Error(err, "variables ConfigMap create or update error", "ConfigMap", cm.Name)
+		return err
+	}
+	logger.Info("variables ConfigMap "+string(result), "ConfigMap", cm.Name)
+	return nil
+}
+
+// Delete は変数を保持するConfigMapを削除する
+func (p *VariablesService) Delete(ctx context.Context, c client.Client) error {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      p.ConfigMapName(),
+			Namespace: p.Spec.Repository.Group,
+		},
+	}
+	if err := c.Delete(ctx, cm); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"sort"
+	"strconv"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"github.com/nautible/review-env-operator/pkg/policy"
+)
+
+// Position はMergeRequestが構築可能であれば0を、待つ必要があれば1からの待ち順を返す
+// candidatesはポリシーのconcurrencyScopeで同じ単位に含まれる削除中でないMergeRequest
+// 構築済み(Queued以外のフェーズ)のMergeRequestは枠を保持し、待っているMergeRequestは優先度、作成日時、名前の順に空いた枠を割り当てる
+func Position(mr *reviewv1beta1.MergeRequest, candidates []reviewv1beta1.MergeRequest, limit int) int {
+	if Active(mr) {
+		return 0
+	}
+	active := 0
+	var waiting []reviewv1beta1.MergeRequest
+	for _, item := range candidates {
+		if item.Name == mr.Name && item.Namespace == mr.Namespace {
+			continue
+		}
+		if Active(&item) {
+			active++
+		} else {
+			waiting = append(waiting, item)
+		}
+	}
+	waiting = append(waiting, *mr)
+	sort.SliceStable(waiting, func(i, j int) bool {
+		pi, pj := Priority(&waiting[i]), Priority(&waiting[j])
+		if pi != pj {
+			return pi > pj
+		}
+		if !waiting[i].CreationTimestamp.Equal(&waiting[j].CreationTimestamp) {
+			return waiting[i].CreationTimestamp.Before(&waiting[j].CreationTimestamp)
+		}
+		return waiting[i].Name < waiting[j].Name
+	})
+	free := limit - active
+	if free < 0 {
+		free = 0
+	}
+	for i, item := range waiting {
+		if item.Name == mr.Name && item.Namespace == mr.Namespace {
+			if i < free {
+				return 0
+			}
+			return i - free + 1
+		}
+	}
+	return 0
+}
+
+// Active はMergeRequestが構築済みで枠を保持しているか判定する
+func Active(mr *reviewv1beta1.MergeRequest) bool {
+	switch mr.Status.Phase {
+	case reviewv1beta1.PhaseProvisioning, reviewv1beta1.PhaseReady, reviewv1beta1.PhaseFailed:
+		return true
+	}
+	return false
+}
+
+// Priority はアノテーションで指定された優先度を返す
+// 指定がない、または整数でない場合は0
+func Priority(mr *reviewv1beta1.MergeRequest) int {
+	value, ok := mr.Annotations[reviewv1beta1.PriorityAnnotation]
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// SameScope はitemがポリシーに選択され、concurrencyScopeでmrと同じ単位に含まれるか判定する
+func SameScope(p *reviewv1beta1.ReviewEnvironmentPolicy, mr *reviewv1beta1.MergeRequest, item *reviewv1beta1.MergeRequest) (bool, error) {
+	selected, err := policy.Selects(p, item)
+	if err != nil || !selected {
+		return false, err
+	}
+	switch p.Spec.ConcurrencyScope {
+	case reviewv1beta1.ConcurrencyScopeGroup:
+		return item.Spec.Repository.Group == mr.Spec.Repository.Group, nil
+	case reviewv1beta1.ConcurrencyScopeProject:
+		return item.Spec.Repository.Group == mr.Spec.Repository.Group && item.Spec.Repository.Project == mr.Spec.Repository.Project, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var base = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestPosition(t *testing.T) {
+	created := func(minutes int) metav1.Time {
+		return metav1.NewTime(base.Add(time.Duration(minutes) * time.Minute))
+	}
+	ready := reviewv1beta1.MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "ready", CreationTimestamp: created(0)},
+		Status:     reviewv1beta1.MergeRequestStatus{Phase: reviewv1beta1.PhaseReady},
+	}
+	first := reviewv1beta1.MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "first", CreationTimestamp: created(1)},
+	}
+	second := reviewv1beta1.MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "second", CreationTimestamp: created(2)},
+		Status:     reviewv1beta1.MergeRequestStatus{Phase: reviewv1beta1.PhaseQueued},
+	}
+	urgent := reviewv1beta1.MergeRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "urgent",
+			CreationTimestamp: created(3),
+			Annotations:       map[string]string{reviewv1beta1.PriorityAnnotation: "10"},
+		},
+		Status: reviewv1beta1.MergeRequestStatus{Phase: reviewv1beta1.PhaseQueued},
+	}
+	candidates := []reviewv1beta1.MergeRequest{ready, first, second, urgent}
+
+	tests := []struct {
+		name  string
+		mr    reviewv1beta1.MergeRequest
+		limit int
+		want  int
+	}{
+		{name: "active keeps its slot", mr: ready, limit: 1, want: 0},
+		{name: "priority comes first", mr: urgent, limit: 2, want: 0},
+		{name: "older waits behind priority", mr: first, limit: 2, want: 1},
+		{name: "newest waits last", mr: second, limit: 2, want: 2},
+		{name: "free slots", mr: second, limit: 4, want: 0},
+		{name: "over limit", mr: urgent, limit: 0, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Position(&tt.mr, candidates, tt.limit); got != tt.want {
+				t.Errorf("Position() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPriority(t *testing.T) {
+	for annotation, want := range map[string]int{"": 0, "invalid": 0, "-5": -5} {
+		mr := &reviewv1beta1.MergeRequest{}
+		if annotation != "" {
+			mr.Annotations = map[string]string{reviewv1beta1.PriorityAnnotation: annotation}
+		}
+		if got := Priority(mr); got != want {
+			t.Errorf("Priority(%q) = %d, want %d", annotation, got, want)
+		}
+	}
+}
+
+func TestSameScope(t *testing.T) {
+	mergeRequest := func(name string, group string, project string) reviewv1beta1.MergeRequest {
+		return reviewv1beta1.MergeRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       reviewv1beta1.MergeRequestSpec{Repository: reviewv1beta1.RepositorySpec{Group: group, Project: project}},
+		}
+	}
+	mr := mergeRequest("a", "demo1", "pj1")
+	sameGroup := mergeRequest("b", "demo1", "pj2")
+	otherGroup := mergeRequest("c", "demo2", "pj1")
+
+	p := &reviewv1beta1.ReviewEnvironmentPolicy{}
+	tests := []struct {
+		scope reviewv1beta1.ConcurrencyScope
+		item  reviewv1beta1.MergeRequest
+		want  bool
+	}{
+		{scope: reviewv1beta1.ConcurrencyScopePolicy, item: otherGroup, want: true},
+		{scope: reviewv1beta1.ConcurrencyScopeGroup, item: sameGroup, want: true},
+		{scope: reviewv1beta1.ConcurrencyScopeGroup, item: otherGroup, want: false},
+		{scope: reviewv1beta1.ConcurrencyScopeProject, item: sameGroup, want: false},
+		{scope: reviewv1beta1.ConcurrencyScopeProject, item: mr, want: true},
+	}
+	for _, tt := range tests {
+		p.Spec.ConcurrencyScope = tt.scope
+		got, err := SameScope(p, &mr, &tt.item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("SameScope(%s, %s) = %v, want %v", tt.scope, tt.item.Name, got, tt.want)
+		}
+	}
+
+	p.Spec.Selector.MatchLabels = map[string]string{reviewv1beta1.GroupLabel: "demo2"}
+	p.Spec.ConcurrencyScope = reviewv1beta1.ConcurrencyScopePolicy
+	if got, _ := SameScope(p, &mr, &sameGroup); got {
+		t.Errorf("SameScope() for unselected MergeRequest = true, want false")
+	}
+}
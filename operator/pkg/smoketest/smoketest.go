@@ -0,0 +1,202 @@
+package smoketest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	"github.com/nautible/review-env-operator/pkg/hook"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// statusに保持するJobのログの行数
+	logTailLines int64 = 20
+	// レスポンスの本文を読み込む上限
+	maxBodySize = 1 << 20
+	// VirtualServiceの反映を待つためプローブは失敗しても数回試行する
+	probeAttempts = 3
+	// プローブを再試行する間隔
+	probeInterval = 2 * time.Second
+)
+
+type SmokeTestService struct {
+	reviewv1beta1.MergeRequest
+	name       string
+	httpClient *http.Client
+}
+
+// NewSmokeTestService はnameを接頭辞とするJobでスモークテストを実行するSmokeTestServiceを作成する
+func NewSmokeTestService(mr *reviewv1beta1.MergeRequest, name string) *SmokeTestService {
+	return &SmokeTestService{
+		MergeRequest: *mr,
+		name:         name,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Enabled はスモークテストが定義されているか判定する
+func (p *SmokeTestService) Enabled() bool {
+	return len(p.Spec.SmokeTest.Probes) > 0 || p.Spec.SmokeTest.Job != nil
+}
+
+// URL はレビュー環境のURLを返す
+// smokeTest.urlの指定がなければワイルドカードでないrouting.hostsの先頭から作る
+func (p *SmokeTestService) URL() string {
+	if p.Spec.SmokeTest.URL != "" {
+		return strings.TrimRight(p.Spec.SmokeTest.URL, "/")
+	}
+	for _, host := range p.Spec.Routing.Hosts {
+		if !strings.HasPrefix(host, "*") {
+			return "http://" + host
+		}
+	}
+	return ""
+}
+
+// Run はプローブとJobを順に実行し、スモークテストの結果を返す
+// Jobの実行中とプローブの再試行を待つ間は結果がRunningになる
+// プローブの再試行を待つ場合は次に実行するまでの間隔を返す
+// lastは同じリビジョンの前回の結果で、プローブの試行回数を引き継ぐ
+func (p *SmokeTestService) Run(ctx context.Context, c client.Client, clientset kubernetes.Interface, revision string, last *reviewv1beta1.SmokeTestStatus) (reviewv1beta1.SmokeTestStatus, time.Duration, error) {
+	logger := log.FromContext(ctx)
+	status := reviewv1beta1.SmokeTestStatus{
+		Revision: revision,
+		Result:   reviewv1beta1.SmokeTestRunning,
+		URL:      p.URL(),
+	}
+	if last != nil && last.Revision == revision && last.Result == reviewv1beta1.SmokeTestRunning {
+		status.ProbeAttempts = last.ProbeAttempts
+	}
+
+	if len(p.Spec.SmokeTest.Probes) > 0 {
+		if status.URL == "" {
+			return p.complete(status, reviewv1beta1.SmokeTestFailed, "smokeTest.url is required when routing.hosts has no host"), 0, nil
+		}
+		for _, probe := range p.Spec.SmokeTest.Probes {
+			message := p.probe(ctx, status.URL, probe)
+			if message == "" {
+				continue
+			}
+			// Reconcileを止めないよう待機せず、再度キューに入れて試行する
+			status.ProbeAttempts++
+			logger.Info("Smoke test probe failed : "+message, "attempts", status.ProbeAttempts)
+			if status.ProbeAttempts < probeAttempts {
+				status.Message = message
+				return status, probeInterval, nil
+			}
+			return p.complete(status, reviewv1beta1.SmokeTestFailed, message), 0, nil
+		}
+	}
+
+	if p.Spec.SmokeTest.Job != nil {
+		// リビジョンが変わるとJobの定義のハッシュが変わり、Jobが作り直される
+		job := *p.Spec.SmokeTest.Job.DeepCopy()
+		job.Env = append(job.Env,
+			corev1.EnvVar{Name: "REVIEW_URL", Value: status.URL},
+			corev1.EnvVar{Name: "REVIEW_BRANCH", Value: p.Spec.Source.TargetRevision},
+			corev1.EnvVar{Name: "REVIEW_REVISION", Value: revision},
+		)
+		hookStatus, err := hook.NewHookService(&p.MergeRequest, p.name).RunJob(ctx, c, reviewv1beta1.HookPhaseSmokeTest, job)
+		if err != nil {
+			return status, 0, err
+		}
+		if hookStatus.State == reviewv1beta1.HookStateRunning {
+			return status, 0, nil
+		}
+		status.LogTail = p.logTail(ctx, clientset, hookStatus.Job)
+		if hookStatus.State == reviewv1beta1.HookStateFailed {
+			return p.complete(status, reviewv1beta1.SmokeTestFailed, fmt.Sprintf("job %s failed: %s", hookStatus.Job, hookStatus.Message)), 0, nil
+		}
+	}
+	return p.complete(status, reviewv1beta1.SmokeTestPassed, ""), 0, nil
+}
+
+func (p *SmokeTestService) complete(status reviewv1beta1.SmokeTestStatus, result reviewv1beta1.SmokeTestResult, message string) reviewv1beta1.SmokeTestStatus {
+	now := metav1.Now()
+	status.Result = result
+	status.Message = message
+	status.CompletionTime = &now
+	return status
+}
+
+// プローブが失敗した場合は理由を返す
+func (p *SmokeTestService) probe(ctx context.Context, base string, probe reviewv1beta1.ProbeSpec) string {
+	target, err := url.Parse(base + probe.Path)
+	if err != nil {
+		return fmt.Sprintf("GET %s: %v", probe.Path, err)
+	}
+	query := target.Query()
+	query.Set("branch", p.Spec.Source.TargetRevision)
+	target.RawQuery = query.Encode()
+
+	expected := int(probe.Status)
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	return p.get(ctx, target.String(), expected, probe.Contains)
+}
+
+func (p *SmokeTestService) get(ctx context.Context, target string, expected int, contains string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return fmt.Sprintf("GET %s: %v", target, err)
+	}
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return fmt.Sprintf("GET %s: %v", target, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != expected {
+		return fmt.Sprintf("GET %s: expected status %d, got %d", target, expected, res.StatusCode)
+	}
+	if contains == "" {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxBodySize))
+	if err != nil {
+		return fmt.Sprintf("GET %s: %v", target, err)
+	}
+	if !strings.Contains(string(body), contains) {
+		return fmt.Sprintf("GET %s: response does not contain %q", target, contains)
+	}
+	return ""
+}
+
+// Jobの最新のPodのログの末尾を返す
+// ログを取得できない場合はスモークテストの結果に影響させず空文字を返す
+func (p *SmokeTestService) logTail(ctx context.Context, clientset kubernetes.Interface, job string) string {
+	logger := log.FromContext(ctx)
+	if clientset == nil {
+		return ""
+	}
+	namespace := p.Spec.Repository.Group
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + job})
+	if err != nil {
+		logger.Error(err, "smoke test Pod list error", "Job", job)
+		return ""
+	}
+	if len(pods.Items) == 0 {
+		return ""
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[j].CreationTimestamp.Before(&pods.Items[i].CreationTimestamp)
+	})
+	tailLines := logTailLines
+	data, err := clientset.CoreV1().Pods(namespace).GetLogs(pods.Items[0].Name, &corev1.PodLogOptions{TailLines: &tailLines}).DoRaw(ctx)
+	if err != nil {
+		logger.Error(err, "smoke test Pod log error", "Pod", pods.Items[0].Name)
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,160 @@
+package smoketest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	reviewv1beta1 "github.com/nautible/review-env-operator/api/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("branch") != "feature/a" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Path {
+		case "/healthz":
+			fmt.Fprint(w, "ok")
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestRunProbes(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		probes []reviewv1beta1.ProbeSpec
+		result reviewv1beta1.SmokeTestResult
+	}{
+		{"passed", []reviewv1beta1.ProbeSpec{{Path: "/healthz", Contains: "ok"}}, reviewv1beta1.SmokeTestPassed},
+		{"unexpected status", []reviewv1beta1.ProbeSpec{{Path: "/api"}}, reviewv1beta1.SmokeTestFailed},
+		{"expected status", []reviewv1beta1.ProbeSpec{{Path: "/api", Status: 500}}, reviewv1beta1.SmokeTestPassed},
+		{"unexpected body", []reviewv1beta1.ProbeSpec{{Path: "/healthz", Contains: "ready"}}, reviewv1beta1.SmokeTestFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+				Source:    reviewv1beta1.SourceSpec{TargetRevision: "feature/a"},
+				SmokeTest: reviewv1beta1.SmokeTestSpec{URL: server.URL, Probes: tt.probes},
+			}}
+			svc := NewSmokeTestService(mr, "demo1-demo1pj1-feature-a")
+			// 失敗したプローブは前回の結果を引き継いで再試行する
+			var last *reviewv1beta1.SmokeTestStatus
+			for i := 0; i < probeAttempts; i++ {
+				status, retryAfter, err := svc.Run(context.Background(), nil, nil, "abc123", last)
+				if err != nil {
+					t.Fatal(err)
+				}
+				last = &status
+				if status.Result != reviewv1beta1.SmokeTestRunning {
+					break
+				}
+				if retryAfter != probeInterval || status.CompletionTime != nil {
+					t.Fatalf("attempt %d: retryAfter = %v, status = %+v", i+1, retryAfter, status)
+				}
+			}
+			if last.Result != tt.result || last.Revision != "abc123" {
+				t.Errorf("unexpected status: %+v", last)
+			}
+			if last.CompletionTime == nil {
+				t.Error("completionTime not set")
+			}
+			if tt.result == reviewv1beta1.SmokeTestFailed && last.ProbeAttempts != probeAttempts {
+				t.Errorf("probeAttempts = %d, want %d", last.ProbeAttempts, probeAttempts)
+			}
+		})
+	}
+
+	// リビジョンが変わった場合は試行回数を数え直す
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Source:    reviewv1beta1.SourceSpec{TargetRevision: "feature/a"},
+		SmokeTest: reviewv1beta1.SmokeTestSpec{URL: server.URL, Probes: []reviewv1beta1.ProbeSpec{{Path: "/api"}}},
+	}}
+	last := &reviewv1beta1.SmokeTestStatus{Revision: "old", Result: reviewv1beta1.SmokeTestRunning, ProbeAttempts: probeAttempts - 1}
+	status, _, err := NewSmokeTestService(mr, "demo1-demo1pj1-feature-a").Run(context.Background(), nil, nil, "abc123", last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Result != reviewv1beta1.SmokeTestRunning || status.ProbeAttempts != 1 {
+		t.Errorf("unexpected status for new revision: %+v", status)
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Repository: reviewv1beta1.RepositorySpec{Group: "demo1"},
+		Source:     reviewv1beta1.SourceSpec{TargetRevision: "feature/a"},
+		SmokeTest: reviewv1beta1.SmokeTestSpec{
+			URL: "http://demo1.review.example.com",
+			Job: &reviewv1beta1.HookSpec{Name: "e2e", Image: "e2e:latest"},
+		},
+	}}
+	svc := NewSmokeTestService(mr, "demo1-demo1pj1-feature-a")
+	jobName := "demo1-demo1pj1-feature-a-smoketest-e2e"
+	clientset := k8sfake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: jobName + "-x1", Namespace: "demo1", Labels: map[string]string{"job-name": jobName}},
+	})
+
+	status, retryAfter, err := svc.Run(ctx, c, clientset, "abc123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Result != reviewv1beta1.SmokeTestRunning || retryAfter != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	job := &batchv1.Job{}
+	if err = c.Get(ctx, client.ObjectKey{Name: jobName, Namespace: "demo1"}, job); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if env["REVIEW_URL"] != "http://demo1.review.example.com" || env["REVIEW_BRANCH"] != "feature/a" {
+		t.Errorf("unexpected env: %v", env)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+	if err = c.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	status, _, err = svc.Run(ctx, c, clientset, "abc123", &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Result != reviewv1beta1.SmokeTestFailed || status.LogTail != "fake logs" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestURL(t *testing.T) {
+	mr := &reviewv1beta1.MergeRequest{Spec: reviewv1beta1.MergeRequestSpec{
+		Routing: reviewv1beta1.RoutingSpec{Hosts: []string{"*.review.example.com", "demo1.review.example.com"}},
+	}}
+	if got := NewSmokeTestService(mr, "").URL(); got != "http://demo1.review.example.com" {
+		t.Errorf("unexpected url: %q", got)
+	}
+}
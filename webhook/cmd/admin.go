@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const adminPath = "/admin/dead-letters"
+
+// デッドレターの一覧に返すイベント
+// ボディは機密項目を伏せて返す
+type deadLetterView struct {
+	ID            string          `json:"id"`
+	CorrelationID string          `json:"correlationId"`
+	ReceivedAt    time.Time       `json:"receivedAt"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError"`
+	Body          json.RawMessage `json:"body"`
+}
+
+// デッドレターの管理エンドポイント
+//
+//	GET    /admin/dead-letters            一覧
+//	POST   /admin/dead-letters/{id}/retry キューに戻して再処理
+//	DELETE /admin/dead-letters/{id}       破棄
+//
+// 環境変数 ADMIN_TOKEN をBearerトークンとして指定する。未設定の場合は利用できない
+func adminHandler(q *Queue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, logger := withRequestLogger(r, correlationID(r))
+		if !validAdminToken(r.Header.Get("Authorization")) {
+			logger.Warnw("admin token validation error")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPath), "/")
+		switch {
+		case rest == "" && r.Method == http.MethodGet:
+			events, err := q.DeadLetters()
+			if err != nil {
+				logger.Errorw("dead letter list error", "error", err)
+				http.Error(w, "InternalServerError", http.StatusInternalServerError)
+				return
+			}
+			views := make([]deadLetterView, 0, len(events))
+			for _, ev := range events {
+				views = append(views, deadLetterView{
+					ID:            ev.ID,
+					CorrelationID: ev.CorrelationID,
+					ReceivedAt:    ev.ReceivedAt,
+					Attempts:      ev.Attempts,
+					LastError:     ev.LastError,
+					Body:          redactedJSON(ev.Body),
+				})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(views)
+		case strings.HasSuffix(rest, "/retry") && r.Method == http.MethodPost:
+			id := strings.TrimSuffix(rest, "/retry")
+			if err := q.Retry(id); err != nil {
+				adminError(w, logger, id, err)
+				return
+			}
+			logger.Infow("dead letter requeued", "eventId", id)
+			fmt.Fprintf(w, "Requeued %s\n", id)
+		case rest != "" && !strings.Contains(rest, "/") && r.Method == http.MethodDelete:
+			if err := q.Discard(rest); err != nil {
+				adminError(w, logger, rest, err)
+				return
+			}
+			logger.Infow("dead letter discarded", "eventId", rest)
+			fmt.Fprintf(w, "Discarded %s\n", rest)
+		default:
+			http.Error(w, "Not Found", http.StatusNotFound)
+		}
+	})
+}
+
+func adminError(w http.ResponseWriter, logger *zap.SugaredLogger, id string, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if validEventID(id) != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	logger.Errorw("dead letter update error", "eventId", id, "error", err)
+	http.Error(w, "InternalServerError", http.StatusInternalServerError)
+}
+
+func validAdminToken(header string) bool {
+	expect := os.Getenv("ADMIN_TOKEN")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if expect == "" || token == header {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expect)) == 1
+}
+
+func redactedJSON(body []byte) json.RawMessage {
+	redacted := redactBody(body)
+	if json.Valid([]byte(redacted)) {
+		return json.RawMessage(redacted)
+	}
+	b, _ := json.Marshal(redacted)
+	return b
+}
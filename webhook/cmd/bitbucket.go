@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type bitbucketUser struct {
+	Id   int32  `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+type bitbucketRepository struct {
+	Id      int32  `json:"id"`
+	Slug    string `json:"slug"`
+	Name    string `json:"name"`
+	Project struct {
+		Key string `json:"key"`
+	} `json:"project"`
+}
+
+type bitbucketRef struct {
+	Id           string              `json:"id"`
+	DisplayId    string              `json:"displayId"`
+	LatestCommit string              `json:"latestCommit"`
+	Repository   bitbucketRepository `json:"repository"`
+}
+
+type bitbucketPullRequest struct {
+	Id      int64        `json:"id"`
+	Title   string       `json:"title"`
+	State   string       `json:"state"`
+	FromRef bitbucketRef `json:"fromRef"`
+	ToRef   bitbucketRef `json:"toRef"`
+}
+
+// Bitbucket ServerのPull RequestのWebhook
+type bitbucketPullRequestEvent struct {
+	EventKey    string               `json:"eventKey"`
+	Actor       bitbucketUser        `json:"actor"`
+	PullRequest bitbucketPullRequest `json:"pullRequest"`
+}
+
+type bitbucketProvider struct{}
+
+func (b *bitbucketProvider) name() string { return providerBitbucket }
+
+// Bitbucket ServerはイベントをX-Event-Key、配信をX-Request-Idで送る
+func (b *bitbucketProvider) matches(r *http.Request) bool {
+	return r.Header.Get("X-Event-Key") != "" && r.Header.Get("X-Request-Id") != ""
+}
+
+// X-Hub-Signatureは"sha256="に続けて、環境変数 BITBUCKET_WEBHOOK_SECRET をキーとしたボディのHMAC-SHA256
+func (b *bitbucketProvider) verify(r *http.Request, body []byte) bool {
+	signature := r.Header.Get("X-Hub-Signature")
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	return validSignature(os.Getenv("BITBUCKET_WEBHOOK_SECRET"), body, strings.TrimPrefix(signature, "sha256="))
+}
+
+func (b *bitbucketProvider) deliveryID(r *http.Request) string {
+	return r.Header.Get("X-Request-Id")
+}
+
+func (b *bitbucketProvider) parse(r *http.Request, body []byte) (*incoming, error) {
+	var state, action string
+	switch event := r.Header.Get("X-Event-Key"); event {
+	case "pr:opened":
+		state, action = "opened", "open"
+	case "pr:merged":
+		state, action = "merged", "merge"
+	case "pr:declined":
+		state, action = "closed", "close"
+	default:
+		// 接続テスト(diagnostics:ping)やその他のイベントは処理しない
+		return ignore(event, "unknown", "No Target Event.\n"), nil
+	}
+	var pull bitbucketPullRequestEvent
+	if err := json.Unmarshal(body, &pull); err != nil {
+		return nil, err
+	}
+	// Bitbucket Serverのペイロードにはリポジトリのリンクが含まれないため、環境変数 BITBUCKET_BASE_URL を利用する
+	host := strings.TrimSuffix(os.Getenv("BITBUCKET_BASE_URL"), "/")
+	if host == "" {
+		return nil, fmt.Errorf("BITBUCKET_BASE_URL is not set")
+	}
+	return mergeRequestEvent(pull.toMergeRequest(host, state, action))
+}
+
+// toMergeRequest はPull RequestをGitLabのマージリクエストのイベントと同じ形で返す
+// グループはプロジェクトのキー(小文字)、プロジェクトはリポジトリのスラッグ
+func (e *bitbucketPullRequestEvent) toMergeRequest(host string, state string, action string) *MergeRequest {
+	pr := e.PullRequest
+	return &MergeRequest{
+		ObjectKind: "merge_request",
+		User:       User{Id: e.Actor.Id, Name: e.Actor.Name, Username: e.Actor.Slug},
+		Project:    pr.ToRef.Repository.toProject(host),
+		ObjectAttributes: ObjectAttributes{
+			Iid:             pr.Id,
+			Title:           pr.Title,
+			SourceBranch:    pr.FromRef.DisplayId,
+			TargetBranch:    pr.ToRef.DisplayId,
+			State:           state,
+			Action:          action,
+			LastCommit:      Commit{Id: pr.FromRef.LatestCommit},
+			SourceProjectId: pr.FromRef.Repository.Id,
+			TargetProjectId: pr.ToRef.Repository.Id,
+			Source:          pr.FromRef.Repository.toProject(host),
+		},
+		Provider: providerBitbucket,
+		Host:     host,
+	}
+}
+
+// 個人リポジトリのキー("~USER")はNamespaceに使えないため"~"を取り除く
+func (r *bitbucketRepository) toProject(host string) Project {
+	key := strings.ToLower(r.Project.Key)
+	group := strings.TrimPrefix(key, "~")
+	return Project{
+		Id:                r.Id,
+		Name:              r.Slug,
+		WebUrl:            fmt.Sprintf("%s/projects/%s/repos/%s", host, r.Project.Key, r.Slug),
+		Namespace:         group,
+		PathWithNamespace: group + "/" + r.Slug,
+		GitHttpUrl:        fmt.Sprintf("%s/scm/%s/%s.git", host, key, r.Slug),
+	}
+}
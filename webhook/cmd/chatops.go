@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	commandPrefix = "/review"
+	// コマンドを実行できる権限の下限(30: Developer)
+	defaultMinAccessLevel = 30
+	// オペレーターがTTLに加える延長時間を保持するアノテーション
+	ttlExtensionAnnotation = "review.nautible.com/ttl-extension"
+	// 値を変えるとオペレーターがApplicationを同期し直すアノテーション
+	redeployAnnotation = "review.nautible.com/redeploy"
+	// "/review destroy"で削除した場合の削除理由
+	deletionReasonDestroyed = "destroyed"
+)
+
+type NoteAttributes struct {
+	Id           int64  `json:"id"`
+	Note         string `json:"note"`
+	NoteableType string `json:"noteable_type"`
+}
+
+// マージリクエストへのコメントのWebhook
+type NoteEvent struct {
+	ObjectKind       string           `json:"object_kind"`
+	User             User             `json:"user"`
+	Project          Project          `json:"project"`
+	ObjectAttributes NoteAttributes   `json:"object_attributes"`
+	MergeRequest     ObjectAttributes `json:"merge_request"`
+}
+
+// toMergeRequest はコメントしたマージリクエストをマージリクエストのイベントと同じ形で返す
+func (n *NoteEvent) toMergeRequest() *MergeRequest {
+	return &MergeRequest{
+		ObjectKind:       n.ObjectKind,
+		User:             n.User,
+		Project:          n.Project,
+		ObjectAttributes: n.MergeRequest,
+	}
+}
+
+// "/review <name> [args]"のコマンド
+type command struct {
+	name      string
+	extension time.Duration
+}
+
+var errNotCommand = errors.New("not a review command")
+
+// parseCommand はコメントの1行目からコマンドを取り出す
+// "/review"で始まらないコメントはerrNotCommandを返す
+func parseCommand(note string) (*command, error) {
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(note), "\n", 2)[0])
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != commandPrefix {
+		return nil, errNotCommand
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("usage: %s deploy|destroy|extend <duration>|wake|redeploy", commandPrefix)
+	}
+	cmd := &command{name: fields[1]}
+	switch cmd.name {
+	case "deploy", "destroy", "wake", "redeploy":
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s %s takes no arguments", commandPrefix, cmd.name)
+		}
+	case "extend":
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("usage: %s extend <duration> (e.g. 3d, 12h)", commandPrefix)
+		}
+		d, err := parseDuration(fields[2])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration %q (e.g. 3d, 12h)", fields[2])
+		}
+		cmd.extension = d
+	default:
+		return nil, fmt.Errorf("unknown command %q", cmd.name)
+	}
+	return cmd, nil
+}
+
+// parseDuration はtime.ParseDurationの書式に加えて日数(3d)を受け付ける
+func parseDuration(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// isCommand はキューに保存するコメントか判定する
+func isCommand(note *NoteEvent) bool {
+	if note.ObjectAttributes.NoteableType != "MergeRequest" {
+		return false
+	}
+	_, err := parseCommand(note.ObjectAttributes.Note)
+	return !errors.Is(err, errNotCommand)
+}
+
+// processNote はコメントのコマンドを実行し、結果をマージリクエストに返信する
+// 権限不足やコマンドの誤りは返信のみ行い、再試行しない
+func (p *processor) processNote(ctx context.Context, ev *Event) error {
+	var note NoteEvent
+	if err := json.Unmarshal(ev.Body, &note); err != nil {
+		return permanent(fmt.Errorf("json.Unmarshal error: %w", err))
+	}
+	mergeRequest := note.toMergeRequest()
+	logger := loggerFrom(ctx).With("kind", note.ObjectKind, "group", mergeRequest.Project.Namespace, "project", mergeRequest.Project.Name, "branch", mergeRequest.ObjectAttributes.SourceBranch, "user", note.User.Username)
+	ctx = context.WithValue(ctx, loggerKey{}, logger)
+
+	cmd, err := parseCommand(note.ObjectAttributes.Note)
+	if errors.Is(err, errNotCommand) {
+		return nil
+	} else if err != nil {
+		return p.reply(ctx, &note, ":warning: "+err.Error())
+	}
+	logger = logger.With("command", cmd.name)
+	ctx = context.WithValue(ctx, loggerKey{}, logger)
+
+	level, err := p.gitlab.accessLevel(ctx, note.Project.Id, note.User.Id)
+	if err != nil {
+		return err
+	}
+	if level < p.minAccessLevel {
+		logger.Warnw("command denied", "accessLevel", level)
+		return p.reply(ctx, &note, fmt.Sprintf(":no_entry: @%s is not allowed to run `%s %s`.", note.User.Username, commandPrefix, cmd.name))
+	}
+
+	c, err := NewClient()
+	if err != nil {
+		return err
+	}
+	message, err := p.runCommand(ctx, c, mergeRequest, cmd)
+	if err != nil {
+		if apierrors.IsInvalid(err) || apierrors.IsBadRequest(err) {
+			return permanent(err)
+		}
+		return err
+	}
+	logger.Infow("command complete")
+	return p.reply(ctx, &note, message)
+}
+
+// runCommand はコマンドに対応する操作をMergeRequestリソースに行い、返信するメッセージを返す
+func (p *processor) runCommand(ctx context.Context, c *Client, mergeRequest *MergeRequest, cmd *command) (string, error) {
+	group, application := environmentTarget(mergeRequest)
+	target := mergeRequest.ObjectAttributes.SourceBranch
+	name := resourceKey(mergeRequest)
+
+	switch cmd.name {
+	case "deploy", "wake":
+		if mergeRequest.ObjectAttributes.State != "opened" {
+			return fmt.Sprintf(":warning: The merge request is %s.", mergeRequest.ObjectAttributes.State), nil
+		}
+		if !forkAllowed(mergeRequest) {
+			return ":no_entry: Review environments are not deployed for merge requests from forks.", nil
+		}
+		if cmd.name == "wake" {
+			// 環境が残っていれば現在の状態を返す
+			phase, found, err := mergeRequestPhase(ctx, c, name)
+			if err != nil {
+				return "", err
+			}
+			if found {
+				return fmt.Sprintf(":information_source: Review environment `%s` is already running (%s).", name, phase), nil
+			}
+		}
+		var err error
+		if groupByBranch() {
+			err = addComponent(ctx, c, group, application, target)
+		} else {
+			err = createCrd(ctx, c, mergeRequest)
+		}
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(":rocket: Deploying review environment `%s`.", name), nil
+	case "destroy":
+		var err error
+		if groupByBranch() {
+			err = removeComponent(ctx, c, group, application, target, deletionReasonDestroyed)
+		} else {
+			err = deleteCrd(ctx, c, group, application, target, deletionReasonDestroyed)
+		}
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(":wastebasket: Destroying review environment `%s`.", name), nil
+	case "extend":
+		// TTLのないレビュー環境は延長しても削除されないため、延長せずに誤りを返信する
+		limited, found, err := hasTTL(ctx, c, name)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return fmt.Sprintf(":warning: Review environment `%s` does not exist.", name), nil
+		}
+		if !limited {
+			return fmt.Sprintf(":warning: Review environment `%s` has no TTL to extend.", name), nil
+		}
+		var total time.Duration
+		err = annotate(ctx, c, name, func(annotations map[string]string) error {
+			current := time.Duration(0)
+			if value := annotations[ttlExtensionAnnotation]; value != "" {
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					return err
+				}
+				current = d
+			}
+			total = current + cmd.extension
+			annotations[ttlExtensionAnnotation] = total.String()
+			return nil
+		})
+		if apierrors.IsNotFound(err) {
+			return fmt.Sprintf(":warning: Review environment `%s` does not exist.", name), nil
+		} else if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(":hourglass: Extended the TTL of `%s` by %s (%s in total, capped by the policy).", name, cmd.extension, total), nil
+	case "redeploy":
+		err := annotate(ctx, c, name, func(annotations map[string]string) error {
+			annotations[redeployAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			return nil
+		})
+		if apierrors.IsNotFound(err) {
+			return fmt.Sprintf(":warning: Review environment `%s` does not exist.", name), nil
+		} else if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(":arrows_counterclockwise: Redeploying review environment `%s`.", name), nil
+	}
+	return "", permanent(fmt.Errorf("unknown command %q", cmd.name))
+}
+
+// 返信に失敗してもコマンドは実行済みのため再試行しない
+func (p *processor) reply(ctx context.Context, note *NoteEvent, message string) error {
+	if err := p.gitlab.postNote(ctx, note.Project.Id, note.MergeRequest.Iid, message); err != nil {
+		loggerFrom(ctx).Errorw("reply error", "error", err)
+	}
+	return nil
+}
+
+// annotate はMergeRequestのアノテーションを更新する
+// MergeRequestがなければNotFoundのエラーを返す
+func annotate(ctx context.Context, c *Client, name string, update func(map[string]string) error) error {
+	resource := c.clientset.Resource(mergeRequestResource).Namespace(mergeRequestNamespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		mr, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		annotations := mr.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		if err := update(annotations); err != nil {
+			return err
+		}
+		mr.SetAnnotations(annotations)
+		if _, err := resource.Update(ctx, mr, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		loggerFrom(ctx).Infof("Annotated MergeRequest %q.", name)
+		return nil
+	})
+}
+
+// mergeRequestPhase はMergeRequestのフェーズを返す
+func mergeRequestPhase(ctx context.Context, c *Client, name string) (string, bool, error) {
+	mr, err := c.clientset.Resource(mergeRequestResource).Namespace(mergeRequestNamespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	phase, _, _ := unstructured.NestedString(mr.Object, "status", "phase")
+	if phase == "" {
+		phase = "Pending"
+	}
+	return phase, true, nil
+}
+
+// hasTTL はMergeRequestにTTLがあるか判定する
+// ポリシーのTTLはspecに含まれないため、オペレーターが記録した期限(status.expiresAt)も確認する
+func hasTTL(ctx context.Context, c *Client, name string) (bool, bool, error) {
+	mr, err := c.clientset.Resource(mergeRequestResource).Namespace(mergeRequestNamespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	ttl, _, _ := unstructured.NestedString(mr.Object, "spec", "lifecycle", "ttl")
+	expiresAt, _, _ := unstructured.NestedString(mr.Object, "status", "expiresAt")
+	return ttl != "" || expiresAt != "", true, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestParseCommand(t *testing.T) {
+	for note, want := range map[string]*command{
+		"/review deploy":                  {name: "deploy"},
+		"  /review destroy\nthanks":       {name: "destroy"},
+		"/review extend 3d":               {name: "extend", extension: 72 * time.Hour},
+		"/review extend 12h":              {name: "extend", extension: 12 * time.Hour},
+		"/review wake":                    {name: "wake"},
+		"/review redeploy":                {name: "redeploy"},
+		"/review extend":                  nil,
+		"/review extend -1d":              nil,
+		"/review extend soon":             nil,
+		"/review deploy now":              nil,
+		"/review scale 3":                 nil,
+		"/review":                         nil,
+		"LGTM":                            nil,
+		"please run /review deploy later": nil,
+	} {
+		got, err := parseCommand(note)
+		if want == nil {
+			if err == nil {
+				t.Errorf("parseCommand(%q) = %+v, want error", note, got)
+			}
+			continue
+		}
+		if err != nil || *got != *want {
+			t.Errorf("parseCommand(%q) = %+v, %v, want %+v", note, got, err, want)
+		}
+	}
+
+	if _, err := parseCommand("LGTM"); err != errNotCommand {
+		t.Errorf("parseCommand() error = %v, want errNotCommand", err)
+	}
+	if note := (&NoteEvent{ObjectAttributes: NoteAttributes{Note: "/review deploy", NoteableType: "Issue"}}); isCommand(note) {
+		t.Error("isCommand() = true for issue comment")
+	}
+	if note := (&NoteEvent{ObjectAttributes: NoteAttributes{Note: "/review typo", NoteableType: "MergeRequest"}}); !isCommand(note) {
+		t.Error("isCommand() = false for invalid command, want a reply")
+	}
+}
+
+func noteEvent(t *testing.T, userID int32, note string) *Event {
+	body, err := json.Marshal(NoteEvent{
+		ObjectKind:       "note",
+		User:             User{Id: userID, Username: "reviewer"},
+		Project:          Project{Id: 10, Name: "pj1", Namespace: "demo1"},
+		ObjectAttributes: NoteAttributes{Note: note, NoteableType: "MergeRequest"},
+		MergeRequest:     ObjectAttributes{Iid: 7, SourceBranch: "feature/a", State: "opened"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Event{Body: body}
+}
+
+func TestProcessNoteRejected(t *testing.T) {
+	replies := &notes{}
+	p := &processor{
+		gitlab: fakeGitLab{
+			"GET /projects/10/members/all/1":           respond(map[string]int{"access_level": 20}),
+			"POST /projects/10/merge_requests/7/notes": replies.ServeHTTP,
+		}.client(t),
+		minAccessLevel: defaultMinAccessLevel,
+	}
+
+	// Reporter、メンバー以外のユーザーは実行できない
+	for _, ev := range []*Event{noteEvent(t, 1, "/review destroy"), noteEvent(t, 2, "/review destroy")} {
+		if err := p.process(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// コマンドの誤りは返信する
+	if err := p.process(context.Background(), noteEvent(t, 1, "/review extend forever")); err != nil {
+		t.Fatal(err)
+	}
+	// コマンド以外のコメントには返信しない
+	if err := p.process(context.Background(), noteEvent(t, 1, "LGTM")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := replies.list()
+	if len(got) != 3 {
+		t.Fatalf("replies = %v, want 3", got)
+	}
+	for _, reply := range got[:2] {
+		if !strings.Contains(reply, "not allowed") {
+			t.Errorf("reply = %q, want permission error", reply)
+		}
+	}
+	if !strings.Contains(got[2], "invalid duration") {
+		t.Errorf("reply = %q, want usage error", got[2])
+	}
+}
+
+func TestExtendWithoutTTL(t *testing.T) {
+	environment := func(spec map[string]interface{}, status map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "review.nautible.com/v1beta1",
+			"kind":       "MergeRequest",
+			"metadata":   map[string]interface{}{"name": "demo1-pj1-feature-a", "namespace": mergeRequestNamespace},
+			"spec":       spec,
+			"status":     status,
+		}}
+	}
+	for _, tc := range []struct {
+		name     string
+		existing []*unstructured.Unstructured
+		reply    string
+		extended bool
+	}{
+		{"no environment", nil, "does not exist", false},
+		{"no ttl", []*unstructured.Unstructured{environment(map[string]interface{}{}, nil)}, "has no TTL", false},
+		{"ttl in spec", []*unstructured.Unstructured{environment(map[string]interface{}{"lifecycle": map[string]interface{}{"ttl": "72h0m0s"}}, nil)}, "Extended", true},
+		{"ttl from policy", []*unstructured.Unstructured{environment(map[string]interface{}{}, map[string]interface{}{"expiresAt": "2023-01-04T00:00:00Z"})}, "Extended", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := useFakeKubernetes(t, tc.existing...)
+			replies := &notes{}
+			p := &processor{
+				gitlab: fakeGitLab{
+					"GET /projects/10/members/all/1":           respond(map[string]int{"access_level": 30}),
+					"POST /projects/10/merge_requests/7/notes": replies.ServeHTTP,
+				}.client(t),
+				minAccessLevel: defaultMinAccessLevel,
+			}
+			if err := p.process(context.Background(), noteEvent(t, 1, "/review extend 1d")); err != nil {
+				t.Fatal(err)
+			}
+			if got := replies.list(); len(got) != 1 || !strings.Contains(got[0], tc.reply) {
+				t.Errorf("replies = %q, want %q", got, tc.reply)
+			}
+			env := k.object("demo1-pj1-feature-a")
+			if extended := env != nil && env.GetAnnotations()[ttlExtensionAnnotation] == "24h0m0s"; extended != tc.extended {
+				t.Errorf("extended = %v, want %v", extended, tc.extended)
+			}
+		})
+	}
+}
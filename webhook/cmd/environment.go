@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/util/retry"
+)
+
+// 環境変数 GROUP_BY_BRANCH が true の場合、同じグループで同じブランチ名のマージリクエストを1つのレビュー環境にまとめる
+func groupByBranch() bool {
+	return os.Getenv("GROUP_BY_BRANCH") == "true"
+}
+
+// 環境変数 GROUP_COMPONENTS に設定されているグループごとのプロジェクト一覧を取得
+// 例: {"demo1": ["frontend", "api", "worker"]}
+// 一覧のプロジェクトはマージリクエストがなくてもデフォルトブランチでレビュー環境にデプロイする
+func groupComponents(group string) ([]string, error) {
+	value := os.Getenv("GROUP_COMPONENTS")
+	if value == "" {
+		return nil, nil
+	}
+	components := map[string][]string{}
+	if err := json.Unmarshal([]byte(value), &components); err != nil {
+		return nil, fmt.Errorf("GROUP_COMPONENTS is invalid: %w", err)
+	}
+	return components[group], nil
+}
+
+func environmentName(group string, target string) string {
+	return fmt.Sprintf("%s-%s", group, strings.Replace(target, "/", "-", -1))
+}
+
+// レビュー環境にプロジェクトのブランチを追加する
+// レビュー環境がなければ作成する
+func addComponent(ctx context.Context, c *Client, group string, project string, target string) error {
+	resource := c.clientset.Resource(mergeRequestResource).Namespace(mergeRequestNamespace)
+	name := environmentName(group, target)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		env, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			env, err = createEnvironmentManifest(group, target)
+			if err != nil {
+				return err
+			}
+			if err := setComponent(env, project, target); err != nil {
+				return err
+			}
+			if _, err := resource.Create(ctx, env, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+			loggerFrom(ctx).Infof("Created MergeRequest %q.", name)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// 削除中のレビュー環境は削除の完了を待って作り直す
+		if env.GetDeletionTimestamp() != nil {
+			return fmt.Errorf("MergeRequest %q is being deleted", name)
+		}
+		if err := setComponent(env, project, target); err != nil {
+			return err
+		}
+		if _, err := resource.Update(ctx, env, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		loggerFrom(ctx).Infof("Updated MergeRequest %q.", name)
+		return nil
+	})
+}
+
+// レビュー環境からプロジェクトのブランチを外す
+// ブランチをデプロイしているプロジェクトがなくなればレビュー環境を削除する
+func removeComponent(ctx context.Context, c *Client, group string, project string, target string, reason string) error {
+	resource := c.clientset.Resource(mergeRequestResource).Namespace(mergeRequestNamespace)
+	name := environmentName(group, target)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		env, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			loggerFrom(ctx).Infof("MergeRequest %q not found.", name)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		remaining, err := unsetComponent(env, project)
+		if err != nil {
+			return err
+		}
+		if remaining == 0 {
+			if err := deleteMergeRequest(ctx, c, name, reason); err != nil {
+				return err
+			}
+			loggerFrom(ctx).Infof("Deleted MergeRequest %q.", name)
+			return nil
+		}
+		if _, err := resource.Update(ctx, env, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		loggerFrom(ctx).Infof("Updated MergeRequest %q.", name)
+		return nil
+	})
+}
+
+func createEnvironmentManifest(group string, target string) (*unstructured.Unstructured, error) {
+	projects, err := groupComponents(group)
+	if err != nil {
+		return nil, err
+	}
+	components := []interface{}{}
+	for _, project := range projects {
+		components = append(components, map[string]interface{}{
+			"project": project,
+		})
+	}
+	env := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "review.nautible.com/v1beta1",
+			"kind":       "MergeRequest",
+			"metadata": map[string]interface{}{
+				"name":      environmentName(group, target),
+				"namespace": mergeRequestNamespace,
+			},
+			"spec": map[string]interface{}{
+				"repository": map[string]interface{}{
+					"host":  gitlabBaseUrl,
+					"group": group,
+				},
+				"source": map[string]interface{}{
+					"path":           manifestPath,
+					"targetRevision": target,
+				},
+				"components": components,
+			},
+		},
+	}
+	return env, nil
+}
+
+// プロジェクトのコンポーネントにブランチを設定する
+func setComponent(env *unstructured.Unstructured, project string, target string) error {
+	components, _, err := unstructured.NestedSlice(env.Object, "spec", "components")
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, item := range components {
+		component, ok := item.(map[string]interface{})
+		if ok && component["project"] == project {
+			component["targetRevision"] = target
+			found = true
+		}
+	}
+	if !found {
+		components = append(components, map[string]interface{}{
+			"project":        project,
+			"targetRevision": target,
+		})
+	}
+	return unstructured.SetNestedSlice(env.Object, components, "spec", "components")
+}
+
+// プロジェクトのコンポーネントからブランチを外し、ブランチをデプロイしているコンポーネントの数を返す
+// GROUP_COMPONENTS のプロジェクトはデフォルトブランチに戻し、それ以外はコンポーネントから削除する
+func unsetComponent(env *unstructured.Unstructured, project string) (int, error) {
+	group, _, err := unstructured.NestedString(env.Object, "spec", "repository", "group")
+	if err != nil {
+		return 0, err
+	}
+	projects, err := groupComponents(group)
+	if err != nil {
+		return 0, err
+	}
+	static := map[string]bool{}
+	for _, p := range projects {
+		static[p] = true
+	}
+	components, _, err := unstructured.NestedSlice(env.Object, "spec", "components")
+	if err != nil {
+		return 0, err
+	}
+	result := []interface{}{}
+	remaining := 0
+	for _, item := range components {
+		component, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if component["project"] == project {
+			if !static[project] {
+				continue
+			}
+			delete(component, "targetRevision")
+		}
+		if component["targetRevision"] != nil && component["targetRevision"] != "" {
+			remaining++
+		}
+		result = append(result, component)
+	}
+	return remaining, unstructured.SetNestedSlice(env.Object, result, "spec", "components")
+}
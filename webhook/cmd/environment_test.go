@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// environment はcomponentsを持つグループdemo1のレビュー環境を返す
+func environment(components ...map[string]interface{}) *unstructured.Unstructured {
+	items := []interface{}{}
+	for _, component := range components {
+		items = append(items, component)
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "demo1-feature-a"},
+		"spec": map[string]interface{}{
+			"repository": map[string]interface{}{"group": "demo1"},
+			"components": items,
+		},
+	}}
+}
+
+func components(t *testing.T, env *unstructured.Unstructured) []interface{} {
+	t.Helper()
+	items, _, err := unstructured.NestedSlice(env.Object, "spec", "components")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestSetComponent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  *unstructured.Unstructured
+		want []interface{}
+	}{
+		{
+			"add to empty environment",
+			environment(),
+			[]interface{}{
+				map[string]interface{}{"project": "api", "targetRevision": "feature/a"},
+			},
+		},
+		{
+			"add next to another project",
+			environment(map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"}),
+			[]interface{}{
+				map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"},
+				map[string]interface{}{"project": "api", "targetRevision": "feature/a"},
+			},
+		},
+		{
+			"replace default branch of group component",
+			environment(map[string]interface{}{"project": "api"}, map[string]interface{}{"project": "worker"}),
+			[]interface{}{
+				map[string]interface{}{"project": "api", "targetRevision": "feature/a"},
+				map[string]interface{}{"project": "worker"},
+			},
+		},
+		{
+			"replace existing branch",
+			environment(map[string]interface{}{"project": "api", "targetRevision": "feature/old"}),
+			[]interface{}{
+				map[string]interface{}{"project": "api", "targetRevision": "feature/a"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := setComponent(tc.env, "api", "feature/a"); err != nil {
+				t.Fatal(err)
+			}
+			if got := components(t, tc.env); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("components = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUnsetComponent(t *testing.T) {
+	t.Setenv("GROUP_COMPONENTS", `{"demo1": ["frontend", "api"]}`)
+	for _, tc := range []struct {
+		name      string
+		env       *unstructured.Unstructured
+		project   string
+		want      []interface{}
+		remaining int
+	}{
+		{
+			"remove project outside group components",
+			environment(
+				map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"},
+				map[string]interface{}{"project": "worker", "targetRevision": "feature/a"},
+			),
+			"worker",
+			[]interface{}{
+				map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"},
+			},
+			1,
+		},
+		{
+			"reset group component to default branch",
+			environment(
+				map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"},
+				map[string]interface{}{"project": "api", "targetRevision": "feature/a"},
+			),
+			"api",
+			[]interface{}{
+				map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"},
+				map[string]interface{}{"project": "api"},
+			},
+			1,
+		},
+		{
+			"remove last branch",
+			environment(
+				map[string]interface{}{"project": "frontend"},
+				map[string]interface{}{"project": "worker", "targetRevision": "feature/a"},
+			),
+			"worker",
+			[]interface{}{
+				map[string]interface{}{"project": "frontend"},
+			},
+			0,
+		},
+		{
+			"remove only component",
+			environment(map[string]interface{}{"project": "worker", "targetRevision": "feature/a"}),
+			"worker",
+			[]interface{}{},
+			0,
+		},
+		{
+			"remove unknown project",
+			environment(map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"}),
+			"worker",
+			[]interface{}{
+				map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"},
+			},
+			1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			remaining, err := unsetComponent(tc.env, tc.project)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remaining != tc.remaining {
+				t.Errorf("remaining = %d, want %d", remaining, tc.remaining)
+			}
+			if got := components(t, tc.env); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("components = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	t.Setenv("GROUP_COMPONENTS", "{")
+	if _, err := unsetComponent(environment(), "api"); err == nil {
+		t.Error("unsetComponent() with invalid GROUP_COMPONENTS succeeded")
+	}
+}
+
+func TestComponentRouting(t *testing.T) {
+	t.Setenv("GROUP_BY_BRANCH", "true")
+	k := useFakeKubernetes(t)
+	tombstones, err := NewTombstones(filepath.Join(t.TempDir(), tombstoneFile), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &processor{tombstones: tombstones}
+	event := func(iid int64, project string, state string, action string) *MergeRequest {
+		return &MergeRequest{
+			ObjectKind:       "merge_request",
+			Project:          Project{Id: 10, Name: project, Namespace: "demo1", PathWithNamespace: "demo1/" + project},
+			ObjectAttributes: ObjectAttributes{Iid: iid, State: state, Action: action, SourceBranch: "feature/a"},
+		}
+	}
+
+	// 同じブランチ名のマージリクエストは1つのレビュー環境のコンポーネントになる
+	for _, mergeRequest := range []*MergeRequest{
+		event(1, "api", "opened", "open"),
+		event(2, "frontend", "opened", "open"),
+		event(1, "api", "merged", "merge"),
+	} {
+		if err := p.handleMergeRequest(context.Background(), mergeRequest, false); err != nil {
+			t.Fatalf("handleMergeRequest() error = %v", err)
+		}
+	}
+	want := []interface{}{map[string]interface{}{"project": "frontend", "targetRevision": "feature/a"}}
+	if got := components(t, k.object("demo1-feature-a")); !reflect.DeepEqual(got, want) {
+		t.Errorf("components = %v, want %v", got, want)
+	}
+
+	// 最後のコンポーネントを外すとレビュー環境を削除する
+	if err := p.handleMergeRequest(context.Background(), event(2, "frontend", "closed", "close"), false); err != nil {
+		t.Fatalf("handleMergeRequest() error = %v", err)
+	}
+	if k.object("demo1-feature-a") != nil {
+		t.Error("environment without components was not deleted")
+	}
+	wantRequests := []string{
+		"create demo1-feature-a",
+		"update demo1-feature-a",
+		"update demo1-feature-a",
+		`patch demo1-feature-a {"metadata":{"annotations":{"` + deletionReasonAnnotation + `":"closed"}}}`,
+		"delete demo1-feature-a",
+	}
+	if strings.Join(k.requests, "\n") != strings.Join(wantRequests, "\n") {
+		t.Errorf("requests = %q, want %q", k.requests, wantRequests)
+	}
+}
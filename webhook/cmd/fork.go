@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+const (
+	// フォークのレビュー環境を作成するグループ(Namespace)のデフォルト
+	defaultForkGroup = "review-forks"
+	// フォークのマージリクエストのMergeRequestリソースに付けるラベル
+	// ReviewEnvironmentPolicyのselectorでフォーク向けの制限を選択する
+	forkLabel = "review.nautible.com/fork"
+
+	forkPolicyReject = "reject"
+	forkPolicyDeploy = "deploy"
+)
+
+// 環境変数 FORK_POLICY でフォークのマージリクエストの扱いを取得
+// reject(デフォルト): レビュー環境を作成しない、deploy: フォークのリポジトリからFORK_GROUPに作成する
+func forkPolicy() string {
+	if os.Getenv("FORK_POLICY") == forkPolicyDeploy {
+		return forkPolicyDeploy
+	}
+	return forkPolicyReject
+}
+
+// isFork はフォークからのマージリクエストか判定する
+func isFork(mergeRequest *MergeRequest) bool {
+	attrs := mergeRequest.ObjectAttributes
+	return attrs.SourceProjectId != 0 && attrs.TargetProjectId != 0 && attrs.SourceProjectId != attrs.TargetProjectId
+}
+
+// forkAllowed はマージリクエストのレビュー環境を作成できるか判定する
+// フォークの場合はFORK_POLICYがdeployで、コンポーネント構成でない場合のみ作成する
+func forkAllowed(mergeRequest *MergeRequest) bool {
+	return !isFork(mergeRequest) || (forkPolicy() == forkPolicyDeploy && !groupByBranch())
+}
+
+// environmentTarget はレビュー環境のグループ(Namespace)とプロジェクトを返す
+// フォークの場合はFORK_GROUPに、同じブランチ名のマージリクエストと重ならないようフォークのパスをプロジェクトとして作成する
+func environmentTarget(mergeRequest *MergeRequest) (string, string) {
+	if isFork(mergeRequest) {
+		source := mergeRequest.ObjectAttributes.Source.PathWithNamespace
+		return envString("FORK_GROUP", defaultForkGroup), strings.Replace(source, "/", "-", -1)
+	}
+	return mergeRequest.Project.Namespace, mergeRequest.Project.Name
+}
+
+// projectPath はマージリクエストのターゲットのプロジェクトのパス(グループ/プロジェクト)を返す
+func projectPath(project Project) string {
+	if project.PathWithNamespace != "" {
+		return project.PathWithNamespace
+	}
+	return project.Namespace + "/" + project.Name
+}
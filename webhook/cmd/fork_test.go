@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func forkMergeRequest() *MergeRequest {
+	return &MergeRequest{
+		ObjectKind: "merge_request",
+		User:       User{Username: "alice"},
+		Project:    Project{Id: 10, Name: "pj1", Namespace: "demo1", PathWithNamespace: "demo1/pj1"},
+		ObjectAttributes: ObjectAttributes{
+			Iid:             7,
+			State:           "opened",
+			Action:          "open",
+			SourceBranch:    "main",
+			LastCommit:      Commit{Id: "abc123"},
+			SourceProjectId: 20,
+			TargetProjectId: 10,
+			Source:          Project{Id: 20, Name: "pj1", Namespace: "alice", PathWithNamespace: "alice/pj1", GitHttpUrl: "http://gitlab/alice/pj1.git"},
+		},
+	}
+}
+
+func TestForkManifest(t *testing.T) {
+	t.Setenv("FORK_POLICY", "deploy")
+	mergeRequest := forkMergeRequest()
+	if !isFork(mergeRequest) || !forkAllowed(mergeRequest) {
+		t.Fatal("fork merge request was not detected")
+	}
+	// 同じブランチ名のマージリクエストと重ならない
+	if got := resourceKey(mergeRequest); got != "review-forks-alice-pj1-main" {
+		t.Errorf("resourceKey() = %q", got)
+	}
+
+	manifest := createManifest(mergeRequest)
+	for _, tc := range []struct {
+		fields []string
+		want   string
+	}{
+		{[]string{"metadata", "labels", forkLabel}, "true"},
+		{[]string{"spec", "repository", "group"}, "review-forks"},
+		{[]string{"spec", "repository", "project"}, "alice-pj1"},
+		{[]string{"spec", "repository", "url"}, "http://gitlab/alice/pj1.git"},
+		{[]string{"spec", "source", "targetRevision"}, "main"},
+		{[]string{"spec", "origin", "sourceProject"}, "alice/pj1"},
+		{[]string{"spec", "origin", "targetProject"}, "demo1/pj1"},
+	} {
+		if got, _, _ := unstructured.NestedString(manifest.Object, tc.fields...); got != tc.want {
+			t.Errorf("%v = %q, want %q", tc.fields, got, tc.want)
+		}
+	}
+
+	// フォークでないマージリクエストはターゲットのプロジェクトにそのまま作成する
+	mergeRequest.ObjectAttributes.SourceProjectId = 10
+	manifest = createManifest(mergeRequest)
+	if manifest.GetName() != "demo1-pj1-main" || len(manifest.GetLabels()) != 0 {
+		t.Errorf("manifest = %s %v", manifest.GetName(), manifest.GetLabels())
+	}
+	if _, found, _ := unstructured.NestedString(manifest.Object, "spec", "repository", "url"); found {
+		t.Error("repository url is set for non-fork merge request")
+	}
+}
+
+func TestForkRejected(t *testing.T) {
+	mergeRequest := forkMergeRequest()
+	if forkAllowed(mergeRequest) {
+		t.Fatal("forkAllowed() = true without FORK_POLICY")
+	}
+	// Kubernetes APIを呼び出さずに終了する
+	if err := (&processor{}).handleMergeRequest(context.Background(), mergeRequest, false); err != nil {
+		t.Errorf("handleMergeRequest() error = %v", err)
+	}
+	// コンポーネント構成ではフォークを扱わない
+	t.Setenv("FORK_POLICY", "deploy")
+	t.Setenv("GROUP_BY_BRANCH", "true")
+	if forkAllowed(mergeRequest) {
+		t.Error("forkAllowed() = true with GROUP_BY_BRANCH")
+	}
+}
+
+func TestForkPipelineGate(t *testing.T) {
+	t.Setenv("FORK_POLICY", "deploy")
+	t.Setenv("PIPELINE_GATE", "true")
+	for name, tc := range map[string]struct {
+		head *gitlabPipeline
+		want bool
+	}{
+		"no pipeline":        {nil, false},
+		"failed":             {&gitlabPipeline{Id: 1, ProjectId: 10, Sha: "abc123", Status: "failed"}, false},
+		"pipeline in fork":   {&gitlabPipeline{Id: 1, ProjectId: 20, Sha: "abc123", Status: "success"}, false},
+		"old commit":         {&gitlabPipeline{Id: 1, ProjectId: 10, Sha: "old", Status: "success"}, false},
+		"pipeline in target": {&gitlabPipeline{Id: 1, ProjectId: 10, Sha: "abc123", Status: "success"}, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := &processor{gitlab: fakeGitLab{
+				"GET /projects/10/merge_requests/7": respond(gitlabMergeRequest{Iid: 7, State: "opened", Sha: "abc123", SourceProjectId: 20, TargetProjectId: 10, HeadPipeline: tc.head}),
+			}.client(t)}
+
+			passed, err := p.gitlab.forkPipelineSucceeded(context.Background(), 10, 7)
+			if err != nil || passed != tc.want {
+				t.Fatalf("forkPipelineSucceeded() = %v, %v, want %v", passed, err, tc.want)
+			}
+			if tc.want {
+				return
+			}
+			// 成功したパイプラインがなければKubernetes APIを呼び出さずに終了する
+			if err := p.handleMergeRequest(context.Background(), forkMergeRequest(), false); err != nil {
+				t.Errorf("handleMergeRequest() error = %v", err)
+			}
+		})
+	}
+
+	// パイプラインのイベントを受け取らないプロバイダーのフォークは作成しない
+	mergeRequest := forkMergeRequest()
+	mergeRequest.Provider = providerGitea
+	if err := (&processor{}).handleMergeRequest(context.Background(), mergeRequest, false); err != nil {
+		t.Errorf("handleMergeRequest() error = %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+type giteaUser struct {
+	Id    int32  `json:"id"`
+	Login string `json:"login"`
+}
+
+type giteaRepository struct {
+	Id            int32     `json:"id"`
+	Name          string    `json:"name"`
+	FullName      string    `json:"full_name"`
+	Owner         giteaUser `json:"owner"`
+	HtmlUrl       string    `json:"html_url"`
+	CloneUrl      string    `json:"clone_url"`
+	DefaultBranch string    `json:"default_branch"`
+}
+
+type giteaBranch struct {
+	Ref    string          `json:"ref"`
+	Sha    string          `json:"sha"`
+	RepoId int32           `json:"repo_id"`
+	Repo   giteaRepository `json:"repo"`
+}
+
+type giteaPullRequest struct {
+	Number int64  `json:"number"`
+	Title  string `json:"title"`
+	State  string `json:"state"`
+	Merged bool   `json:"merged"`
+	Labels []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+	Head giteaBranch `json:"head"`
+	Base giteaBranch `json:"base"`
+}
+
+// GiteaのPull RequestのWebhook
+type giteaPullRequestEvent struct {
+	Action      string           `json:"action"`
+	Number      int64            `json:"number"`
+	PullRequest giteaPullRequest `json:"pull_request"`
+	Repository  giteaRepository  `json:"repository"`
+	Sender      giteaUser        `json:"sender"`
+}
+
+type giteaProvider struct{}
+
+func (g *giteaProvider) name() string { return providerGitea }
+
+func (g *giteaProvider) matches(r *http.Request) bool {
+	return r.Header.Get("X-Gitea-Event") != ""
+}
+
+// X-Gitea-Signatureは環境変数 GITEA_WEBHOOK_SECRET をキーとしたボディのHMAC-SHA256
+func (g *giteaProvider) verify(r *http.Request, body []byte) bool {
+	return validSignature(os.Getenv("GITEA_WEBHOOK_SECRET"), body, r.Header.Get("X-Gitea-Signature"))
+}
+
+func (g *giteaProvider) deliveryID(r *http.Request) string {
+	return r.Header.Get("X-Gitea-Delivery")
+}
+
+func (g *giteaProvider) parse(r *http.Request, body []byte) (*incoming, error) {
+	event := r.Header.Get("X-Gitea-Event")
+	if event != "pull_request" {
+		return ignore(event, "unknown", "No Target Event.\n"), nil
+	}
+	var pull giteaPullRequestEvent
+	if err := json.Unmarshal(body, &pull); err != nil {
+		return nil, err
+	}
+	var state, action string
+	switch {
+	case pull.Action == "opened":
+		state, action = "opened", "open"
+	case pull.Action == "closed" && pull.PullRequest.Merged:
+		state, action = "merged", "merge"
+	case pull.Action == "closed":
+		state, action = "closed", "close"
+	default:
+		// 再オープンやラベルの変更などはGitLabのイベントと同様に処理しない
+		return ignore("merge_request", pull.Action, "No Target Status.\n"), nil
+	}
+	return mergeRequestEvent(pull.toMergeRequest(state, action))
+}
+
+// toMergeRequest はPull RequestをGitLabのマージリクエストのイベントと同じ形で返す
+// グループはリポジトリのオーナー、プロジェクトはリポジトリ名
+func (e *giteaPullRequestEvent) toMergeRequest(state string, action string) *MergeRequest {
+	pr := e.PullRequest
+	mergeRequest := &MergeRequest{
+		ObjectKind: "merge_request",
+		User:       User{Id: e.Sender.Id, Username: e.Sender.Login},
+		Project:    e.Repository.toProject(),
+		ObjectAttributes: ObjectAttributes{
+			Iid:             pr.Number,
+			Title:           pr.Title,
+			SourceBranch:    pr.Head.Ref,
+			TargetBranch:    pr.Base.Ref,
+			State:           state,
+			Action:          action,
+			LastCommit:      Commit{Id: pr.Head.Sha},
+			SourceProjectId: pr.Head.RepoId,
+			TargetProjectId: pr.Base.RepoId,
+			Source:          pr.Head.Repo.toProject(),
+		},
+		Provider: providerGitea,
+		Host:     trimURL(e.Repository.HtmlUrl, e.Repository.FullName),
+	}
+	for _, label := range pr.Labels {
+		mergeRequest.Labels = append(mergeRequest.Labels, Label{Title: label.Name})
+	}
+	return mergeRequest
+}
+
+func (r *giteaRepository) toProject() Project {
+	return Project{
+		Id:                r.Id,
+		Name:              r.Name,
+		WebUrl:            r.HtmlUrl,
+		Namespace:         r.Owner.Login,
+		PathWithNamespace: r.FullName,
+		DefaultBranch:     r.DefaultBranch,
+		GitHttpUrl:        r.CloneUrl,
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const gitlabRequestTimeout = 10 * time.Second
+
+// GitLab APIでコマンドを実行したユーザーの権限確認とマージリクエストへの返信を行う
+type gitlabClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// 環境変数 GITLAB_API_URL(省略時はgitlabBaseUrl)と GITLAB_API_TOKEN からクライアントを作成する
+func newGitLabClient() *gitlabClient {
+	baseURL := envString("GITLAB_API_URL", gitlabBaseUrl)
+	return &gitlabClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + "/api/v4",
+		token:      os.Getenv("GITLAB_API_TOKEN"),
+		httpClient: &http.Client{Timeout: gitlabRequestTimeout},
+	}
+}
+
+type gitlabError struct {
+	method string
+	path   string
+	status int
+	body   string
+}
+
+func (e *gitlabError) Error() string {
+	return fmt.Sprintf("GitLab API %s %s returned %d: %s", e.method, e.path, e.status, e.body)
+}
+
+// accessLevel はプロジェクトでのユーザーの権限(継承したものを含む)を返す
+// メンバーでなければ0
+func (g *gitlabClient) accessLevel(ctx context.Context, projectID int32, userID int32) (int, error) {
+	member := struct {
+		AccessLevel int `json:"access_level"`
+	}{}
+	err := g.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%d/members/all/%d", projectID, userID), nil, &member)
+	if apiErr, ok := err.(*gitlabError); ok && apiErr.status == http.StatusNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return member.AccessLevel, nil
+}
+
+// postNote はマージリクエストにコメントする
+func (g *gitlabClient) postNote(ctx context.Context, projectID int32, iid int64, body string) error {
+	return g.do(ctx, http.MethodPost, fmt.Sprintf("/projects/%d/merge_requests/%d/notes", projectID, iid), map[string]string{"body": body}, nil)
+}
+
+func (g *gitlabClient) do(ctx context.Context, method string, path string, payload interface{}, result interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", g.token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := g.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return &gitlabError{method: method, path: path, status: res.StatusCode, body: strings.TrimSpace(string(b))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGitLab はテストで使うエンドポイントのみを持つGitLab APIのスタブ
+// キーはメソッドと /api/v4 以降のパス(例: "GET /projects/10/merge_requests/7")
+type fakeGitLab map[string]http.HandlerFunc
+
+func (g fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, ok := g[r.Method+" "+strings.TrimPrefix(r.URL.Path, "/api/v4")]
+	if !ok {
+		http.Error(w, `{"message":"404 Not found"}`, http.StatusNotFound)
+		return
+	}
+	handler(w, r)
+}
+
+// client はスタブに接続するGitLab APIのクライアントを返す
+func (g fakeGitLab) client(t *testing.T) *gitlabClient {
+	t.Helper()
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	return &gitlabClient{baseURL: server.URL + "/api/v4", httpClient: server.Client()}
+}
+
+// respond は常にvalueを返すハンドラー
+func respond(value interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(value)
+	}
+}
+
+// diffs はfilesをページに分けて変更ファイルとして返すハンドラー
+func diffs(files *[]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		result := []map[string]string{}
+		for i := (page - 1) * perPage; i < len(*files) && i < page*perPage; i++ {
+			result = append(result, map[string]string{"old_path": (*files)[i], "new_path": (*files)[i]})
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// succeededPipelines はsucceededのコミットのみ成功したパイプラインを返すハンドラー
+func succeededPipelines(succeeded map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pipelines := []map[string]int64{}
+		if r.URL.Query().Get("status") == "success" && succeeded[r.URL.Query().Get("sha")] {
+			pipelines = append(pipelines, map[string]int64{"id": 1})
+		}
+		json.NewEncoder(w).Encode(pipelines)
+	}
+}
+
+// notes はマージリクエストへのコメントを記録する
+type notes struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (n *notes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	payload := map[string]string{}
+	json.NewDecoder(r.Body).Decode(&payload)
+	n.bodies = append(n.bodies, payload["body"])
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(`{}`))
+}
+
+func (n *notes) list() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.bodies...)
+}
+
+func TestAccessLevelError(t *testing.T) {
+	g := fakeGitLab{"GET /projects/10/members/all/1": func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+	}}.client(t)
+	// 権限を確認できない場合は再試行する
+	if _, err := g.accessLevel(context.Background(), 10, 1); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("accessLevel() error = %v, want 401", err)
+	}
+}
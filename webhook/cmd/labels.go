@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// ラベルの付け外しでレビュー環境を削除した場合の削除理由
+const deletionReasonOptedOut = "opted-out"
+
+type Label struct {
+	Id    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+type LabelChanges struct {
+	Previous []Label `json:"previous"`
+	Current  []Label `json:"current"`
+}
+
+// マージリクエストの更新イベントで変更された項目
+type Changes struct {
+	Labels *LabelChanges `json:"labels"`
+}
+
+// レビュー環境を作成するマージリクエストをラベルで選ぶ
+type labelRules struct {
+	// いずれかのラベルが付いている場合のみ作成する(空であればすべて)
+	required []string
+	// いずれかのラベルが付いていれば作成しない
+	skip []string
+}
+
+// 環境変数 REQUIRED_LABELS、SKIP_LABELS(カンマ区切り)からルールを取得
+// 例: REQUIRED_LABELS=review-app、SKIP_LABELS=no-review,dependencies
+func labelRulesFromEnv() labelRules {
+	return labelRules{
+		required: splitList(os.Getenv("REQUIRED_LABELS")),
+		skip:     splitList(os.Getenv("SKIP_LABELS")),
+	}
+}
+
+// allows はラベルの付いたマージリクエストにレビュー環境を作成するか判定する
+func (r labelRules) allows(labels []Label) bool {
+	titles := map[string]bool{}
+	for _, l := range labels {
+		titles[l.Title] = true
+	}
+	for _, title := range r.skip {
+		if titles[title] {
+			return false
+		}
+	}
+	if len(r.required) == 0 {
+		return true
+	}
+	for _, title := range r.required {
+		if titles[title] {
+			return true
+		}
+	}
+	return false
+}
+
+// labelsChanged はラベルを付け外した更新イベントか判定する
+func labelsChanged(mergeRequest *MergeRequest) bool {
+	return mergeRequest.ObjectAttributes.State == "opened" && mergeRequest.ObjectAttributes.Action == "update" && mergeRequest.Changes.Labels != nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func labels(titles ...string) []Label {
+	var result []Label
+	for _, title := range titles {
+		result = append(result, Label{Title: title})
+	}
+	return result
+}
+
+func TestLabelRules(t *testing.T) {
+	rules := labelRules{required: []string{"review-app"}, skip: []string{"no-review"}}
+	for _, tc := range []struct {
+		labels []Label
+		want   bool
+	}{
+		{labels("review-app"), true},
+		{labels("review-app", "no-review"), false},
+		{labels("bug"), false},
+		{nil, false},
+	} {
+		if got := rules.allows(tc.labels); got != tc.want {
+			t.Errorf("allows(%v) = %v, want %v", tc.labels, got, tc.want)
+		}
+	}
+	// ルールがなければすべて作成する
+	if !(labelRules{}).allows(nil) {
+		t.Error("allows() without rules = false")
+	}
+	if got := splitList(" review-app, ,no-review "); len(got) != 2 || got[0] != "review-app" || got[1] != "no-review" {
+		t.Errorf("splitList() = %v", got)
+	}
+}
+
+func TestProcessIgnoresByLabels(t *testing.T) {
+	t.Setenv("REQUIRED_LABELS", "review-app")
+	t.Setenv("SKIP_LABELS", "no-review")
+	p := &processor{}
+	for name, mergeRequest := range map[string]MergeRequest{
+		"open without required label": {
+			ObjectKind:       "merge_request",
+			ObjectAttributes: ObjectAttributes{State: "opened", Action: "open", SourceBranch: "docs"},
+			Labels:           labels("documentation"),
+		},
+		"unrelated label added": {
+			ObjectKind:       "merge_request",
+			ObjectAttributes: ObjectAttributes{State: "opened", Action: "update", SourceBranch: "feature/a"},
+			Labels:           labels("review-app", "bug"),
+			Changes:          Changes{Labels: &LabelChanges{Previous: labels("review-app"), Current: labels("review-app", "bug")}},
+		},
+	} {
+		body, err := json.Marshal(mergeRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Kubernetes APIを呼び出さずに終了する
+		if err := p.process(context.Background(), &Event{Body: body}); err != nil {
+			t.Errorf("%s: process() error = %v", name, err)
+		}
+	}
+}
+
+func TestLabelsChanged(t *testing.T) {
+	update := &MergeRequest{ObjectAttributes: ObjectAttributes{State: "opened", Action: "update"}}
+	if labelsChanged(update) {
+		t.Error("labelsChanged() = true without label changes")
+	}
+	update.Changes.Labels = &LabelChanges{Current: labels("review-app")}
+	if !labelsChanged(update) {
+		t.Error("labelsChanged() = false for label update")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const redacted = "[REDACTED]"
+
+// 相関IDに利用するヘッダー
+// GitLabが配信ごとに付与するイベントUUIDを優先する
+var correlationHeaders = []string{"X-Gitlab-Event-UUID", "X-Request-Id"}
+
+// ログに出力しないリクエストボディの項目(小文字で比較)
+var sensitiveFields = map[string]bool{
+	"token":         true,
+	"password":      true,
+	"secret":        true,
+	"private_token": true,
+	"access_token":  true,
+	"authorization": true,
+	"email":         true,
+	"user_email":    true,
+}
+
+type loggerKey struct{}
+
+// リクエストの相関IDを付けたロガーをコンテキストに保持する
+func withRequestLogger(r *http.Request, id string) (*http.Request, *zap.SugaredLogger) {
+	logger := zap.S().With("correlationId", id, "method", r.Method, "path", r.URL.Path)
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger)), logger
+}
+
+// コンテキストのロガーを返す
+// リクエスト外から呼ばれた場合はグローバルのロガー
+func loggerFrom(ctx context.Context) *zap.SugaredLogger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.SugaredLogger); ok {
+		return logger
+	}
+	return zap.S()
+}
+
+func correlationID(r *http.Request) string {
+	for _, header := range correlationHeaders {
+		if id := r.Header.Get(header); id != "" {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// リクエストボディの機密項目を伏せてログ出力用の文字列にする
+// JSONでない場合は中身を出力しない
+func redactBody(body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Sprintf("[non-JSON body, %d bytes]", len(body))
+	}
+	b, err := json.Marshal(redact(value))
+	if err != nil {
+		return fmt.Sprintf("[body, %d bytes]", len(body))
+	}
+	return string(b)
+}
+
+func redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if sensitiveFields[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redact(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redact(child)
+		}
+	}
+	return value
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			"top level token",
+			`{"object_kind":"merge_request","token":"glpat-secret"}`,
+			`{"object_kind":"merge_request","token":"[REDACTED]"}`,
+		},
+		{
+			"nested email",
+			`{"object_attributes":{"last_commit":{"id":"abc","author":{"name":"dev","email":"dev@example.com"}}}}`,
+			`{"object_attributes":{"last_commit":{"author":{"email":"[REDACTED]","name":"dev"},"id":"abc"}}}`,
+		},
+		{
+			"secrets in arrays",
+			`{"assignees":[{"username":"dev","email":"dev@example.com"}],"hooks":[{"url":"https://example.com","password":"p@ss"}]}`,
+			`{"assignees":[{"email":"[REDACTED]","username":"dev"}],"hooks":[{"password":"[REDACTED]","url":"https://example.com"}]}`,
+		},
+		{
+			"keys in any case",
+			`{"headers":{"Authorization":"Bearer glpat-secret","Private_Token":"glpat-secret","ACCESS_TOKEN":"glpat-secret"}}`,
+			`{"headers":{"ACCESS_TOKEN":"[REDACTED]","Authorization":"[REDACTED]","Private_Token":"[REDACTED]"}}`,
+		},
+		{
+			"whole object under secret",
+			`{"secret":{"value":"glpat-secret","items":["glpat-secret"]},"user_email":"dev@example.com"}`,
+			`{"secret":"[REDACTED]","user_email":"[REDACTED]"}`,
+		},
+		{
+			"no secrets",
+			`[{"id":1},"merge_request",null]`,
+			`[{"id":1},"merge_request",null]`,
+		},
+		{
+			"not JSON",
+			`token=glpat-secret`,
+			`[non-JSON body, 18 bytes]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := redactBody([]byte(tc.body))
+			if got != tc.want {
+				t.Errorf("redactBody() = %s, want %s", got, tc.want)
+			}
+			for _, secret := range []string{"glpat-secret", "dev@example.com", "p@ss"} {
+				if strings.Contains(got, secret) {
+					t.Errorf("redactBody() = %s, contains %q", got, secret)
+				}
+			}
+		})
+	}
+}
@@ -2,28 +2,60 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
+	"k8s.io/client-go/util/retry"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var config *rest.Config
+var (
+	config   *rest.Config
+	configMu sync.Mutex
+)
+
+var mergeRequestResource = schema.GroupVersionResource{Group: "review.nautible.com", Version: "v1beta1", Resource: "mergerequests"}
+
+const (
+	mergeRequestNamespace = "operator-system"
+	gitlabBaseUrl         = "http://gitlab-webservice-default.gitlab.svc.cluster.local:8181"
+	manifestPath          = "manifests"
+	defaultQueueDir       = "/var/lib/webhook-receiver/queue"
+	defaultMaxAttempts    = 8
+	defaultBackoff        = 2 * time.Second
+	defaultWorkers        = 4
+	defaultDedupWindow    = time.Hour
+	defaultTombstoneTTL   = 72 * time.Hour
+	// オペレーターが削除理由ごとのメトリクスを記録するためのアノテーション
+	deletionReasonAnnotation = "review.nautible.com/deletion-reason"
+)
+
+// Webhookのイベントの種類
+type eventHeader struct {
+	ObjectKind string `json:"object_kind"`
+}
 
 type Client struct {
 	clientset dynamic.Interface
@@ -42,8 +74,13 @@ type Project struct {
 	Namespace         string `json:"namespace"`
 	PathWithNamespace string `json:"path_with_namespace"`
 	DefaultBranch     string `json:"default_branch"`
+	GitHttpUrl        string `json:"git_http_url"`
+}
+type Commit struct {
+	Id string `json:"id"`
 }
 type ObjectAttributes struct {
+	Iid          int64  `json:"iid"`
 	Title        string `json:"title"`
 	Description  string `description:"description"`
 	MergeStatus  string `json:"merge_status"`
@@ -53,6 +90,13 @@ type ObjectAttributes struct {
 	Action       string `json:"action"`
 	CreatedAt    string `json:"created_at"`
 	UpdatedAt    string `json:"updated_at"`
+	LastCommit   Commit `json:"last_commit"`
+	// コミットを追加した更新のイベントのみ、追加前のコミットが設定される
+	Oldrev string `json:"oldrev"`
+	// フォークからのマージリクエストはソースとターゲットのプロジェクトが異なる
+	SourceProjectId int32   `json:"source_project_id"`
+	TargetProjectId int32   `json:"target_project_id"`
+	Source          Project `json:"source"`
 }
 type MergeRequest struct {
 	ObjectKind       string           `json:"object_kind"`
@@ -60,97 +104,419 @@ type MergeRequest struct {
 	User             User             `json:"user"`
 	Project          Project          `json:"project"`
 	ObjectAttributes ObjectAttributes `json:"object_attributes"`
+	Labels           []Label          `json:"labels"`
+	Changes          Changes          `json:"changes"`
+	// パイプラインで作成したイメージのタグ(Webhookのペイロードにはない)
+	ImageTag string `json:"-"`
+	// GitLab以外のプロバイダーのイベントを変換した場合のプロバイダーとGitホスティングのURL
+	Provider string `json:"provider,omitempty"`
+	Host     string `json:"host,omitempty"`
 }
 
 func main() {
 	logger, err := NewLogger(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
 	}
-	defer logger.Sync()
 	zap.ReplaceGlobals(logger)
+	err = run()
+	if err != nil {
+		zap.S().Errorw("webhook receiver error", "error", err)
+	}
+	logger.Sync()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// run はSIGTERMを受け取るまでWebhookを受け付ける
+// 終了時は新しいリクエストを受け付けずに処理中のリクエストとイベントの完了を待つ
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		zap.S().Infoln("healthz start")
+	c, err := serverConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	// 受信したイベントはキューに保存してからワーカーで処理する
+	queueDir := envString("QUEUE_DIR", defaultQueueDir)
+	q, err := NewQueue(queueDir, envInt("QUEUE_MAX_ATTEMPTS", defaultMaxAttempts), envDuration("QUEUE_BACKOFF", defaultBackoff), envDuration("DEDUP_WINDOW", defaultDedupWindow))
+	if err != nil {
+		return fmt.Errorf("queue open error: %w", err)
+	}
+	tombstoneFile, err := tombstonePath(queueDir)
+	if err != nil {
+		return fmt.Errorf("tombstone open error: %w", err)
+	}
+	tombstones, err := NewTombstones(tombstoneFile, envDuration("TOMBSTONE_TTL", defaultTombstoneTTL))
+	if err != nil {
+		return fmt.Errorf("tombstone open error: %w", err)
+	}
+	// トークンはSecretをマウントしたファイル(WEBHOOK_TOKENS_FILE)から読み込み、Secretの更新を反映する
+	tokens, err := NewTokenStore(os.Getenv("WEBHOOK_TOKENS_FILE"))
+	if err != nil {
+		return fmt.Errorf("token file load error: %w", err)
+	}
+	go tokens.Watch(ctx, envDuration("TOKEN_RELOAD_INTERVAL", defaultTokenReloadInterval))
+
+	ready := &readiness{check: kubernetesReachable}
+	server := newServer(c, newMux(q, tokens, ready, c.maxBodyBytes))
+	if c.tls() {
+		certs, err := newCertReloader(c.certFile, c.keyFile)
+		if err != nil {
+			return err
+		}
+		go certs.Watch(ctx, envDuration("TLS_RELOAD_INTERVAL", defaultCertReloadInterval))
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.getCertificate}
+	}
+
+	p := &processor{
+		tombstones:     tombstones,
+		gitlab:         newGitLabClient(),
+		minAccessLevel: envInt("CHATOPS_MIN_ACCESS_LEVEL", defaultMinAccessLevel),
+	}
+	drained := make(chan struct{})
+	go func() {
+		q.Run(ctx, envInt("QUEUE_WORKERS", defaultWorkers), p.process)
+		close(drained)
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		zap.S().Infow("webhook receiver start", "addr", c.addr, "tls", c.tls())
+		if c.tls() {
+			// 証明書はTLSConfigのGetCertificateで取得する
+			served <- server.ListenAndServeTLS("", "")
+		} else {
+			served <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	// 終了処理中はReadinessを失敗させ、Serviceから外す
+	zap.S().Infow("shutdown start")
+	ready.shutdown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("server shutdown error: %w", err)
+	}
+	// 処理中のイベントの完了を待つ。完了しなかったイベントはキューに残り、起動後に再処理する
+	select {
+	case <-drained:
+		zap.S().Infow("shutdown complete")
+	case <-shutdownCtx.Done():
+		zap.S().Warnw("shutdown timed out, remaining events will be processed after restart")
+	}
+	return nil
+}
+
+// newMux はWebhookレシーバーのエンドポイントを登録する
+//
+//	/healthz  Liveness(プロセスが応答できるか)
+//	/readyz   Readiness(Kubernetes APIに接続できるか)
+func newMux(q *Queue, tokens *TokenStore, ready *readiness, maxBodyBytes int64) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Health Check OK")
 	})
-	http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
-		zap.S().Infoln("webhook start Method : " + r.Method)
-		c, err := NewClient()
+	mux.Handle("/readyz", ready)
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/webhook", webhookHandler(q, tokens, maxBodyBytes))
+	mux.Handle("/admin/dead-letters", adminHandler(q))
+	mux.Handle("/admin/dead-letters/", adminHandler(q))
+	return mux
+}
+
+// Webhookを検証してキューに保存し、すぐに応答する
+// Kubernetes APIの呼び出しはキューのワーカーで行い、失敗した場合は再試行する
+func webhookHandler(q *Queue, tokens *TokenStore, maxBodyBytes int64) http.HandlerFunc {
+	providers := providers(tokens)
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := correlationID(r)
+		r, logger := withRequestLogger(r, id)
+		logger.Infow("webhook start")
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprint(w, "Method not allowed.\n")
+			return
+		}
+		pv := detectProvider(providers, r)
+		logger = logger.With("provider", pv.name())
+		kind, action := "unknown", "unknown"
+		record := func(outcome string) {
+			eventsReceived.WithLabelValues(pv.name(), kind, action, outcome).Inc()
+		}
+
+		// 署名の検証にボディを利用するため、先に読み込む
+		body, err := readBody(r, maxBodyBytes)
+		defer r.Body.Close()
+		if errors.Is(err, errBodyTooLarge) {
+			logger.Warnw("request body too large", "limit", maxBodyBytes)
+			record(outcomeInvalid)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "Request Entity Too Large")
+			return
+		} else if err != nil {
+			logger.Errorw("request body read error", "error", err)
+			record(outcomeInvalid)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "BadRequest")
+			return
+		}
+		if !pv.verify(r, body) {
+			logger.Warnw("AccessToken validation error")
+			tokenValidationFailures.WithLabelValues(pv.name()).Inc()
+			record(outcomeUnauthorized)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Authorized Error")
+			return
+		}
+		logger.Debugw("webhook body", "body", redactBody(body))
+
+		in, err := pv.parse(r, body)
+		if err != nil {
+			logger.Errorw("json.Unmarshal error", "error", err)
+			record(outcomeInvalid)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "BadRequest")
+			return
+		}
+		kind, action = in.kind, in.action
+		if in.key == "" {
+			logger.Infow("ignore event", "kind", kind, "action", action)
+			record(outcomeIgnored)
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, in.reason)
+			return
+		}
+		// 処理しないイベントはプロジェクトを取得しないため、キューに保存するイベントのみ判定する
+		if !tokens.Allowed(in.project) {
+			logger.Warnw("project not allowed", "project", in.project)
+			record(outcomeNotAllowed)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Project Not Allowed")
+			return
+		}
+
+		// 再送は同じ配信IDで届くため、受信済みであれば処理しない
+		// コマンドも同じリソースを操作するイベントと受信順に処理する
+		ev := &Event{
+			CorrelationID: id,
+			DeliveryID:    pv.deliveryID(r),
+			Key:           in.key,
+			Body:          in.body,
+		}
+		accepted, err := q.Enqueue(ev)
 		if err != nil {
-			zap.S().Fatalln("InternalServerError")
+			logger.Errorw("queue enqueue error", "error", err)
+			record(outcomeError)
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "InternalServerError")
 			return
 		}
-		switch r.Method {
-		case http.MethodPost:
-			token := r.Header.Get("X-Gitlab-Token")
-			if !validToken(token) {
-				zap.S().Warnw("AccessToken validation error")
-				w.WriteHeader(http.StatusForbidden)
-				fmt.Fprintf(w, "Authorized Error")
-				return
-			}
+		if !accepted {
+			logger.Infow("duplicate delivery ignored", "deliveryId", ev.DeliveryID)
+			record(outcomeDuplicate)
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "Duplicate Delivery")
+			return
+		}
+		logger.Infow("event queued", "eventId", ev.ID)
+		record(outcomeQueued)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Queued")
+	}
+}
 
-			// MergeRequestの内容を取得
-			body, _ := io.ReadAll(r.Body)
-			defer r.Body.Close()
-			zap.S().Debugw(string(body))
-			var mergeRequest MergeRequest
-			if err := json.Unmarshal(body, &mergeRequest); err != nil {
-				zap.S().Errorw("json.Unmarshal error message : " + err.Error())
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "InternalServerError")
-				return
-			}
+// キューから取り出したイベントを処理する
+type processor struct {
+	tombstones     *Tombstones
+	gitlab         *gitlabClient
+	minAccessLevel int
+}
 
-			// マージ作成時およびマージ実施時以外のステータスは送信しない
-			state := mergeRequest.ObjectAttributes.State
-			action := mergeRequest.ObjectAttributes.Action
-			if !checkStateAndAction(state, action) {
-				w.WriteHeader(http.StatusOK)
-				fmt.Fprint(w, "No Target Status.\n")
-				return
-			}
+// process はイベントの種類ごとにMergeRequestリソースを作成・削除する
+// エラーを返した場合はバックオフして再試行する
+func (p *processor) process(ctx context.Context, ev *Event) error {
+	var header eventHeader
+	if err := json.Unmarshal(ev.Body, &header); err != nil {
+		return permanent(fmt.Errorf("json.Unmarshal error: %w", err))
+	}
+	switch header.ObjectKind {
+	case "note":
+		return p.processNote(ctx, ev)
+	case "pipeline":
+		return p.processPipeline(ctx, ev)
+	}
+	var mergeRequest MergeRequest
+	if err := json.Unmarshal(ev.Body, &mergeRequest); err != nil {
+		return permanent(fmt.Errorf("json.Unmarshal error: %w", err))
+	}
+	return p.handleMergeRequest(ctx, &mergeRequest, false)
+}
 
-			// メッセージ送信
-			target := mergeRequest.ObjectAttributes.SourceBranch
-			application := mergeRequest.Project.Name
-			group := mergeRequest.Project.Namespace
-			if state == "opened" && action == "open" {
-				zap.S().Infoln("create MergeRequestResource")
-				err = createCrd(r.Context(), c, group, application, target)
-			} else {
-				zap.S().Infoln("delete MergeRequestResource")
-				err = deleteCrd(r.Context(), c, group, application, target)
-			}
-			if err != nil {
-				zap.S().Errorw("MergeRequestResource execute error message : " + err.Error())
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "InternalServerError")
-				return
-			}
-			zap.S().Infoln("SendMessage Complete")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, "SendMessage Complete")
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			fmt.Fprint(w, "Method not allowed.\n")
+// handleMergeRequest はマージリクエストのイベントに従いMergeRequestリソースを作成・削除する
+// pipelinePassedはパイプラインの成功を確認済みの場合にtrue
+func (p *processor) handleMergeRequest(ctx context.Context, mergeRequest *MergeRequest, pipelinePassed bool) error {
+	logger := loggerFrom(ctx)
+	state := mergeRequest.ObjectAttributes.State
+	action := mergeRequest.ObjectAttributes.Action
+	target := mergeRequest.ObjectAttributes.SourceBranch
+	group, application := environmentTarget(mergeRequest)
+	logger = logger.With("kind", mergeRequest.ObjectKind, "action", action, "state", state, "group", group, "project", application, "branch", target, "fork", isFork(mergeRequest))
+	ctx = context.WithValue(ctx, loggerKey{}, logger)
+
+	// ラベルのルールに従い、オープン時は作成するか、ラベルの付け外しでは作成・削除を判定する
+	opened := state == "opened" && action == "open"
+	reason := state
+	rules := labelRulesFromEnv()
+	if opened && !rules.allows(mergeRequest.Labels) {
+		logger.Infow("ignore open event by labels")
+		return nil
+	}
+	if labelsChanged(mergeRequest) {
+		previous, current := rules.allows(mergeRequest.Changes.Labels.Previous), rules.allows(mergeRequest.Changes.Labels.Current)
+		if previous == current {
+			logger.Infow("labels changed without affecting the review environment")
+			return nil
 		}
-	})
+		opened, reason = current, deletionReasonOptedOut
+	}
+	// コミットを追加した場合は変更ファイルの条件で作成・削除を判定し直す
+	pushed := commitsPushed(mergeRequest)
+	if pushed {
+		if !pathFiltered(mergeRequest) || !rules.allows(mergeRequest.Labels) {
+			logger.Infow("ignore update event without path filters")
+			return nil
+		}
+		opened = true
+	}
+
+	// フォークのマージリクエストはFORK_POLICYに従う
+	if opened && !forkAllowed(mergeRequest) {
+		logger.Infow("ignore open event from fork", "source", mergeRequest.ObjectAttributes.Source.PathWithNamespace)
+		return nil
+	}
+
+	// 変更ファイルがプロジェクトのパターンに一致しなければ作成しない
+	// コミットの追加やパイプラインで判定し直した場合は、一致しなくなったレビュー環境を削除する
+	if opened && isGitLab(mergeRequest) {
+		changed, err := p.pathsChanged(ctx, mergeRequest)
+		if err != nil {
+			return err
+		}
+		if !changed && !pushed && !pipelinePassed {
+			logger.Infow("ignore open event by changed paths")
+			return nil
+		}
+		if !changed {
+			logger.Infow("changed paths no longer match")
+			opened, reason = false, deletionReasonPathsUnchanged
+		}
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// パイプラインの成功を待つ場合は、ソースのコミットのパイプラインが成功するまで作成しない
+	// 成功していなければパイプラインのイベントで作成する
+	// GitLab以外のプロバイダーはパイプラインのイベントを受け取らないため待たない。ただしフォークは作成しない
+	if opened && pipelineGate() && !pipelinePassed && !isGitLab(mergeRequest) && isFork(mergeRequest) {
+		logger.Infow("ignore open event from fork without pipeline")
+		return nil
+	}
+	if opened && pipelineGate() && !pipelinePassed && isGitLab(mergeRequest) {
+		var passed bool
+		var err error
+		if isFork(mergeRequest) {
+			// フォークのパイプラインはフォークの作成者が変更できるため、ターゲットのプロジェクトで実行したものに限る
+			passed, err = p.gitlab.forkPipelineSucceeded(ctx, mergeRequest.Project.Id, mergeRequest.ObjectAttributes.Iid)
+		} else {
+			passed, err = p.gitlab.pipelineSucceeded(ctx, mergeRequest.Project.Id, mergeRequest.ObjectAttributes.LastCommit.Id)
+		}
+		if err != nil {
+			return err
+		}
+		if !passed {
+			logger.Infow("wait for the pipeline to succeed", "sha", mergeRequest.ObjectAttributes.LastCommit.Id)
+			return nil
+		}
+	}
+
+	// マージ・クローズ後に遅れて届いたオープンでレビュー環境を作り直さない
+	tombstone := tombstoneKey(mergeRequest)
+	if opened && tombstone != "" && p.tombstones.Has(tombstone) {
+		logger.Infow("ignore open event for merged or closed MergeRequest")
+		return nil
+	}
+	c, err := NewClient()
+	if err != nil {
+		return err
+	}
+	if groupByBranch() {
+		// 同じグループで同じブランチ名のマージリクエストは1つのレビュー環境にまとめる
+		if opened {
+			logger.Infow("add component to MergeRequestResource")
+			err = addComponent(ctx, c, group, application, target)
+		} else {
+			logger.Infow("remove component from MergeRequestResource")
+			err = removeComponent(ctx, c, group, application, target, reason)
+		}
+	} else if opened {
+		logger.Infow("create MergeRequestResource")
+		err = createCrd(ctx, c, mergeRequest)
+	} else {
+		logger.Infow("delete MergeRequestResource")
+		err = deleteCrd(ctx, c, group, application, target, reason)
+	}
+	if err != nil {
+		// マニフェストの誤りは再試行しても成功しない
+		if apierrors.IsInvalid(err) || apierrors.IsBadRequest(err) {
+			return permanent(err)
+		}
+		return err
+	}
+	if state != "opened" && tombstone != "" {
+		if err := p.tombstones.Add(tombstone); err != nil {
+			logger.Errorw("tombstone save error", "error", err)
+		}
+	}
+	logger.Infow("SendMessage Complete")
+	return nil
 }
 
-// 環境変数 WEBHOOK_TOKEN に設定されているトークンとリクエストのトークンが一致しているか検証
-func validToken(token string) bool {
-	expect := os.Getenv("WEBHOOK_TOKEN")
-	if expect == "" {
-		return false
+// resourceKey はイベントが操作するMergeRequestリソースの名前を返す
+// 同じリソースを操作するイベントはキューで受信順に処理する
+func resourceKey(mergeRequest *MergeRequest) string {
+	group, project := environmentTarget(mergeRequest)
+	target := mergeRequest.ObjectAttributes.SourceBranch
+	if groupByBranch() {
+		return environmentName(group, target)
 	}
-	return token == expect
+	return mergeRequestName(group, project, target)
+}
+
+// tombstoneKey はマージリクエストを一意に識別するキー(プロジェクトのパス!IID)を返す
+// IIDがない場合は空文字
+func tombstoneKey(mergeRequest *MergeRequest) string {
+	if mergeRequest.ObjectAttributes.Iid == 0 {
+		return ""
+	}
+	key := fmt.Sprintf("%s!%d", projectPath(mergeRequest.Project), mergeRequest.ObjectAttributes.Iid)
+	if !isGitLab(mergeRequest) {
+		// 同じパスのプロジェクトがGitLabにあっても区別する
+		key = mergeRequest.Provider + ":" + key
+	}
+	return key
+}
+
+func mergeRequestName(group string, project string, target string) string {
+	return fmt.Sprintf("%s-%s-%s", group, project, strings.Replace(target, "/", "-", -1))
 }
 
 func checkStateAndAction(state string, action string) bool {
@@ -170,21 +536,37 @@ func checkStateAndAction(state string, action string) bool {
 	return false
 }
 
-func NewClient() (client *Client, err error) {
+// restConfig はKubernetes APIの接続設定を返す
+// ワーカーとReadinessから同時に呼ばれるため、作成済みの設定を排他して共有する
+func restConfig() (*rest.Config, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
 	if config == nil {
 		var kubeconfig string
+		var c *rest.Config
+		var err error
 
 		pathToConfig := filepath.Join(homedir.HomeDir(), ".kube", "config")
 
 		if exists(pathToConfig) {
 			kubeconfig = pathToConfig
-			config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+			c, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 		} else {
-			config, err = rest.InClusterConfig()
+			c, err = rest.InClusterConfig()
 		}
 		if err != nil {
 			return nil, err
 		}
+		c.WrapTransport = instrumentTransport
+		config = c
+	}
+	return config, nil
+}
+
+func NewClient() (client *Client, err error) {
+	config, err := restConfig()
+	if err != nil {
+		return nil, err
 	}
 	clientset, err := dynamic.NewForConfig(config)
 	if err != nil {
@@ -196,49 +578,163 @@ func NewClient() (client *Client, err error) {
 	}, nil
 }
 
+func envString(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
 func exists(filename string) bool {
 	_, err := os.Stat(filename)
 	return err == nil
 }
 
-func createCrd(ctx context.Context, c *Client, groupName string, applicationName string, target string) error {
-	resource := schema.GroupVersionResource{Group: "review.nautible.com", Version: "v1alpha1", Resource: "mergerequests"}
-	manifest := createManifest(groupName, applicationName, target)
-	result, err := c.clientset.Resource(resource).Namespace("operator-system").Create(ctx, manifest, metav1.CreateOptions{})
-	if err != nil {
+// MergeRequestリソースを作成する
+// 作成済みの場合(オープンのイベントの再送など)はマージリクエストの情報のみ更新する
+func createCrd(ctx context.Context, c *Client, mergeRequest *MergeRequest) error {
+	resource := c.clientset.Resource(mergeRequestResource).Namespace(mergeRequestNamespace)
+	manifest := createManifest(mergeRequest)
+	result, err := resource.Create(ctx, manifest, metav1.CreateOptions{})
+	if err == nil {
+		loggerFrom(ctx).Infof("Created MergeRequest %q.", result.GetName())
+		return nil
+	} else if !apierrors.IsAlreadyExists(err) {
 		return err
 	}
-	fmt.Printf("Created MergeRequest %q.\n", result.GetName())
+	name := manifest.GetName()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existing, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		// 前のマージリクエストのレビュー環境を削除中の場合は削除の完了を待って作り直す
+		if existing.GetDeletionTimestamp() != nil {
+			return fmt.Errorf("MergeRequest %q is being deleted", name)
+		}
+		// 値のない項目と含まれない項目(パイプラインのイベント以外のイメージタグなど)は作成済みの値を残す
+		for key, value := range origin(mergeRequest) {
+			if value == "" {
+				continue
+			}
+			if err := unstructured.SetNestedField(existing.Object, value, "spec", "origin", key); err != nil {
+				return err
+			}
+		}
+		if _, err := resource.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		loggerFrom(ctx).Infof("Updated MergeRequest %q.", name)
+		return nil
+	})
+}
+
+func deleteCrd(ctx context.Context, c *Client, groupName string, applicationName string, target string, reason string) error {
+	name := mergeRequestName(groupName, applicationName, target)
+	if err := deleteMergeRequest(ctx, c, name, reason); err != nil {
+		return err
+	}
+	loggerFrom(ctx).Infof("Deleted MergeRequest %q.", name)
 	return nil
 }
 
-func deleteCrd(ctx context.Context, c *Client, groupName string, applicationName string, target string) error {
-	resource := schema.GroupVersionResource{Group: "review.nautible.com", Version: "v1alpha1", Resource: "mergerequests"}
-	name := fmt.Sprintf("%s-%s-%s", groupName, applicationName, strings.Replace(target, "/", "-", -1))
-	err := c.clientset.Resource(resource).Namespace("operator-system").Delete(ctx, name, metav1.DeleteOptions{})
+// 削除理由(merged/closed)をアノテーションに記録してからMergeRequestを削除する
+// 存在しない場合(レビュー環境を作成していないマージリクエストなど)は何もしない
+func deleteMergeRequest(ctx context.Context, c *Client, name string, reason string) error {
+	resource := c.clientset.Resource(mergeRequestResource).Namespace(mergeRequestNamespace)
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{deletionReasonAnnotation: reason},
+		},
+	})
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Deleted MergeRequest %q.\n", name)
+	if _, err := resource.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); apierrors.IsNotFound(err) {
+		loggerFrom(ctx).Infof("MergeRequest %q not found.", name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := resource.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
 	return nil
 }
 
-func createManifest(group string, project string, target string) *unstructured.Unstructured {
-	name := fmt.Sprintf("%s-%s-%s", group, project, strings.Replace(target, "/", "-", -1))
+// マージリクエストのIID、最新のコミット、作成者、イメージタグをレビュー環境の変数としてオペレーターに渡す
+func origin(mergeRequest *MergeRequest) map[string]interface{} {
+	values := map[string]interface{}{
+		"iid":       mergeRequest.ObjectAttributes.Iid,
+		"commitSHA": mergeRequest.ObjectAttributes.LastCommit.Id,
+		"author":    mergeRequest.User.Username,
+	}
+	if mergeRequest.ImageTag != "" {
+		values["imageTag"] = mergeRequest.ImageTag
+	}
+	// GitLab以外のプロバイダーはオペレーターのGitLabへの通知を行わない
+	if !isGitLab(mergeRequest) {
+		values["provider"] = mergeRequest.Provider
+	}
+	// フォークの場合はソースのプロジェクトと、通知に利用するターゲットのプロジェクトを記録する
+	if isFork(mergeRequest) {
+		values["sourceProject"] = mergeRequest.ObjectAttributes.Source.PathWithNamespace
+		values["targetProject"] = projectPath(mergeRequest.Project)
+	}
+	return values
+}
+
+func createManifest(mergeRequest *MergeRequest) *unstructured.Unstructured {
+	group, project := environmentTarget(mergeRequest)
+	target := mergeRequest.ObjectAttributes.SourceBranch
+	name := mergeRequestName(group, project, target)
+	repository := map[string]interface{}{
+		"host":    gitlabBaseUrl,
+		"group":   group,
+		"project": project,
+	}
+	// GitLab以外のプロバイダーはリポジトリのURLの形式が異なるため、イベントのURLを利用する
+	if !isGitLab(mergeRequest) {
+		repository["host"] = mergeRequest.Host
+		repository["url"] = mergeRequest.Project.GitHttpUrl
+	}
+	metadata := map[string]interface{}{
+		"name":      name,
+		"namespace": mergeRequestNamespace,
+	}
+	// フォークのブランチはフォークのリポジトリからデプロイする
+	if isFork(mergeRequest) {
+		repository["url"] = mergeRequest.ObjectAttributes.Source.GitHttpUrl
+		metadata["labels"] = map[string]interface{}{forkLabel: "true"}
+	}
 	projectResource := &unstructured.Unstructured{
 		Object: map[string]interface{}{
-			"apiVersion": "review.nautible.com/v1alpha1",
+			"apiVersion": "review.nautible.com/v1beta1",
 			"kind":       "MergeRequest",
-			"metadata": map[string]interface{}{
-				"name":      name,
-				"namespace": "operator-system",
-			},
+			"metadata":   metadata,
 			"spec": map[string]interface{}{
-				"name":           group,
-				"application":    project,
-				"baseUrl":        "http://gitlab-webservice-default.gitlab.svc.cluster.local:8181",
-				"manifestPath":   "manifests",
-				"targetRevision": target,
+				"repository": repository,
+				"source": map[string]interface{}{
+					"path":           manifestPath,
+					"targetRevision": target,
+				},
+				"origin": origin(mergeRequest),
 			},
 		},
 	}
@@ -247,11 +743,11 @@ func createManifest(group string, project string, target string) *unstructured.U
 
 func NewLogger(logLevel string, logFormat string) (*zap.Logger, error) {
 	if logLevel == "" {
-		logLevel = "DEBUG"
+		logLevel = "INFO"
 	}
 	level, err := zap.ParseAtomicLevel(logLevel)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	if logFormat == "" {
 		logFormat = "console"
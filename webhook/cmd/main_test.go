@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+)
+
+// fakeKubernetes はMergeRequestリソースを保持し、作成・更新・削除のリクエストを記録するKubernetes APIのスタブ
+type fakeKubernetes struct {
+	mu       sync.Mutex
+	objects  map[string]map[string]interface{}
+	requests []string
+}
+
+func (k *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	name := path.Base(r.URL.Path)
+	body, _ := io.ReadAll(r.Body)
+	object := map[string]interface{}{}
+	json.Unmarshal(body, &object)
+	switch r.Method {
+	case http.MethodGet:
+		if k.objects[name] == nil {
+			k.status(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		json.NewEncoder(w).Encode(k.objects[name])
+	case http.MethodPost:
+		name = (&unstructured.Unstructured{Object: object}).GetName()
+		if k.objects[name] != nil {
+			k.status(w, http.StatusConflict, "AlreadyExists")
+			return
+		}
+		k.objects[name] = object
+		k.requests = append(k.requests, "create "+name)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	case http.MethodPut:
+		k.objects[name] = object
+		k.requests = append(k.requests, "update "+name)
+		w.Write(body)
+	case http.MethodPatch:
+		if k.objects[name] == nil {
+			k.status(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		k.requests = append(k.requests, "patch "+name+" "+string(body))
+		json.NewEncoder(w).Encode(k.objects[name])
+	case http.MethodDelete:
+		if k.objects[name] == nil {
+			k.status(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		delete(k.objects, name)
+		k.requests = append(k.requests, "delete "+name)
+		k.status(w, http.StatusOK, "")
+	}
+}
+
+func (k *fakeKubernetes) status(w http.ResponseWriter, code int, reason string) {
+	status := "Success"
+	if reason != "" {
+		status = "Failure"
+	}
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"apiVersion": "v1", "kind": "Status", "status": status, "reason": reason, "code": code})
+}
+
+// object は保持しているMergeRequestリソースを返す
+func (k *fakeKubernetes) object(name string) *unstructured.Unstructured {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.objects[name] == nil {
+		return nil
+	}
+	return &unstructured.Unstructured{Object: k.objects[name]}
+}
+
+// useFakeKubernetes はテストの間、Kubernetes APIの接続先をexistingを保持するスタブに向ける
+func useFakeKubernetes(t *testing.T, existing ...*unstructured.Unstructured) *fakeKubernetes {
+	t.Helper()
+	k := &fakeKubernetes{objects: map[string]map[string]interface{}{}}
+	for _, object := range existing {
+		k.objects[object.GetName()] = object.Object
+	}
+	server := httptest.NewServer(k)
+	configMu.Lock()
+	saved := config
+	config = &rest.Config{Host: server.URL}
+	configMu.Unlock()
+	t.Cleanup(func() {
+		configMu.Lock()
+		config = saved
+		configMu.Unlock()
+		server.Close()
+	})
+	return k
+}
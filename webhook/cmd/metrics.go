@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "review_webhook"
+
+// Webhookの処理結果
+const (
+	outcomeProcessed    = "processed"
+	outcomeIgnored      = "ignored"
+	outcomeUnauthorized = "unauthorized"
+	outcomeNotAllowed   = "not_allowed"
+	outcomeInvalid      = "invalid"
+	outcomeError        = "error"
+	outcomeQueued       = "queued"
+	outcomeDuplicate    = "duplicate"
+	outcomeRetried      = "retried"
+	outcomeDeadLetter   = "dead_letter"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	// 受信したイベントの数
+	eventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_received_total",
+		Help:      "Number of received webhook events by provider, kind, action and outcome.",
+	}, []string{"provider", "kind", "action", "outcome"})
+
+	// トークンの検証に失敗した数
+	tokenValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_validation_failures_total",
+		Help:      "Number of webhook requests rejected by token validation.",
+	}, []string{"provider"})
+
+	// キューから取り出したイベントの処理結果
+	eventsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_processed_total",
+		Help:      "Number of queued events processed by outcome (processed, retried, dead_letter).",
+	}, []string{"outcome"})
+
+	// 処理待ちのイベント数
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Number of events waiting to be processed, including those waiting for a retry.",
+	})
+
+	// デッドレターのイベント数
+	deadLetters = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_letters",
+		Help:      "Number of events parked in the dead letter list.",
+	})
+
+	// Kubernetes APIの呼び出し時間
+	kubernetesRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "kubernetes_request_duration_seconds",
+		Help:      "Latency of Kubernetes API requests by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
+
+func init() {
+	registry.MustRegister(
+		eventsReceived,
+		tokenValidationFailures,
+		eventsProcessed,
+		queueDepth,
+		deadLetters,
+		kubernetesRequestDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Kubernetes APIの呼び出し時間を記録するRoundTripper
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func instrumentTransport(rt http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{next: rt}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	kubernetesRequestDuration.WithLabelValues(req.Method, code).Observe(time.Since(start).Seconds())
+	return res, err
+}
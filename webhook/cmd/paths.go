@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// 変更ファイルを取得する際の1ページの件数
+const diffsPerPage = 100
+
+// 変更ファイルがパターンに一致しなくなり削除した場合の削除理由
+const deletionReasonPathsUnchanged = "paths-unchanged"
+
+// 環境変数 PATH_FILTERS に設定されているプロジェクト(グループ/プロジェクト)ごとのパターンを取得
+// 例: {"demo1/demo1pj1": ["src/", "manifests/", "Dockerfile"]}
+// 設定がないプロジェクトはnilを返す
+func pathFilters(project string) ([]string, error) {
+	value := os.Getenv("PATH_FILTERS")
+	if value == "" {
+		return nil, nil
+	}
+	filters := map[string][]string{}
+	if err := json.Unmarshal([]byte(value), &filters); err != nil {
+		return nil, fmt.Errorf("PATH_FILTERS is invalid: %w", err)
+	}
+	return filters[project], nil
+}
+
+// matchesPaths は変更ファイルのいずれかがパターンに一致するか判定する
+// "/"で終わるパターンはディレクトリ配下のすべてのファイル、それ以外はpath.Matchの書式で一致させる
+func matchesPaths(patterns []string, files []string) bool {
+	for _, file := range files {
+		for _, pattern := range patterns {
+			if strings.HasSuffix(pattern, "/") {
+				if strings.HasPrefix(file, pattern) {
+					return true
+				}
+			} else if ok, _ := path.Match(pattern, file); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathFiltered はマージリクエストのプロジェクトに変更ファイルのパターンが設定されているか判定する
+// 設定が誤っている場合は処理時にエラーとするためtrueを返す
+func pathFiltered(mergeRequest *MergeRequest) bool {
+	patterns, err := pathFilters(projectPath(mergeRequest.Project))
+	return err != nil || len(patterns) > 0
+}
+
+// commitsPushed はオープン中のマージリクエストにコミットを追加した更新のイベントか判定する
+func commitsPushed(mergeRequest *MergeRequest) bool {
+	attrs := mergeRequest.ObjectAttributes
+	return attrs.State == "opened" && attrs.Action == "update" && attrs.Oldrev != ""
+}
+
+// pathsChanged はプロジェクトのパターンに一致するファイルをマージリクエストが変更しているか判定する
+// パターンの設定がなければ常にtrue
+func (p *processor) pathsChanged(ctx context.Context, mergeRequest *MergeRequest) (bool, error) {
+	patterns, err := pathFilters(projectPath(mergeRequest.Project))
+	if err != nil {
+		return false, permanent(err)
+	}
+	if len(patterns) == 0 {
+		return true, nil
+	}
+	files, err := p.gitlab.changedFiles(ctx, mergeRequest.Project.Id, mergeRequest.ObjectAttributes.Iid)
+	if err != nil {
+		return false, err
+	}
+	return matchesPaths(patterns, files), nil
+}
+
+// changedFiles はマージリクエストで変更されたファイルのパス(変更前と変更後)を返す
+func (g *gitlabClient) changedFiles(ctx context.Context, projectID int32, iid int64) ([]string, error) {
+	var files []string
+	for page := 1; ; page++ {
+		var diffs []struct {
+			OldPath string `json:"old_path"`
+			NewPath string `json:"new_path"`
+		}
+		p := fmt.Sprintf("/projects/%d/merge_requests/%d/diffs?page=%d&per_page=%d", projectID, iid, page, diffsPerPage)
+		if err := g.do(ctx, http.MethodGet, p, nil, &diffs); err != nil {
+			return nil, err
+		}
+		for _, d := range diffs {
+			files = append(files, d.NewPath)
+			if d.OldPath != d.NewPath {
+				files = append(files, d.OldPath)
+			}
+		}
+		if len(diffs) < diffsPerPage {
+			return files, nil
+		}
+	}
+}
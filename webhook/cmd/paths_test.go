@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestMatchesPaths(t *testing.T) {
+	patterns := []string{"src/", "manifests/", "Dockerfile", "*.go"}
+	for _, tc := range []struct {
+		files []string
+		want  bool
+	}{
+		{[]string{"README.md", "docs/setup.md"}, false},
+		{[]string{"README.md", "src/main.ts"}, true},
+		{[]string{"manifests/overlays/dev/kustomization.yaml"}, true},
+		{[]string{"Dockerfile"}, true},
+		{[]string{"main.go"}, true},
+		{[]string{"cmd/main.go"}, false},
+		{[]string{"srcs/main.ts"}, false},
+		{nil, false},
+	} {
+		if got := matchesPaths(patterns, tc.files); got != tc.want {
+			t.Errorf("matchesPaths(%v) = %v, want %v", tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestPathsChanged(t *testing.T) {
+	t.Setenv("PATH_FILTERS", `{"demo1/pj1": ["src/"]}`)
+	var files []string
+	p := &processor{gitlab: fakeGitLab{"GET /projects/10/merge_requests/7/diffs": diffs(&files)}.client(t)}
+	mergeRequest := &MergeRequest{
+		Project:          Project{Id: 10, Name: "pj1", Namespace: "demo1", PathWithNamespace: "demo1/pj1"},
+		ObjectAttributes: ObjectAttributes{Iid: 7, State: "opened", Action: "open", SourceBranch: "docs"},
+	}
+
+	// 2ページ目の変更ファイルも判定する
+	for i := 0; i < diffsPerPage; i++ {
+		files = append(files, fmt.Sprintf("docs/page%d.md", i))
+	}
+	if changed, err := p.pathsChanged(context.Background(), mergeRequest); err != nil || changed {
+		t.Errorf("pathsChanged() for docs = %v, %v, want false", changed, err)
+	}
+	files = append(files, "src/index.ts")
+	if changed, err := p.pathsChanged(context.Background(), mergeRequest); err != nil || !changed {
+		t.Errorf("pathsChanged() for src = %v, %v, want true", changed, err)
+	}
+
+	// パターンのないプロジェクトはGitLab APIを呼び出さない
+	other := &MergeRequest{Project: Project{Id: 11, Name: "pj2", Namespace: "demo1"}}
+	if changed, err := (&processor{}).pathsChanged(context.Background(), other); err != nil || !changed {
+		t.Errorf("pathsChanged() without filters = %v, %v, want true", changed, err)
+	}
+
+	// ドキュメントのみのマージリクエストはKubernetes APIを呼び出さずに終了する
+	files = []string{"README.md"}
+	body, err := json.Marshal(mergeRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.process(context.Background(), &Event{Body: body}); err != nil {
+		t.Errorf("process() error = %v", err)
+	}
+}
+
+func TestPathsReevaluated(t *testing.T) {
+	t.Setenv("PATH_FILTERS", `{"demo1/pj1": ["src/"]}`)
+	var files []string
+	tombstones, err := NewTombstones(filepath.Join(t.TempDir(), tombstoneFile), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &processor{tombstones: tombstones, gitlab: fakeGitLab{"GET /projects/10/merge_requests/7/diffs": diffs(&files)}.client(t)}
+	pushed := func() *MergeRequest {
+		return &MergeRequest{
+			ObjectKind: "merge_request",
+			Project:    Project{Id: 10, Name: "pj1", Namespace: "demo1", PathWithNamespace: "demo1/pj1"},
+			ObjectAttributes: ObjectAttributes{
+				Iid: 7, State: "opened", Action: "update", Oldrev: "0123abcd", SourceBranch: "feature/a",
+				LastCommit: Commit{Id: "4567cdef"},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		files    []string
+		pipeline bool
+		existing bool
+		want     []string
+	}{
+		{"push touching paths", []string{"src/index.ts"}, false, false, []string{"create demo1-pj1-feature-a"}},
+		{"push no longer touching paths", []string{"README.md"}, false, true, []string{
+			`patch demo1-pj1-feature-a {"metadata":{"annotations":{"` + deletionReasonAnnotation + `":"paths-unchanged"}}}`,
+			"delete demo1-pj1-feature-a",
+		}},
+		{"pipeline not touching paths", []string{"README.md"}, true, true, []string{
+			`patch demo1-pj1-feature-a {"metadata":{"annotations":{"` + deletionReasonAnnotation + `":"paths-unchanged"}}}`,
+			"delete demo1-pj1-feature-a",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var existing []*unstructured.Unstructured
+			if tc.existing {
+				existing = append(existing, createManifest(pushed()))
+			}
+			k := useFakeKubernetes(t, existing...)
+			files = tc.files
+			mergeRequest := pushed()
+			if tc.pipeline {
+				mergeRequest.ObjectAttributes.Action, mergeRequest.ObjectAttributes.Oldrev = "open", ""
+			}
+			if err := p.handleMergeRequest(context.Background(), mergeRequest, tc.pipeline); err != nil {
+				t.Fatalf("handleMergeRequest() error = %v", err)
+			}
+			if strings.Join(k.requests, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("requests = %q, want %q", k.requests, tc.want)
+			}
+		})
+	}
+
+	// パターンのないプロジェクトへのコミットの追加は受け付けない
+	other := pushed()
+	other.Project = Project{Id: 11, Name: "pj2", Namespace: "demo1", PathWithNamespace: "demo1/pj2"}
+	if commitsPushed(other) && pathFiltered(other) {
+		t.Error("push to a project without filters was accepted")
+	}
+	if !pathFiltered(pushed()) {
+		t.Error("push to a project with filters was not accepted")
+	}
+}
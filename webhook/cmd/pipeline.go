@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// イメージタグのテンプレートのデフォルト(コミットSHA)
+const defaultImageTagTemplate = "{{.SHA}}"
+
+type PipelineAttributes struct {
+	Id     int64  `json:"id"`
+	Ref    string `json:"ref"`
+	Sha    string `json:"sha"`
+	Status string `json:"status"`
+	Source string `json:"source"`
+}
+
+// パイプラインのイベントに含まれるマージリクエスト(マージリクエストのパイプラインのみ)
+type PipelineMergeRequest struct {
+	Iid          int64  `json:"iid"`
+	SourceBranch string `json:"source_branch"`
+	State        string `json:"state"`
+}
+
+// パイプラインのWebhook
+type PipelineEvent struct {
+	ObjectKind       string                `json:"object_kind"`
+	User             User                  `json:"user"`
+	Project          Project               `json:"project"`
+	ObjectAttributes PipelineAttributes    `json:"object_attributes"`
+	MergeRequest     *PipelineMergeRequest `json:"merge_request"`
+}
+
+// 環境変数 PIPELINE_GATE が true の場合、ソースのコミットのパイプラインが成功してからレビュー環境を作成する
+func pipelineGate() bool {
+	return os.Getenv("PIPELINE_GATE") == "true"
+}
+
+// sourceBranch はパイプラインを実行したブランチを返す
+// マージリクエストのパイプラインのrefは"refs/merge-requests/<iid>/head"のため、マージリクエストのソースブランチを利用する
+func (e *PipelineEvent) sourceBranch() string {
+	if e.MergeRequest != nil && e.MergeRequest.SourceBranch != "" {
+		return e.MergeRequest.SourceBranch
+	}
+	return e.ObjectAttributes.Ref
+}
+
+// resourceKey はパイプラインが作成・更新するMergeRequestリソースの名前を返す
+func (e *PipelineEvent) resourceKey() string {
+	return resourceKey(&MergeRequest{Project: e.Project, ObjectAttributes: ObjectAttributes{SourceBranch: e.sourceBranch()}})
+}
+
+// 環境変数 IMAGE_TAG_TEMPLATE(Goテンプレート)でパイプラインが作成したイメージのタグを返す
+// .SHA、.ShortSHA(先頭8文字)、.Branch("/"を"-"に置き換えたブランチ名)、.PipelineID を利用できる
+func imageTag(e *PipelineEvent) (string, error) {
+	text := envString("IMAGE_TAG_TEMPLATE", defaultImageTagTemplate)
+	tmpl, err := template.New("imageTag").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("IMAGE_TAG_TEMPLATE is invalid: %w", err)
+	}
+	sha := e.ObjectAttributes.Sha
+	short := sha
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"SHA":        sha,
+		"ShortSHA":   short,
+		"Branch":     strings.Replace(e.sourceBranch(), "/", "-", -1),
+		"PipelineID": e.ObjectAttributes.Id,
+	})
+	if err != nil {
+		return "", fmt.Errorf("IMAGE_TAG_TEMPLATE is invalid: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// processPipeline は成功したパイプラインのコミットがソースのマージリクエストのレビュー環境を作成・更新する
+// ブランチのパイプラインの場合はブランチをソースとするオープン中のマージリクエストをGitLab APIで探す
+func (p *processor) processPipeline(ctx context.Context, ev *Event) error {
+	var pipeline PipelineEvent
+	if err := json.Unmarshal(ev.Body, &pipeline); err != nil {
+		return permanent(fmt.Errorf("json.Unmarshal error: %w", err))
+	}
+	logger := loggerFrom(ctx).With("kind", pipeline.ObjectKind, "pipeline", pipeline.ObjectAttributes.Id, "sha", pipeline.ObjectAttributes.Sha)
+	ctx = context.WithValue(ctx, loggerKey{}, logger)
+	tag, err := imageTag(&pipeline)
+	if err != nil {
+		return permanent(err)
+	}
+
+	var mergeRequests []gitlabMergeRequest
+	if pipeline.MergeRequest != nil && pipeline.MergeRequest.Iid > 0 {
+		mr, err := p.gitlab.mergeRequest(ctx, pipeline.Project.Id, pipeline.MergeRequest.Iid)
+		if err != nil {
+			return err
+		}
+		mergeRequests = append(mergeRequests, *mr)
+	} else {
+		mergeRequests, err = p.gitlab.openMergeRequests(ctx, pipeline.Project.Id, pipeline.ObjectAttributes.Ref)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range mergeRequests {
+		mr := &mergeRequests[i]
+		// フォークのマージリクエストはターゲットのプロジェクトで実行したパイプラインのみ成功とみなす
+		fork := mr.SourceProjectId != mr.TargetProjectId
+		if fork && pipeline.Project.Id != mr.TargetProjectId {
+			logger.Infow("ignore pipeline for merge request from fork", "iid", mr.Iid)
+			continue
+		}
+		// 古いコミットのパイプラインでは作成・更新しない
+		if mr.State != "opened" || mr.Sha != pipeline.ObjectAttributes.Sha {
+			logger.Infow("pipeline is not for the latest commit of the merge request", "iid", mr.Iid, "state", mr.State)
+			continue
+		}
+		mergeRequest := mr.toMergeRequest(pipeline.Project)
+		if fork {
+			source, err := p.gitlab.project(ctx, mr.SourceProjectId)
+			if err != nil {
+				return err
+			}
+			mergeRequest.ObjectAttributes.Source = *source
+		}
+		mergeRequest.ImageTag = tag
+		if err := p.handleMergeRequest(ctx, mergeRequest, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GitLab APIのマージリクエスト
+type gitlabMergeRequest struct {
+	Iid          int64    `json:"iid"`
+	State        string   `json:"state"`
+	SourceBranch string   `json:"source_branch"`
+	Sha          string   `json:"sha"`
+	Labels       []string `json:"labels"`
+	Author       User     `json:"author"`
+
+	SourceProjectId int32 `json:"source_project_id"`
+	TargetProjectId int32 `json:"target_project_id"`
+
+	HeadPipeline *gitlabPipeline `json:"head_pipeline"`
+}
+
+// GitLab APIのパイプライン
+type gitlabPipeline struct {
+	Id        int64  `json:"id"`
+	ProjectId int32  `json:"project_id"`
+	Sha       string `json:"sha"`
+	Status    string `json:"status"`
+}
+
+// toMergeRequest はマージリクエストをオープンのイベントと同じ形で返す
+func (m *gitlabMergeRequest) toMergeRequest(project Project) *MergeRequest {
+	mergeRequest := &MergeRequest{
+		ObjectKind: "merge_request",
+		User:       m.Author,
+		Project:    project,
+		ObjectAttributes: ObjectAttributes{
+			Iid:          m.Iid,
+			SourceBranch: m.SourceBranch,
+			State:        m.State,
+			Action:       "open",
+			LastCommit:   Commit{Id: m.Sha},
+
+			SourceProjectId: m.SourceProjectId,
+			TargetProjectId: m.TargetProjectId,
+		},
+	}
+	for _, title := range m.Labels {
+		mergeRequest.Labels = append(mergeRequest.Labels, Label{Title: title})
+	}
+	return mergeRequest
+}
+
+func (g *gitlabClient) mergeRequest(ctx context.Context, projectID int32, iid int64) (*gitlabMergeRequest, error) {
+	mr := &gitlabMergeRequest{}
+	if err := g.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%d/merge_requests/%d", projectID, iid), nil, mr); err != nil {
+		return nil, err
+	}
+	return mr, nil
+}
+
+// openMergeRequests はブランチをソースとするオープン中のマージリクエストを返す
+func (g *gitlabClient) openMergeRequests(ctx context.Context, projectID int32, branch string) ([]gitlabMergeRequest, error) {
+	var mrs []gitlabMergeRequest
+	query := url.Values{"state": {"opened"}, "source_branch": {branch}}.Encode()
+	if err := g.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%d/merge_requests?%s", projectID, query), nil, &mrs); err != nil {
+		return nil, err
+	}
+	return mrs, nil
+}
+
+// project はプロジェクトのパスとクローンURLを返す
+func (g *gitlabClient) project(ctx context.Context, projectID int32) (*Project, error) {
+	var project struct {
+		Id                int32  `json:"id"`
+		Path              string `json:"path"`
+		WebUrl            string `json:"web_url"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		HttpUrlToRepo     string `json:"http_url_to_repo"`
+		Namespace         struct {
+			FullPath string `json:"full_path"`
+		} `json:"namespace"`
+	}
+	if err := g.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%d", projectID), nil, &project); err != nil {
+		return nil, err
+	}
+	return &Project{
+		Id:                project.Id,
+		Name:              project.Path,
+		WebUrl:            project.WebUrl,
+		Namespace:         project.Namespace.FullPath,
+		PathWithNamespace: project.PathWithNamespace,
+		GitHttpUrl:        project.HttpUrlToRepo,
+	}, nil
+}
+
+// forkPipelineSucceeded はフォークのマージリクエストの最新のコミットのパイプラインが
+// ターゲットのプロジェクトで成功しているか判定する
+// フォークのプロジェクトのパイプラインはフォークの作成者が内容を変更できるため成功とみなさない
+func (g *gitlabClient) forkPipelineSucceeded(ctx context.Context, projectID int32, iid int64) (bool, error) {
+	mr, err := g.mergeRequest(ctx, projectID, iid)
+	if err != nil {
+		return false, err
+	}
+	head := mr.HeadPipeline
+	return head != nil && head.Status == "success" && head.Sha == mr.Sha && head.ProjectId == mr.TargetProjectId, nil
+}
+
+// pipelineSucceeded はコミットのパイプラインが成功しているか判定する
+func (g *gitlabClient) pipelineSucceeded(ctx context.Context, projectID int32, sha string) (bool, error) {
+	if sha == "" {
+		return false, nil
+	}
+	var pipelines []struct {
+		Id int64 `json:"id"`
+	}
+	query := url.Values{"sha": {sha}, "status": {"success"}, "per_page": {"1"}}.Encode()
+	if err := g.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%d/pipelines?%s", projectID, query), nil, &pipelines); err != nil {
+		return false, err
+	}
+	return len(pipelines) > 0, nil
+}
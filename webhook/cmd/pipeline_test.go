@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestImageTag(t *testing.T) {
+	pipeline := &PipelineEvent{
+		Project:          Project{Id: 10, Name: "pj1", Namespace: "demo1"},
+		ObjectAttributes: PipelineAttributes{Id: 42, Ref: "refs/merge-requests/7/head", Sha: "0123456789abcdef"},
+		MergeRequest:     &PipelineMergeRequest{Iid: 7, SourceBranch: "feature/a"},
+	}
+	for template, want := range map[string]string{
+		"":                                 "0123456789abcdef",
+		"{{.ShortSHA}}":                    "01234567",
+		"{{.Branch}}-{{.PipelineID}}":      "feature-a-42",
+		"review-{{.Branch}}-{{.ShortSHA}}": "review-feature-a-01234567",
+	} {
+		t.Setenv("IMAGE_TAG_TEMPLATE", template)
+		if got, err := imageTag(pipeline); err != nil || got != want {
+			t.Errorf("imageTag(%q) = %q, %v, want %q", template, got, err, want)
+		}
+	}
+	t.Setenv("IMAGE_TAG_TEMPLATE", "{{.Tag}}")
+	if _, err := imageTag(pipeline); err == nil {
+		t.Error("imageTag() with unknown field succeeded")
+	}
+	if got := pipeline.resourceKey(); got != "demo1-pj1-feature-a" {
+		t.Errorf("resourceKey() = %q, want source branch of the merge request", got)
+	}
+}
+
+func TestPipelineGate(t *testing.T) {
+	t.Setenv("PIPELINE_GATE", "true")
+	mergeRequest := gitlabMergeRequest{Iid: 7, State: "opened", SourceBranch: "feature/a", Sha: "new"}
+	p := &processor{gitlab: fakeGitLab{
+		"GET /projects/10/merge_requests":   respond([]gitlabMergeRequest{mergeRequest}),
+		"GET /projects/10/merge_requests/7": respond(mergeRequest),
+		"GET /projects/10/pipelines":        succeededPipelines(map[string]bool{"old": true}),
+	}.client(t)}
+	ctx := context.Background()
+
+	// パイプラインが成功していないコミットのオープンでは作成しない
+	open := &MergeRequest{
+		ObjectKind:       "merge_request",
+		Project:          Project{Id: 10, Name: "pj1", Namespace: "demo1"},
+		ObjectAttributes: ObjectAttributes{Iid: 7, State: "opened", Action: "open", SourceBranch: "feature/a", LastCommit: Commit{Id: "new"}},
+	}
+	if err := p.handleMergeRequest(ctx, open, false); err != nil {
+		t.Errorf("handleMergeRequest() error = %v", err)
+	}
+	if passed, err := p.gitlab.pipelineSucceeded(ctx, 10, "old"); err != nil || !passed {
+		t.Errorf("pipelineSucceeded(old) = %v, %v, want true", passed, err)
+	}
+
+	// マージリクエストの最新でないコミットのパイプラインでは作成しない
+	for _, pipeline := range []PipelineEvent{
+		{ObjectKind: "pipeline", Project: Project{Id: 10}, ObjectAttributes: PipelineAttributes{Ref: "feature/a", Sha: "old", Status: "success"}},
+		{ObjectKind: "pipeline", Project: Project{Id: 10}, ObjectAttributes: PipelineAttributes{Ref: "refs/merge-requests/7/head", Sha: "old", Status: "success"}, MergeRequest: &PipelineMergeRequest{Iid: 7, SourceBranch: "feature/a"}},
+	} {
+		body, err := json.Marshal(pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.process(ctx, &Event{Body: body}); err != nil {
+			t.Errorf("process() error = %v", err)
+		}
+	}
+
+	mrs, err := p.gitlab.openMergeRequests(ctx, 10, "feature/a")
+	if err != nil || len(mrs) != 1 {
+		t.Fatalf("openMergeRequests() = %v, %v", mrs, err)
+	}
+	opened := mrs[0].toMergeRequest(Project{Id: 10, Name: "pj1", Namespace: "demo1"})
+	if opened.ObjectAttributes.Action != "open" || opened.ObjectAttributes.LastCommit.Id != "new" {
+		t.Errorf("toMergeRequest() = %+v", opened.ObjectAttributes)
+	}
+	opened.ImageTag = "new"
+	if got := origin(opened)["imageTag"]; got != "new" {
+		t.Errorf("origin imageTag = %v, want new", got)
+	}
+}
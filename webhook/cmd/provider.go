@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	providerGitLab    = "gitlab"
+	providerGitea     = "gitea"
+	providerBitbucket = "bitbucket-server"
+)
+
+// provider はGitホスティングごとのWebhookの検証と解析を行う
+// GitLab以外のイベントはGitLabのマージリクエストのイベントと同じ形に変換してキューに保存し、同じ処理で作成・削除する
+type provider interface {
+	// name はメトリクスのラベルとMergeRequestのoriginに記録する名前
+	name() string
+	// matches はリクエストのヘッダーからこのプロバイダーのWebhookか判定する
+	matches(r *http.Request) bool
+	// verify はトークンまたは署名を検証する
+	verify(r *http.Request, body []byte) bool
+	// deliveryID は再送の重複排除に利用する配信ごとのID
+	deliveryID(r *http.Request) string
+	// parse はペイロードをキューに保存するイベントに変換する
+	parse(r *http.Request, body []byte) (*incoming, error)
+}
+
+// incoming はキューに保存する前のイベント
+// keyが空の場合は処理しないイベントで、reasonを応答する
+type incoming struct {
+	kind   string
+	action string
+	key    string
+	body   []byte
+	reason string
+	// プロジェクトの許可リストで判定するプロジェクトのパス
+	project string
+}
+
+func ignore(kind string, action string, reason string) *incoming {
+	return &incoming{kind: kind, action: action, reason: reason}
+}
+
+// 上から順にヘッダーで判定し、いずれにも一致しなければGitLabとして扱う
+func providers(tokens *TokenStore) []provider {
+	return []provider{&giteaProvider{}, &bitbucketProvider{}, &gitlabProvider{tokens: tokens}}
+}
+
+func detectProvider(providers []provider, r *http.Request) provider {
+	for _, p := range providers {
+		if p.matches(r) {
+			return p
+		}
+	}
+	return providers[len(providers)-1]
+}
+
+// GitLab以外のプロバイダーのマージリクエストをキューに保存するイベントにする
+func mergeRequestEvent(mergeRequest *MergeRequest) (*incoming, error) {
+	body, err := json.Marshal(mergeRequest)
+	if err != nil {
+		return nil, err
+	}
+	return &incoming{
+		kind:    mergeRequest.ObjectKind,
+		action:  mergeRequest.ObjectAttributes.Action,
+		key:     resourceKey(mergeRequest),
+		body:    body,
+		project: projectPath(mergeRequest.Project),
+	}, nil
+}
+
+// validSignature はボディのHMAC-SHA256(16進数)と署名が一致しているか検証する
+// シークレットが設定されていなければ常に失敗する
+func validSignature(secret string, body []byte, signature string) bool {
+	if secret == "" || signature == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+type gitlabProvider struct {
+	tokens *TokenStore
+}
+
+func (g *gitlabProvider) name() string { return providerGitLab }
+
+func (g *gitlabProvider) matches(r *http.Request) bool {
+	return r.Header.Get("X-Gitlab-Event") != "" || r.Header.Get("X-Gitlab-Token") != ""
+}
+
+// プロジェクトごとのトークンで検証するため、ペイロードからプロジェクトを取得する
+func (g *gitlabProvider) verify(r *http.Request, body []byte) bool {
+	var payload struct {
+		Project Project `json:"project"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return false
+	}
+	return g.tokens.Valid(payload.Project.PathWithNamespace, r.Header.Get("X-Gitlab-Token"))
+}
+
+// GitLabの再送は同じX-Gitlab-Event-UUIDで届く
+func (g *gitlabProvider) deliveryID(r *http.Request) string {
+	return r.Header.Get("X-Gitlab-Event-UUID")
+}
+
+func (g *gitlabProvider) parse(r *http.Request, body []byte) (*incoming, error) {
+	// イベントの種類ごとにobject_attributesの形が異なるため、種類を先に取得する
+	var header eventHeader
+	if err := json.Unmarshal(body, &header); err != nil {
+		return nil, err
+	}
+	kind := header.ObjectKind
+
+	switch kind {
+	case "note":
+		// マージリクエストへのコメントは"/review"のコマンドのみ処理する
+		var note NoteEvent
+		if err := json.Unmarshal(body, &note); err != nil {
+			return nil, err
+		}
+		if !isCommand(&note) {
+			return ignore(kind, "comment", "No Review Command.\n"), nil
+		}
+		return &incoming{kind: kind, action: "comment", key: resourceKey(note.toMergeRequest()), body: body, project: projectPath(note.Project)}, nil
+	case "pipeline":
+		// パイプラインの成功を待つ場合のみ、成功したパイプラインを処理する
+		var pipeline PipelineEvent
+		if err := json.Unmarshal(body, &pipeline); err != nil {
+			return nil, err
+		}
+		action := pipeline.ObjectAttributes.Status
+		if !pipelineGate() || action != "success" {
+			return ignore(kind, action, "No Target Pipeline.\n"), nil
+		}
+		return &incoming{kind: kind, action: action, key: pipeline.resourceKey(), body: body, project: projectPath(pipeline.Project)}, nil
+	}
+	var mergeRequest MergeRequest
+	if err := json.Unmarshal(body, &mergeRequest); err != nil {
+		return nil, err
+	}
+	action := mergeRequest.ObjectAttributes.Action
+	// マージ作成時およびマージ実施時以外のステータスは送信しない
+	// コミットの追加は変更ファイルのパターンがあるプロジェクトのみ処理する
+	pushed := commitsPushed(&mergeRequest) && pathFiltered(&mergeRequest)
+	if !checkStateAndAction(mergeRequest.ObjectAttributes.State, action) && !labelsChanged(&mergeRequest) && !pushed {
+		return ignore(kind, action, "No Target Status.\n"), nil
+	}
+	return &incoming{kind: kind, action: action, key: resourceKey(&mergeRequest), body: body, project: projectPath(mergeRequest.Project)}, nil
+}
+
+// isGitLab はGitLabのマージリクエストか判定する
+// GitLab APIを利用する処理(変更ファイル、パイプライン)はGitLabのみ行う
+func isGitLab(mergeRequest *MergeRequest) bool {
+	return mergeRequest.Provider == "" || mergeRequest.Provider == providerGitLab
+}
+
+// trimURL はURLの末尾の"/"とsuffixを取り除く
+func trimURL(url string, suffix string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(url, "/"), "/"+suffix)
+}
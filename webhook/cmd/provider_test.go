@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func setProviderEnv(t *testing.T) {
+	t.Setenv("WEBHOOK_TOKEN", "gitlab-token")
+	t.Setenv("GITEA_WEBHOOK_SECRET", "gitea-secret")
+	t.Setenv("BITBUCKET_WEBHOOK_SECRET", "bitbucket-secret")
+	t.Setenv("BITBUCKET_BASE_URL", "https://bitbucket.example.com/")
+}
+
+// Webhookを受信させてキューに保存されたイベントを返す
+func deliver(t *testing.T, header http.Header, body []byte) (int, *Event) {
+	t.Helper()
+	q, err := NewQueue(t.TempDir(), 1, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	req.Header = header
+	rec := httptest.NewRecorder()
+	tokens, err := NewTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhookHandler(q, tokens, defaultMaxBodyBytes)(rec, req)
+	for _, ev := range q.pending {
+		return rec.Code, ev
+	}
+	return rec.Code, nil
+}
+
+func giteaHeader(event string, secret string, body []byte) http.Header {
+	return http.Header{
+		"X-Gitea-Event":     {event},
+		"X-Gitea-Delivery":  {"f6266f16-1bf3-46a5-9ea4-602e06ead473"},
+		"X-Gitea-Signature": {sign(secret, body)},
+	}
+}
+
+func bitbucketHeader(event string, secret string, body []byte) http.Header {
+	return http.Header{
+		"X-Event-Key":     {event},
+		"X-Request-Id":    {"d1f2a3b4-5c6d-4e7f-8a9b-0c1d2e3f4a5b"},
+		"X-Hub-Signature": {"sha256=" + sign(secret, body)},
+	}
+}
+
+func TestProviderFixtures(t *testing.T) {
+	setProviderEnv(t)
+	for _, tc := range []struct {
+		fixture    string
+		header     func(body []byte) http.Header
+		deliveryID string
+		key        string
+		state      string
+		action     string
+		host       string
+		url        string
+	}{
+		{
+			fixture: "gitlab_merge_request_open.json",
+			header: func([]byte) http.Header {
+				return http.Header{"X-Gitlab-Token": {"gitlab-token"}, "X-Gitlab-Event-Uuid": {"uuid-1"}}
+			},
+			deliveryID: "uuid-1",
+			key:        "demo1-demo1pj1-feature-a",
+			state:      "opened",
+			action:     "open",
+			host:       gitlabBaseUrl,
+		},
+		{
+			fixture:    "gitea_pull_request_opened.json",
+			header:     func(body []byte) http.Header { return giteaHeader("pull_request", "gitea-secret", body) },
+			deliveryID: "f6266f16-1bf3-46a5-9ea4-602e06ead473",
+			key:        "platform-tools-feature-search",
+			state:      "opened",
+			action:     "open",
+			host:       "https://gitea.example.com",
+			url:        "https://gitea.example.com/platform/tools.git",
+		},
+		{
+			fixture: "gitea_pull_request_merged.json",
+			header:  func(body []byte) http.Header { return giteaHeader("pull_request", "gitea-secret", body) },
+			key:     "platform-tools-feature-search",
+			state:   "merged",
+			action:  "merge",
+		},
+		{
+			fixture: "gitea_pull_request_closed.json",
+			header:  func(body []byte) http.Header { return giteaHeader("pull_request", "gitea-secret", body) },
+			key:     "platform-tools-feature-search",
+			state:   "closed",
+			action:  "close",
+		},
+		{
+			fixture:    "bitbucket_pr_opened.json",
+			header:     func(body []byte) http.Header { return bitbucketHeader("pr:opened", "bitbucket-secret", body) },
+			deliveryID: "d1f2a3b4-5c6d-4e7f-8a9b-0c1d2e3f4a5b",
+			key:        "legacy-billing-feature-batch",
+			state:      "opened",
+			action:     "open",
+			host:       "https://bitbucket.example.com",
+			url:        "https://bitbucket.example.com/scm/legacy/billing.git",
+		},
+		{
+			fixture: "bitbucket_pr_merged.json",
+			header:  func(body []byte) http.Header { return bitbucketHeader("pr:merged", "bitbucket-secret", body) },
+			key:     "legacy-billing-feature-batch",
+			state:   "merged",
+			action:  "merge",
+		},
+		{
+			fixture: "bitbucket_pr_declined.json",
+			header:  func(body []byte) http.Header { return bitbucketHeader("pr:declined", "bitbucket-secret", body) },
+			key:     "legacy-billing-feature-batch",
+			state:   "closed",
+			action:  "close",
+		},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			body := fixture(t, tc.fixture)
+			code, ev := deliver(t, tc.header(body), body)
+			if code != http.StatusAccepted || ev == nil {
+				t.Fatalf("status = %d, want %d with a queued event", code, http.StatusAccepted)
+			}
+			if ev.Key != tc.key {
+				t.Errorf("Key = %q, want %q", ev.Key, tc.key)
+			}
+			if tc.deliveryID != "" && ev.DeliveryID != tc.deliveryID {
+				t.Errorf("DeliveryID = %q, want %q", ev.DeliveryID, tc.deliveryID)
+			}
+			// キューのイベントはGitLabのマージリクエストのイベントとして処理できる
+			var mergeRequest MergeRequest
+			if err := json.Unmarshal(ev.Body, &mergeRequest); err != nil {
+				t.Fatal(err)
+			}
+			if mergeRequest.ObjectKind != "merge_request" || mergeRequest.ObjectAttributes.State != tc.state || mergeRequest.ObjectAttributes.Action != tc.action {
+				t.Errorf("kind, state, action = %q, %q, %q, want merge_request, %q, %q", mergeRequest.ObjectKind, mergeRequest.ObjectAttributes.State, mergeRequest.ObjectAttributes.Action, tc.state, tc.action)
+			}
+			if tc.host == "" {
+				return
+			}
+			manifest := createManifest(&mergeRequest)
+			if manifest.GetName() != tc.key {
+				t.Errorf("name = %q, want %q", manifest.GetName(), tc.key)
+			}
+			if got, _, _ := unstructured.NestedString(manifest.Object, "spec", "repository", "host"); got != tc.host {
+				t.Errorf("host = %q, want %q", got, tc.host)
+			}
+			if got, _, _ := unstructured.NestedString(manifest.Object, "spec", "repository", "url"); got != tc.url {
+				t.Errorf("url = %q, want %q", got, tc.url)
+			}
+		})
+	}
+}
+
+func TestProviderOrigin(t *testing.T) {
+	setProviderEnv(t)
+	body := fixture(t, "gitea_pull_request_opened.json")
+	_, ev := deliver(t, giteaHeader("pull_request", "gitea-secret", body), body)
+	var mergeRequest MergeRequest
+	if err := json.Unmarshal(ev.Body, &mergeRequest); err != nil {
+		t.Fatal(err)
+	}
+	values := origin(&mergeRequest)
+	if values["provider"] != providerGitea || values["iid"] != int64(3) || values["author"] != "alice" || values["commitSHA"] != "9f2c1e0b7a4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b" {
+		t.Errorf("origin() = %v", values)
+	}
+	if len(mergeRequest.Labels) != 1 || mergeRequest.Labels[0].Title != "review" {
+		t.Errorf("Labels = %v, want review", mergeRequest.Labels)
+	}
+	// GitLabと同じパスのプロジェクトでも重ならない
+	if got := tombstoneKey(&mergeRequest); got != "gitea:platform/tools!3" {
+		t.Errorf("tombstoneKey() = %q", got)
+	}
+}
+
+func TestProviderFork(t *testing.T) {
+	setProviderEnv(t)
+	t.Setenv("FORK_POLICY", "deploy")
+	body := fixture(t, "bitbucket_pr_opened_fork.json")
+	_, ev := deliver(t, bitbucketHeader("pr:opened", "bitbucket-secret", body), body)
+	if ev == nil {
+		t.Fatal("event was not queued")
+	}
+	var mergeRequest MergeRequest
+	if err := json.Unmarshal(ev.Body, &mergeRequest); err != nil {
+		t.Fatal(err)
+	}
+	if !isFork(&mergeRequest) || ev.Key != "review-forks-carol-billing-fix-rounding" {
+		t.Errorf("fork = %v, key = %q", isFork(&mergeRequest), ev.Key)
+	}
+	manifest := createManifest(&mergeRequest)
+	if got, _, _ := unstructured.NestedString(manifest.Object, "spec", "repository", "url"); got != "https://bitbucket.example.com/scm/~carol/billing.git" {
+		t.Errorf("url = %q, want the fork", got)
+	}
+}
+
+func TestProviderRejected(t *testing.T) {
+	setProviderEnv(t)
+	gitea := fixture(t, "gitea_pull_request_opened.json")
+	bitbucket := fixture(t, "bitbucket_pr_opened.json")
+	for name, tc := range map[string]struct {
+		header http.Header
+		body   []byte
+	}{
+		"gitea wrong secret":          {giteaHeader("pull_request", "wrong", gitea), gitea},
+		"gitea tampered body":         {giteaHeader("pull_request", "gitea-secret", gitea), append([]byte(" "), gitea...)},
+		"bitbucket wrong secret":      {bitbucketHeader("pr:opened", "wrong", bitbucket), bitbucket},
+		"bitbucket without signature": {http.Header{"X-Event-Key": {"pr:opened"}, "X-Request-Id": {"1"}}, bitbucket},
+		"gitlab wrong token":          {http.Header{"X-Gitlab-Token": {"wrong"}}, fixture(t, "gitlab_merge_request_open.json")},
+		"gitlab invalid json":         {http.Header{"X-Gitlab-Token": {"gitlab-token"}}, []byte(`{"project": `)},
+	} {
+		if code, ev := deliver(t, tc.header, tc.body); code != http.StatusForbidden || ev != nil {
+			t.Errorf("%s: status = %d, want %d", name, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestProviderIgnored(t *testing.T) {
+	setProviderEnv(t)
+	ping := []byte(`{"test": true}`)
+	gitea := bytes.Replace(fixture(t, "gitea_pull_request_opened.json"), []byte(`"action": "opened"`), []byte(`"action": "reopened"`), 1)
+	for name, tc := range map[string]struct {
+		header http.Header
+		body   []byte
+	}{
+		"bitbucket ping": {bitbucketHeader("diagnostics:ping", "bitbucket-secret", ping), ping},
+		"gitea push":     {giteaHeader("push", "gitea-secret", ping), ping},
+		"gitea reopened": {giteaHeader("pull_request", "gitea-secret", gitea), gitea},
+	} {
+		if code, ev := deliver(t, tc.header, tc.body); code != http.StatusOK || ev != nil {
+			t.Errorf("%s: status = %d, want %d without a queued event", name, code, http.StatusOK)
+		}
+	}
+}
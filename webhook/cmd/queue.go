@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	deadLetterDir = "dead"
+	// 読み込めないイベントのファイルを移すディレクトリ(キューとデッドレターのディレクトリごと)
+	brokenDir         = "broken"
+	eventFileSuffix   = ".json"
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// Event は受信したWebhookを処理が完了するまで保持する
+type Event struct {
+	ID            string `json:"id"`
+	CorrelationID string `json:"correlationId"`
+	// DeliveryID はプロバイダーが配信ごとに付与するID(GitLabはX-Gitlab-Event-UUID)。再送の重複排除に利用する
+	DeliveryID string `json:"deliveryId,omitempty"`
+	// Key は操作対象のMergeRequestリソースの名前。同じKeyのイベントは受信順に1つずつ処理する
+	Key         string          `json:"key,omitempty"`
+	ReceivedAt  time.Time       `json:"receivedAt"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+	Body        json.RawMessage `json:"body"`
+}
+
+// 再試行しても成功しないエラー
+// 発生したイベントはすぐにデッドレターに移す
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Queue はイベントをディレクトリにファイルとして保存するキュー
+// Podが再起動しても処理前のイベントは失われない
+// 同じディレクトリを複数のプロセスで共有することはできない
+type Queue struct {
+	dir         string
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	dedupWindow time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	pending  map[string]*Event
+	inflight map[string]bool
+	// 重複排除のために受信したDeliveryIDと受信時刻を保持する
+	deliveries map[string]time.Time
+	// イベントの追加を待機中のワーカーに知らせる。通知のたびに閉じて作り直す
+	wake chan struct{}
+}
+
+// NewQueue はディレクトリに残っている処理前のイベントを読み込んでキューを作る
+// dedupWindowの間は同じDeliveryIDのイベントを受け付けない
+func NewQueue(dir string, maxAttempts int, baseBackoff time.Duration, dedupWindow time.Duration) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, deadLetterDir), 0o755); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:         dir,
+		maxAttempts: maxAttempts,
+		baseBackoff: baseBackoff,
+		maxBackoff:  defaultMaxBackoff,
+		dedupWindow: dedupWindow,
+		now:         time.Now,
+		pending:     map[string]*Event{},
+		inflight:    map[string]bool{},
+		deliveries:  map[string]time.Time{},
+		wake:        make(chan struct{}),
+	}
+	events, err := readEvents(dir)
+	if err != nil {
+		return nil, err
+	}
+	dead, err := readEvents(filepath.Join(dir, deadLetterDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range events {
+		q.pending[ev.ID] = ev
+	}
+	// 処理済みのイベントは保持しないため、再起動後の重複排除は処理前とデッドレターのイベントのみ
+	// 処理済みのイベントが再送された場合もMergeRequestリソースの作成・削除は冪等に行う
+	for _, ev := range append(events, dead...) {
+		if ev.DeliveryID != "" {
+			q.deliveries[ev.DeliveryID] = ev.ReceivedAt
+		}
+	}
+	queueDepth.Set(float64(len(q.pending)))
+	q.refreshDeadLetterMetric()
+	return q, nil
+}
+
+// Enqueue はイベントを保存してから待機中のワーカーに知らせる
+// 同じDeliveryIDのイベントを重複排除の期間内に受信済みの場合は保存せずにfalseを返す
+func (q *Queue) Enqueue(ev *Event) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.pruneDeliveries(now)
+	if ev.DeliveryID != "" {
+		if _, ok := q.deliveries[ev.DeliveryID]; ok {
+			return false, nil
+		}
+	}
+	id, err := newEventID(now)
+	if err != nil {
+		return false, err
+	}
+	ev.ID = id
+	ev.ReceivedAt = now
+	if err := writeEvent(q.dir, ev); err != nil {
+		return false, err
+	}
+	if ev.DeliveryID != "" {
+		q.deliveries[ev.DeliveryID] = now
+	}
+	q.pending[ev.ID] = ev
+	q.notify()
+	queueDepth.Set(float64(len(q.pending)))
+	return true, nil
+}
+
+// 呼び出し元でロックを取得していること
+func (q *Queue) pruneDeliveries(now time.Time) {
+	for id, received := range q.deliveries {
+		if now.Sub(received) > q.dedupWindow {
+			delete(q.deliveries, id)
+		}
+	}
+}
+
+// Run はworkers個のワーカーでイベントを処理する
+// ctxが終了すると新しいイベントを取り出さず、処理中のイベントが完了してから戻る
+// 処理中のKubernetes APIの呼び出しを中断しないよう、処理にはctxを渡さない
+func (q *Queue) Run(ctx context.Context, workers int, process func(context.Context, *Event) error) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				ev, ok := q.next(ctx)
+				if !ok {
+					return
+				}
+				q.handle(context.Background(), ev, process)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) handle(ctx context.Context, ev *Event, process func(context.Context, *Event) error) {
+	logger := zap.S().With("correlationId", ev.CorrelationID, "eventId", ev.ID, "attempt", ev.Attempts+1)
+	err := process(context.WithValue(ctx, loggerKey{}, logger), ev)
+	if err == nil {
+		if err := q.complete(ev); err != nil {
+			logger.Errorw("queue complete error", "error", err)
+		}
+		eventsProcessed.WithLabelValues(outcomeProcessed).Inc()
+		return
+	}
+	dead, ferr := q.fail(ev, err)
+	if ferr != nil {
+		logger.Errorw("queue update error", "error", ferr)
+	}
+	if dead {
+		logger.Errorw("event moved to dead letter", "error", err)
+		eventsProcessed.WithLabelValues(outcomeDeadLetter).Inc()
+		return
+	}
+	logger.Warnw("event processing failed, will retry", "error", err, "nextAttempt", ev.NextAttempt)
+	eventsProcessed.WithLabelValues(outcomeRetried).Inc()
+}
+
+// next は処理時刻を過ぎたイベントのうち最も古いものを返す
+// なければイベントが追加されるか、次の処理時刻になるまで待つ
+// 同じKeyのイベントは最も古いものが完了するまで後のものを返さない
+func (q *Queue) next(ctx context.Context) (*Event, bool) {
+	for {
+		q.mu.Lock()
+		now := q.now()
+		heads := map[string]*Event{}
+		for _, ev := range q.pending {
+			if ev.Key == "" {
+				continue
+			}
+			if head, ok := heads[ev.Key]; !ok || olderThan(ev, head) {
+				heads[ev.Key] = ev
+			}
+		}
+		var due *Event
+		wait := time.Duration(-1)
+		for _, ev := range q.pending {
+			if q.inflight[ev.ID] || (ev.Key != "" && heads[ev.Key] != ev) {
+				continue
+			}
+			if ev.NextAttempt.After(now) {
+				if d := ev.NextAttempt.Sub(now); wait < 0 || d < wait {
+					wait = d
+				}
+				continue
+			}
+			if due == nil || olderThan(ev, due) {
+				due = ev
+			}
+		}
+		if due != nil {
+			q.inflight[due.ID] = true
+			q.mu.Unlock()
+			return due, true
+		}
+		wake := q.wake
+		q.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			stopTimer(timer)
+			return nil, false
+		case <-wake:
+		case <-expired:
+		}
+		stopTimer(timer)
+	}
+}
+
+func olderThan(a *Event, b *Event) bool {
+	if !a.ReceivedAt.Equal(b.ReceivedAt) {
+		return a.ReceivedAt.Before(b.ReceivedAt)
+	}
+	return a.ID < b.ID
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (q *Queue) complete(ev *Event) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, ev.ID)
+	delete(q.inflight, ev.ID)
+	queueDepth.Set(float64(len(q.pending)))
+	return removeEvent(q.dir, ev.ID)
+}
+
+// fail は失敗回数を記録し、指数バックオフで次の処理時刻を決める
+// 上限回数に達したか再試行できないエラーの場合はデッドレターに移してtrueを返す
+func (q *Queue) fail(ev *Event, cause error) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inflight, ev.ID)
+	ev.Attempts++
+	ev.LastError = cause.Error()
+	var perm *permanentError
+	if errors.As(cause, &perm) || ev.Attempts >= q.maxAttempts {
+		delete(q.pending, ev.ID)
+		queueDepth.Set(float64(len(q.pending)))
+		if err := writeEvent(filepath.Join(q.dir, deadLetterDir), ev); err != nil {
+			return true, err
+		}
+		q.refreshDeadLetterMetric()
+		return true, removeEvent(q.dir, ev.ID)
+	}
+	ev.NextAttempt = q.now().Add(q.backoff(ev.Attempts))
+	q.notify()
+	return false, writeEvent(q.dir, ev)
+}
+
+// 1回目の失敗はbaseBackoff、以降は2倍ずつmaxBackoffまで待つ
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.baseBackoff
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return d
+}
+
+// DeadLetters はデッドレターのイベントを古い順に返す
+func (q *Queue) DeadLetters() ([]*Event, error) {
+	return readEvents(filepath.Join(q.dir, deadLetterDir))
+}
+
+// Retry はデッドレターのイベントを失敗回数を戻してキューに戻す
+// 同じイベントを同時に戻したり破棄したりしないよう、ファイルの操作もロックを取得して行う
+func (q *Queue) Retry(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dead := filepath.Join(q.dir, deadLetterDir)
+	ev, err := readEvent(dead, id)
+	if err != nil {
+		return err
+	}
+	ev.Attempts = 0
+	ev.NextAttempt = time.Time{}
+	if err := writeEvent(q.dir, ev); err != nil {
+		return err
+	}
+	if err := removeEvent(dead, id); err != nil {
+		return err
+	}
+	q.pending[ev.ID] = ev
+	q.notify()
+	queueDepth.Set(float64(len(q.pending)))
+	q.refreshDeadLetterMetric()
+	return nil
+}
+
+// Discard はデッドレターのイベントを削除する
+// イベントがない場合はfs.ErrNotExistのエラーを返す
+func (q *Queue) Discard(id string) error {
+	if err := validEventID(id); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := os.Remove(filepath.Join(q.dir, deadLetterDir, id+eventFileSuffix)); err != nil {
+		return err
+	}
+	q.refreshDeadLetterMetric()
+	return nil
+}
+
+// 呼び出し元でロックを取得していること
+func (q *Queue) notify() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+func (q *Queue) refreshDeadLetterMetric() {
+	entries, err := os.ReadDir(filepath.Join(q.dir, deadLetterDir))
+	if err != nil {
+		return
+	}
+	count := 0
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), eventFileSuffix) {
+			count++
+		}
+	}
+	deadLetters.Set(float64(count))
+}
+
+// ファイル名の順序が受信順になるよう、時刻を先頭にしたIDを作る
+func newEventID(now time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(b)), nil
+}
+
+// 管理エンドポイントから受け取ったIDでディレクトリの外を参照させない
+func validEventID(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return fmt.Errorf("invalid event id %q", id)
+	}
+	return nil
+}
+
+// イベントのファイル名(newEventIDのID)
+var eventFileName = regexp.MustCompile(`^[0-9]+-[0-9a-f]{8}\.json$`)
+
+// readEvents はディレクトリのイベントを受信順に返す
+// キューが書き込んだファイル以外は読み込まない
+func readEvents(dir string) ([]*Event, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var events []*Event
+	for _, entry := range entries {
+		if entry.IsDir() || !eventFileName.MatchString(entry.Name()) {
+			continue
+		}
+		ev, err := readEvent(dir, strings.TrimSuffix(entry.Name(), eventFileSuffix))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			// 壊れたファイルがあってもほかのイベントを処理できるよう、移してから起動する
+			if err := quarantineEvent(dir, entry.Name()); err != nil {
+				return nil, err
+			}
+			zap.S().Errorw("broken event file moved", "file", entry.Name(), "dir", filepath.Join(dir, brokenDir), "error", err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// quarantineEvent は読み込めないイベントのファイルをbrokenDirに移す
+func quarantineEvent(dir string, name string) error {
+	broken := filepath.Join(dir, brokenDir)
+	if err := os.MkdirAll(broken, 0o755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(dir, name), filepath.Join(broken, name))
+}
+
+func readEvent(dir string, id string) (*Event, error) {
+	if err := validEventID(id); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, id+eventFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	ev := &Event{}
+	if err := json.Unmarshal(b, ev); err != nil {
+		return nil, fmt.Errorf("event %s is broken: %w", id, err)
+	}
+	return ev, nil
+}
+
+// 書き込み途中のファイルを読み込まないよう、一時ファイルに書いてからリネームする
+func writeEvent(dir string, ev *Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, ev.ID+eventFileSuffix))
+}
+
+func removeEvent(dir string, id string) error {
+	if err := os.Remove(filepath.Join(dir, id+eventFileSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func runUntil(t *testing.T, q *Queue, process func(context.Context, *Event) error, done func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		q.Run(ctx, 2, process)
+		close(finished)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatal("timed out waiting for the queue")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-finished
+}
+
+func TestQueueRetriesUntilSuccess(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir, 5, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue(&Event{CorrelationID: "uuid-1", Body: []byte(`{"object_kind":"merge_request"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	calls := 0
+	process := func(ctx context.Context, ev *Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if ev.CorrelationID != "uuid-1" {
+			t.Errorf("CorrelationID = %s, want uuid-1", ev.CorrelationID)
+		}
+		if calls < 3 {
+			return errors.New("apiserver unavailable")
+		}
+		return nil
+	}
+	runUntil(t, q, process, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.pending) == 0
+	})
+	if calls != 3 {
+		t.Errorf("calls = %d, want 3", calls)
+	}
+	events, err := readEvents(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("pending events on disk = %d, want 0", len(events))
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried := &Event{CorrelationID: "uuid-1", Body: []byte(`{}`)}
+	poison := &Event{CorrelationID: "uuid-2", Body: []byte(`{}`)}
+	q.Enqueue(retried)
+	q.Enqueue(poison)
+
+	process := func(ctx context.Context, ev *Event) error {
+		if ev.ID == poison.ID {
+			return permanent(errors.New("broken payload"))
+		}
+		return errors.New("apiserver unavailable")
+	}
+	runUntil(t, q, process, func() bool {
+		dead, _ := q.DeadLetters()
+		return len(dead) == 2
+	})
+	dead, err := q.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts := map[string]int{}
+	for _, ev := range dead {
+		attempts[ev.ID] = ev.Attempts
+	}
+	if attempts[retried.ID] != 3 {
+		t.Errorf("attempts of retried event = %d, want 3", attempts[retried.ID])
+	}
+	if attempts[poison.ID] != 1 {
+		t.Errorf("attempts of poison event = %d, want 1", attempts[poison.ID])
+	}
+
+	// デッドレターから戻したイベントは再起動後も処理される
+	if err := q.Retry(retried.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Discard(poison.ID); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := reopened.pending[retried.ID]; ev == nil || ev.Attempts != 0 {
+		t.Fatalf("requeued event = %+v, want attempts 0", ev)
+	}
+	if dead, _ := reopened.DeadLetters(); len(dead) != 0 {
+		t.Errorf("dead letters = %d, want 0", len(dead))
+	}
+	if err := reopened.Retry("../escape"); err == nil {
+		t.Error("Retry() with invalid id succeeded")
+	}
+	// 戻した、または破棄したイベントはもうない
+	if err := reopened.Retry(retried.ID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Retry() of requeued event error = %v, want not exist", err)
+	}
+	if err := reopened.Discard(poison.ID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Discard() of discarded event error = %v, want not exist", err)
+	}
+}
+
+func TestQueueRetryConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir, 1, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := &Event{ID: "1-00000000", CorrelationID: "uuid-1", Body: []byte(`{}`), Attempts: 1}
+	if err := writeEvent(filepath.Join(dir, deadLetterDir), ev); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じイベントを同時に戻しても1回だけキューに戻る
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- q.Retry(ev.ID)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, fs.ErrNotExist):
+			t.Errorf("Retry() error = %v, want not exist", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("succeeded retries = %d, want 1", succeeded)
+	}
+	if dead, _ := q.DeadLetters(); len(dead) != 0 || q.pending[ev.ID] == nil {
+		t.Errorf("dead letters = %d, pending = %v, want the event requeued", len(dead), q.pending[ev.ID])
+	}
+}
+
+func TestQueueBrokenEventFile(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := &Event{CorrelationID: "uuid-1", Body: []byte(`{}`)}
+	if _, err := q.Enqueue(valid); err != nil {
+		t.Fatal(err)
+	}
+	// 書き込み途中で停止したなどで壊れたファイル
+	broken := "1700000000000000000-0123abcd.json"
+	for _, d := range []string{dir, filepath.Join(dir, deadLetterDir)} {
+		if err := os.WriteFile(filepath.Join(d, broken), []byte(`{"id": `), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 壊れたファイルを移して、ほかのイベントを読み込んで起動する
+	reopened, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.pending) != 1 || reopened.pending[valid.ID] == nil {
+		t.Errorf("pending = %v, want only %s", reopened.pending, valid.ID)
+	}
+	for _, d := range []string{dir, filepath.Join(dir, deadLetterDir)} {
+		if _, err := os.Stat(filepath.Join(d, brokenDir, broken)); err != nil {
+			t.Errorf("broken file was not moved: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(d, broken)); !os.IsNotExist(err) {
+			t.Errorf("broken file remains in %s", d)
+		}
+	}
+}
+
+func TestQueueDeduplicatesDeliveries(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	if accepted, _ := q.Enqueue(&Event{DeliveryID: "uuid-1", Body: []byte(`{}`)}); !accepted {
+		t.Fatal("first delivery was not accepted")
+	}
+	if accepted, _ := q.Enqueue(&Event{DeliveryID: "uuid-1", Body: []byte(`{}`)}); accepted {
+		t.Error("redelivery was accepted")
+	}
+	// 再起動後も処理前のイベントの再送は受け付けない
+	reopened, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.now = func() time.Time { return now }
+	if accepted, _ := reopened.Enqueue(&Event{DeliveryID: "uuid-1", Body: []byte(`{}`)}); accepted {
+		t.Error("redelivery after restart was accepted")
+	}
+	// 重複排除の期間を過ぎた再送は受け付ける
+	reopened.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if accepted, _ := reopened.Enqueue(&Event{DeliveryID: "uuid-1", Body: []byte(`{}`)}); !accepted {
+		t.Error("redelivery after the window was not accepted")
+	}
+}
+
+func TestQueueOrdersEventsByKey(t *testing.T) {
+	q, err := NewQueue(t.TempDir(), 5, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := &Event{Key: "demo1-pj1-feature-a", Body: []byte(`"open"`)}
+	merge := &Event{Key: "demo1-pj1-feature-a", Body: []byte(`"merge"`)}
+	other := &Event{Key: "demo1-pj2-feature-b", Body: []byte(`"other"`)}
+	for _, ev := range []*Event{open, merge, other} {
+		if _, err := q.Enqueue(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var order []string
+	failed := false
+	process := func(ctx context.Context, ev *Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		// 最初のオープンが失敗して再試行になってもマージは先に処理しない
+		if ev.ID == open.ID && !failed {
+			failed = true
+			return errors.New("apiserver unavailable")
+		}
+		order = append(order, string(ev.Body))
+		return nil
+	}
+	runUntil(t, q, process, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.pending) == 0
+	})
+	var keyed []string
+	for _, body := range order {
+		if body != `"other"` {
+			keyed = append(keyed, body)
+		}
+	}
+	if len(keyed) != 2 || keyed[0] != `"open"` || keyed[1] != `"merge"` {
+		t.Errorf("order = %v, want open before merge", order)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := &Queue{baseBackoff: time.Second, maxBackoff: 5 * time.Second}
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := q.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestQueueRunDrainsInflight(t *testing.T) {
+	q, err := NewQueue(t.TempDir(), 5, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue(&Event{CorrelationID: "uuid-1", Body: []byte(`{"object_kind":"merge_request"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	var processErr error
+	process := func(ctx context.Context, ev *Event) error {
+		close(started)
+		// 終了処理を始めても処理中のイベントは中断しない
+		time.Sleep(20 * time.Millisecond)
+		processErr = ctx.Err()
+		return processErr
+	}
+	finished := make(chan struct{})
+	go func() {
+		q.Run(ctx, 1, process)
+		close(finished)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after the in-flight event")
+	}
+	if processErr != nil {
+		t.Errorf("process context error = %v, want nil", processErr)
+	}
+	if len(q.pending) != 0 {
+		t.Errorf("pending = %d, want the in-flight event completed", len(q.pending))
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+const (
+	defaultListenAddr         = ":8080"
+	defaultReadHeaderTimeout  = 5 * time.Second
+	defaultReadTimeout        = 30 * time.Second
+	defaultWriteTimeout       = 30 * time.Second
+	defaultIdleTimeout        = 2 * time.Minute
+	defaultShutdownTimeout    = 25 * time.Second
+	defaultCertReloadInterval = time.Minute
+	defaultReadinessTimeout   = 5 * time.Second
+	// GitLabのマージリクエストのイベントは説明文や変更内容を含むため余裕を持たせる
+	defaultMaxBodyBytes = 5 << 20
+)
+
+// serverConfig はWebhookレシーバーのHTTPサーバーの設定
+type serverConfig struct {
+	addr              string
+	certFile          string
+	keyFile           string
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+	maxBodyBytes      int64
+}
+
+// 環境変数からサーバーの設定を取得する
+// TLS_CERT_FILE と TLS_KEY_FILE を設定した場合はHTTPSで待ち受ける
+func serverConfigFromEnv() (*serverConfig, error) {
+	c := &serverConfig{
+		addr:              envString("LISTEN_ADDR", defaultListenAddr),
+		certFile:          os.Getenv("TLS_CERT_FILE"),
+		keyFile:           os.Getenv("TLS_KEY_FILE"),
+		readHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", defaultReadHeaderTimeout),
+		readTimeout:       envDuration("READ_TIMEOUT", defaultReadTimeout),
+		writeTimeout:      envDuration("WRITE_TIMEOUT", defaultWriteTimeout),
+		idleTimeout:       envDuration("IDLE_TIMEOUT", defaultIdleTimeout),
+		shutdownTimeout:   envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		maxBodyBytes:      int64(envInt("MAX_BODY_BYTES", defaultMaxBodyBytes)),
+	}
+	if (c.certFile == "") != (c.keyFile == "") {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	return c, nil
+}
+
+func (c *serverConfig) tls() bool {
+	return c.certFile != ""
+}
+
+func newServer(c *serverConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              c.addr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.readHeaderTimeout,
+		ReadTimeout:       c.readTimeout,
+		WriteTimeout:      c.writeTimeout,
+		IdleTimeout:       c.idleTimeout,
+	}
+}
+
+// readBody はボディを上限まで読み込む。上限を超える場合はerrBodyTooLargeを返す
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// certReloader は証明書ファイルの更新を反映する
+// cert-managerなどが更新した証明書を、Podを再起動せずに新しい接続から利用する
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload は証明書ファイルが更新されていれば読み込み直す
+// 読み込みに失敗した場合は以前の証明書を使い続ける
+func (c *certReloader) reload() (bool, error) {
+	info, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	modTime := info.ModTime()
+	if keyInfo.ModTime().After(modTime) {
+		modTime = keyInfo.ModTime()
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("certificate load error: %w", err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return true, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Watch はctxが終了するまでinterval間隔で証明書ファイルの更新を確認する
+func (c *certReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				loggerFrom(ctx).Errorw("certificate reload error", "error", err)
+			} else if reloaded {
+				loggerFrom(ctx).Infow("certificate reloaded", "certFile", c.certFile)
+			}
+		}
+	}
+}
+
+// readiness はイベントを受け付けられるか判定する
+// 終了処理を始めた後と、Kubernetes APIに接続できない間は準備ができていない
+type readiness struct {
+	check        func(ctx context.Context) error
+	shuttingDown int32
+}
+
+func (r *readiness) shutdown() {
+	atomic.StoreInt32(&r.shuttingDown, 1)
+}
+
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&r.shuttingDown) == 1 {
+		http.Error(w, "Shutting Down", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), defaultReadinessTimeout)
+	defer cancel()
+	if err := r.check(ctx); err != nil {
+		loggerFrom(ctx).Warnw("readiness check error", "error", err)
+		http.Error(w, "Kubernetes API Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "Ready")
+}
+
+// kubernetesReachable はKubernetes APIに接続できるか確認する
+func kubernetesReachable(ctx context.Context) error {
+	config, err := restConfig()
+	if err != nil {
+		return err
+	}
+	client, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(config.Host, "/")+"/version", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes API returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBodyLimit(t *testing.T) {
+	t.Setenv("WEBHOOK_TOKEN", "gitlab-token")
+	q, err := NewQueue(t.TempDir(), 1, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := fixture(t, "gitlab_merge_request_open.json")
+	for _, tc := range []struct {
+		limit int64
+		want  int
+	}{
+		{int64(len(body)), http.StatusAccepted},
+		{int64(len(body)) - 1, http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("X-Gitlab-Token", "gitlab-token")
+		rec := httptest.NewRecorder()
+		webhookHandler(q, tokens, tc.limit)(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("limit %d: status = %d, want %d", tc.limit, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestAdminDeadLetters(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-token")
+	dir := t.TempDir()
+	q, err := NewQueue(dir, 1, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeEvent(filepath.Join(dir, deadLetterDir), &Event{ID: "1-00000000", Body: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodDelete, "/1-00000000", http.StatusOK},
+		{http.MethodDelete, "/1-00000000", http.StatusNotFound},
+		{http.MethodPost, "/1-00000000/retry", http.StatusNotFound},
+		{http.MethodDelete, "/1-0000.json", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(tc.method, adminPath+tc.path, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		adminHandler(q).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	var checkErr error
+	ready := &readiness{check: func(context.Context) error { return checkErr }}
+	status := func() int {
+		rec := httptest.NewRecorder()
+		ready.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	if got := status(); got != http.StatusOK {
+		t.Errorf("status = %d, want %d", got, http.StatusOK)
+	}
+	checkErr = errors.New("connection refused")
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("status without Kubernetes API = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	checkErr = nil
+	ready.shutdown()
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("status while shutting down = %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "/etc/tls/tls.crt")
+	if _, err := serverConfigFromEnv(); err == nil {
+		t.Error("serverConfigFromEnv() error = nil, want missing TLS_KEY_FILE")
+	}
+	t.Setenv("TLS_KEY_FILE", "/etc/tls/tls.key")
+	t.Setenv("WRITE_TIMEOUT", "10s")
+	c, err := serverConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(c, http.NewServeMux())
+	if !c.tls() || server.WriteTimeout != 10*time.Second || server.ReadHeaderTimeout != defaultReadHeaderTimeout || c.maxBodyBytes != defaultMaxBodyBytes {
+		t.Errorf("config = %+v", c)
+	}
+}
+
+// writeCert は自己署名の証明書と鍵を書き込む
+func writeCert(t *testing.T, dir string, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"tls.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+	for file, data := range files {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonName(t *testing.T, c *certReloader) string {
+	t.Helper()
+	cert, err := c.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Hour)
+	writeCert(t, dir, "first", modTime)
+	c, err := newCertReloader(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, c); got != "first" {
+		t.Errorf("certificate = %q, want first", got)
+	}
+
+	writeCert(t, dir, "second", modTime.Add(time.Minute))
+	if reloaded, err := c.reload(); err != nil || !reloaded {
+		t.Fatalf("reload() = %v, %v, want reloaded", reloaded, err)
+	}
+	if got := commonName(t, c); got != "second" {
+		t.Errorf("certificate = %q, want second", got)
+	}
+
+	// 更新途中で鍵と一致しない場合は以前の証明書を使い続ける
+	if err := os.WriteFile(filepath.Join(dir, "tls.key"), []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.reload(); err == nil {
+		t.Error("reload() error = nil, want invalid key")
+	}
+	if got := commonName(t, c); got != "second" {
+		t.Errorf("certificate = %q, want second", got)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// トークンファイルの変更を確認する間隔のデフォルト
+const defaultTokenReloadInterval = 10 * time.Second
+
+// Secretをマウントしたトークンファイルの内容
+//
+//	{
+//	  "tokens": ["current", "previous"],
+//	  "groups": {"demo1": ["..."]},
+//	  "projects": {"demo1/demo1pj1": ["..."]},
+//	  "allowedProjects": ["demo1/*", "demo2/demo2pj1"]
+//	}
+//
+// プロジェクト、親のグループ(近い順)、tokensの順に最初に設定があるトークンで検証する
+// トークンを入れ替える間は新旧の2つを設定する
+type tokenConfig struct {
+	Tokens   []string            `json:"tokens"`
+	Groups   map[string][]string `json:"groups"`
+	Projects map[string][]string `json:"projects"`
+	// Webhookを受け付けるプロジェクト(path.Matchの書式)。空の場合はすべて受け付ける
+	AllowedProjects []string `json:"allowedProjects"`
+}
+
+// tokensFor はプロジェクト(グループ/プロジェクト)のWebhookに設定されているトークンを返す
+func (c *tokenConfig) tokensFor(project string) []string {
+	if tokens, ok := c.Projects[project]; ok && project != "" {
+		return tokens
+	}
+	for group := path.Dir(project); group != "." && group != "/"; group = path.Dir(group) {
+		if tokens, ok := c.Groups[group]; ok {
+			return tokens
+		}
+	}
+	return c.Tokens
+}
+
+// TokenStore はWebhookのトークンとプロジェクトの許可リストを保持する
+// Secretの更新をPodの再起動なしに反映するため、ファイルの更新時刻が変わると読み込み直す
+type TokenStore struct {
+	path string
+
+	mu      sync.RWMutex
+	config  *tokenConfig
+	modTime time.Time
+}
+
+// NewTokenStore はトークンファイルを読み込む
+// ファイルを指定しない場合は環境変数 WEBHOOK_TOKEN のトークンのみ受け付ける
+func NewTokenStore(file string) (*TokenStore, error) {
+	s := &TokenStore{path: file}
+	if file == "" {
+		s.config = &tokenConfig{}
+		if token := os.Getenv("WEBHOOK_TOKEN"); token != "" {
+			s.config.Tokens = []string{token}
+		}
+		return s, nil
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload はファイルが更新されていれば読み込み直す
+// 読み込みに失敗した場合は以前の内容を使い続ける
+func (s *TokenStore) reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	unchanged := s.config != nil && info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	config := &tokenConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return false, fmt.Errorf("token file %s is invalid: %w", s.path, err)
+	}
+	s.mu.Lock()
+	s.config = config
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return true, nil
+}
+
+// Watch はctxが終了するまでinterval間隔でファイルの更新を確認する
+func (s *TokenStore) Watch(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := s.reload()
+			if err != nil {
+				loggerFrom(ctx).Errorw("token file reload error", "error", err)
+			} else if reloaded {
+				loggerFrom(ctx).Infow("token file reloaded", "path", s.path)
+			}
+		}
+	}
+}
+
+func (s *TokenStore) current() *tokenConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// Valid はプロジェクトのトークンのいずれかとリクエストのトークンが一致しているか検証する
+// 比較にかかる時間からトークンを推測されないよう、一致する長さに関係なく同じ時間で比較する
+func (s *TokenStore) Valid(project string, token string) bool {
+	if token == "" {
+		return false
+	}
+	valid := false
+	for _, expect := range s.current().tokensFor(project) {
+		if expect != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expect)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// Allowed はプロジェクトのWebhookを受け付けるか判定する
+func (s *TokenStore) Allowed(project string) bool {
+	patterns := s.current().AllowedProjects
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, project); ok && project != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTokens(t *testing.T, file string, content string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenStoreValid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokens(t, file, `{
+		"tokens": ["default"],
+		"groups": {"demo1": ["group"], "demo2/sub": ["subgroup"]},
+		"projects": {"demo1/demo1pj1": ["current", "previous"]}
+	}`, time.Now())
+	s, err := NewTokenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		project string
+		token   string
+		want    bool
+	}{
+		// 入れ替え中は新旧のどちらも受け付ける
+		{"demo1/demo1pj1", "current", true},
+		{"demo1/demo1pj1", "previous", true},
+		{"demo1/demo1pj1", "group", false},
+		{"demo1/demo1pj2", "group", true},
+		{"demo1/demo1pj2", "default", false},
+		{"demo2/sub/pj", "subgroup", true},
+		{"demo2/pj", "default", true},
+		{"demo2/pj", "", false},
+		{"", "default", true},
+	} {
+		if got := s.Valid(tc.project, tc.token); got != tc.want {
+			t.Errorf("Valid(%q, %q) = %v, want %v", tc.project, tc.token, got, tc.want)
+		}
+	}
+}
+
+func TestTokenStoreReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	modTime := time.Now().Add(-time.Hour)
+	writeTokens(t, file, `{"tokens": ["old"]}`, modTime)
+	s, err := NewTokenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTokens(t, file, `{"tokens": ["new"]}`, modTime.Add(time.Minute))
+	if reloaded, err := s.reload(); err != nil || !reloaded {
+		t.Fatalf("reload() = %v, %v, want reloaded", reloaded, err)
+	}
+	if s.Valid("demo1/demo1pj1", "old") || !s.Valid("demo1/demo1pj1", "new") {
+		t.Error("token file was not reloaded")
+	}
+
+	// 誤った内容に更新された場合は以前のトークンを使い続ける
+	writeTokens(t, file, `{"tokens": `, modTime.Add(2*time.Minute))
+	if _, err := s.reload(); err == nil {
+		t.Error("reload() error = nil, want invalid file")
+	}
+	if !s.Valid("demo1/demo1pj1", "new") {
+		t.Error("previous tokens were discarded")
+	}
+}
+
+func TestTokenStoreFromEnv(t *testing.T) {
+	t.Setenv("WEBHOOK_TOKEN", "usagisan")
+	s, err := NewTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Valid("demo1/demo1pj1", "usagisan") || s.Valid("demo1/demo1pj1", "usagisa") {
+		t.Error("WEBHOOK_TOKEN was not used")
+	}
+	if _, err := NewTokenStore(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("NewTokenStore() error = nil, want missing file")
+	}
+}
+
+func TestProjectAllowlist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokens(t, file, `{"tokens": ["gitlab-token"], "allowedProjects": ["demo1/*"]}`, time.Now())
+	tokens, err := NewTokenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tokens.Allowed("demo1/demo1pj1") || tokens.Allowed("demo2/demo2pj1") || tokens.Allowed("") {
+		t.Error("Allowed() does not follow allowedProjects")
+	}
+
+	q, err := NewQueue(t.TempDir(), 1, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := webhookHandler(q, tokens, defaultMaxBodyBytes)
+	allowed := fixture(t, "gitlab_merge_request_open.json")
+	// 処理しないイベントは許可したプロジェクトかに関わらずそのまま応答する
+	ignored := bytes.Replace(allowed, []byte(`"action": "open"`), []byte(`"action": "update"`), 1)
+	for _, tc := range []struct {
+		body    []byte
+		project string
+		want    int
+	}{
+		{allowed, "demo1/demo1pj1", http.StatusAccepted},
+		{allowed, "demo2/demo2pj1", http.StatusForbidden},
+		{ignored, "demo1/demo1pj1", http.StatusOK},
+		{ignored, "demo2/demo2pj1", http.StatusOK},
+	} {
+		body := bytes.ReplaceAll(tc.body, []byte("demo1/demo1pj1"), []byte(tc.project))
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("X-Gitlab-Token", "gitlab-token")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.project, rec.Code, tc.want)
+		}
+	}
+}
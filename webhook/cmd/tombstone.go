@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	tombstoneFile = "tombstones.json"
+	// キューのディレクトリのファイルはイベントとして読み込むため、サブディレクトリに保存する
+	tombstoneDir = "tombstones"
+)
+
+// tombstonePath はトゥームストーンを保存するファイルを返す
+// 環境変数 TOMBSTONE_FILE がなければキューのディレクトリのサブディレクトリに保存する
+// 以前のバージョンがキューのディレクトリに保存したファイルは移動する
+func tombstonePath(queueDir string) (string, error) {
+	if file := os.Getenv("TOMBSTONE_FILE"); file != "" {
+		return file, nil
+	}
+	file := filepath.Join(queueDir, tombstoneDir, tombstoneFile)
+	legacy := filepath.Join(queueDir, tombstoneFile)
+	if _, err := os.Stat(legacy); err == nil {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+				return "", err
+			}
+			if err := os.Rename(legacy, file); err != nil {
+				return "", err
+			}
+		}
+	}
+	return file, nil
+}
+
+// Tombstones はマージ・クローズしたマージリクエストを保持する
+// 遅れて届いたオープンのイベントで削除済みのレビュー環境を作り直さないために利用する
+type Tombstones struct {
+	path string
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// NewTombstones はファイルに保存されたマージリクエストを読み込む
+// ttlを過ぎたものは保持しない
+func NewTombstones(file string, ttl time.Duration) (*Tombstones, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return nil, err
+	}
+	t := &Tombstones{
+		path:    file,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]time.Time{},
+	}
+	b, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &t.entries); err != nil {
+		return nil, fmt.Errorf("%s is broken: %w", t.path, err)
+	}
+	return t, nil
+}
+
+// Add はマージ・クローズしたマージリクエストを記録する
+func (t *Tombstones) Add(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[key] = t.now()
+	return t.save()
+}
+
+// Has はマージ・クローズ済みのマージリクエストか判定する
+func (t *Tombstones) Has(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	closed, ok := t.entries[key]
+	return ok && t.now().Sub(closed) <= t.ttl
+}
+
+// 呼び出し元でロックを取得していること
+func (t *Tombstones) save() error {
+	now := t.now()
+	for key, closed := range t.entries {
+		if now.Sub(closed) > t.ttl {
+			delete(t.entries, key)
+		}
+	}
+	b, err := json.Marshal(t.entries)
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	file := filepath.Join(t.TempDir(), tombstoneFile)
+	tombstones, err := NewTombstones(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tombstones.now = func() time.Time { return now }
+	if err := tombstones.Add("demo1/pj1!1"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewTombstones(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.now = func() time.Time { return now.Add(time.Minute) }
+	if !reopened.Has("demo1/pj1!1") {
+		t.Error("Has() = false for merged MergeRequest")
+	}
+	if reopened.Has("demo1/pj1!2") {
+		t.Error("Has() = true for unknown MergeRequest")
+	}
+	reopened.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if reopened.Has("demo1/pj1!1") {
+		t.Error("Has() = true after ttl")
+	}
+}
+
+// トゥームストーンとイベントを同じキューのディレクトリに保存しても再起動できる
+func TestTombstonesWithQueueRestart(t *testing.T) {
+	dir := t.TempDir()
+	// 以前のバージョンはキューのディレクトリに直接保存していた
+	if err := os.WriteFile(filepath.Join(dir, tombstoneFile), []byte(`{"demo1/pj1!1":"2099-01-01T00:00:00Z"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := tombstonePath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstones, err := NewTombstones(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tombstoneFile)); !os.IsNotExist(err) {
+		t.Errorf("legacy tombstone file was not moved: %v", err)
+	}
+	if err := tombstones.Add("demo1/pj1!2"); err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue(&Event{CorrelationID: "uuid-1", Body: []byte(`{"object_kind":"merge_request"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	// キューが書き込んでいないファイルはイベントとして読み込まない
+	if err := os.WriteFile(filepath.Join(dir, "notes.json"), []byte(`{}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewQueue(dir, 3, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatalf("NewQueue() after restart error = %v", err)
+	}
+	if len(restarted.pending) != 1 {
+		t.Fatalf("pending = %d, want 1", len(restarted.pending))
+	}
+	processed := 0
+	runUntil(t, restarted, func(context.Context, *Event) error {
+		processed++
+		return nil
+	}, func() bool {
+		restarted.mu.Lock()
+		defer restarted.mu.Unlock()
+		return len(restarted.pending) == 0
+	})
+	if processed != 1 {
+		t.Errorf("processed = %d, want 1", processed)
+	}
+	if dead, err := restarted.DeadLetters(); err != nil || len(dead) != 0 {
+		t.Errorf("DeadLetters() = %d, %v, want none", len(dead), err)
+	}
+	if _, err := NewQueue(dir, 3, time.Millisecond, time.Hour); err != nil {
+		t.Errorf("NewQueue() after processing error = %v", err)
+	}
+	reopened, err := NewTombstones(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.Has("demo1/pj1!1") || !reopened.Has("demo1/pj1!2") {
+		t.Error("tombstones were lost")
+	}
+}